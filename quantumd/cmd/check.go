@@ -5,10 +5,13 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/control"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
 )
@@ -20,9 +23,10 @@ func init() {
 var checkCmd = &cobra.Command{
 	Use:   "check",
 	Short: "Check for missing files and list uploaded files with their hashes.",
-	Long: `Queries zstor metadata to list all uploaded files, showing their
-remote hash versus their current local hash. It helps in verifying the integrity
-of the stored files. It also checks for any pending uploads.`,
+	Long: `Lists all uploaded files, showing their remote hash versus their current
+local hash. It helps in verifying the integrity of the stored files. It also
+checks for any pending uploads. The remote hashes come from the running daemon,
+or from the zstor metadata if the daemon can't be reached.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfg, err := config.LoadConfig(ConfigFile)
 		if err != nil {
@@ -30,26 +34,20 @@ of the stored files. It also checks for any pending uploads.`,
 		}
 
 		// Get all eligible files for upload
-		eligibleFiles, err := util.GetEligibleZdbFiles(cfg.ZdbRootPath)
+		eligibleFiles, err := util.GetEligibleZdbFiles(cfg.ZdbRootPath, cfg.Namespaces)
 		if err != nil {
 			return fmt.Errorf("failed to get eligible files: %w", err)
 		}
 
-		// Get all metadata from zstor once
-		zstorClient, err := zstor.NewClient(cfg.ZstorConfigPath)
+		// A running daemon already knows what was uploaded, so only decode
+		// all metadata ourselves when it can't be reached
+		filenameMetadata, err := remoteChecksumsFromDaemon(cfg.ControlSocket)
 		if err != nil {
-			return fmt.Errorf("failed to create zstor client: %w", err)
-		}
-
-		allMetadata, err := zstorClient.GetAllMetadata()
-		if err != nil {
-			return fmt.Errorf("failed to get metadata: %w", err)
-		}
-
-		// Assign filenames to metadata once
-		filenameMetadata, err := zstor.AssignFilenamesToMetadata(eligibleFiles, allMetadata, cfg.ZdbRootPath)
-		if err != nil {
-			return fmt.Errorf("failed to assign filenames to metadata: %w", err)
+			fmt.Printf("Daemon not reachable (%v), reading metadata from zstor...\n\n", err)
+			filenameMetadata, err = remoteChecksumsFromZstor(cfg, eligibleFiles)
+			if err != nil {
+				return err
+			}
 		}
 
 		if err := checkAndPrintHashes(eligibleFiles, filenameMetadata, cfg.ZdbRootPath); err != nil {
@@ -60,10 +58,53 @@ of the stored files. It also checks for any pending uploads.`,
 			return fmt.Errorf("error during pending upload check: %w", err)
 		}
 
+		if err := checkDeadLetters(cfg.DatabasePath); err != nil {
+			return fmt.Errorf("error during dead-letter check: %w", err)
+		}
+
 		return nil
 	},
 }
 
+// remoteChecksumsFromDaemon builds the remote view of all uploaded files from
+// the daemon's upload journal. Only the checksums are filled in.
+func remoteChecksumsFromDaemon(socketPath string) (map[string]zstor.Metadata, error) {
+	files, err := control.NewClient(socketPath).Files(string(journal.StateUploaded))
+	if err != nil {
+		return nil, err
+	}
+
+	filenameMetadata := make(map[string]zstor.Metadata, len(files))
+	for _, file := range files {
+		checksum, err := hex.DecodeString(file.RemoteChecksum)
+		if err != nil || len(checksum) == 0 {
+			continue
+		}
+		filenameMetadata[file.Path] = zstor.Metadata{Checksum: checksum}
+	}
+	return filenameMetadata, nil
+}
+
+// remoteChecksumsFromZstor decodes all metadata from zstor and matches it to
+// the eligible files
+func remoteChecksumsFromZstor(cfg *config.Config, eligibleFiles []string) (map[string]zstor.Metadata, error) {
+	zstorClient, err := zstor.NewExecClient(cfg.ZstorConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstor client: %w", err)
+	}
+
+	allMetadata, err := zstorClient.GetAllMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+
+	filenameMetadata, err := zstor.AssignFilenamesToMetadata(eligibleFiles, allMetadata, cfg.ZdbRootPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign filenames to metadata: %w", err)
+	}
+	return filenameMetadata, nil
+}
+
 func checkAndPrintHashes(eligibleFiles []string, filenameMetadata map[string]zstor.Metadata, zdbRootPath string) error {
 	var (
 		mismatches int
@@ -166,3 +207,42 @@ func checkPendingUploads(eligibleFiles []string, filenameMetadata map[string]zst
 
 	return nil
 }
+
+func checkDeadLetters(databasePath string) error {
+	// The journal only exists once the daemon has run
+	if _, err := os.Stat(databasePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	j, err := journal.Open(databasePath)
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	deadLetters, err := j.ListByState(journal.StateDead)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	if len(deadLetters) == 0 {
+		fmt.Println("Dead-letter Summary: No quarantined uploads.")
+		return nil
+	}
+
+	paths := make([]string, 0, len(deadLetters))
+	for path := range deadLetters {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fmt.Println("Dead-letter Report:")
+	for _, path := range paths {
+		entry := deadLetters[path]
+		fmt.Printf(" - %s (%d attempts, last at %s): %s\n", path, entry.Attempts,
+			entry.UpdatedAt.Format("2006-01-02 15:04:05"), entry.LastError)
+	}
+	fmt.Printf("Dead-letter Summary: %d files are quarantined. Use 'quantumd rearm' to retry them.\n", len(deadLetters))
+	return nil
+}
@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/control"
+)
+
+var (
+	ctlFileStates   []string
+	ctlScrubsFailed bool
+	ctlRepairsLimit int
+)
+
+func init() {
+	ctlFilesCmd.Flags().StringSliceVarP(&ctlFileStates, "state", "s", nil, "Only list files in these states (pending, uploading, uploaded, awaiting_data, failed, verify_failed, dead)")
+
+	ctlScrubsCmd.Flags().BoolVar(&ctlScrubsFailed, "failed", false, "Only list files whose last scrub failed")
+
+	ctlRepairsCmd.Flags().IntVarP(&ctlRepairsLimit, "limit", "n", 50, "Number of most recent repairs to list, 0 for all")
+
+	ctlCmd.AddCommand(ctlStatusCmd)
+	ctlCmd.AddCommand(ctlFilesCmd)
+	ctlCmd.AddCommand(ctlUploadCmd)
+	ctlCmd.AddCommand(ctlRetryCmd)
+	ctlCmd.AddCommand(ctlRefreshCmd)
+	ctlCmd.AddCommand(ctlBackendsCmd)
+	ctlCmd.AddCommand(ctlScrubCmd)
+	ctlCmd.AddCommand(ctlScrubsCmd)
+	ctlCmd.AddCommand(ctlRepairsCmd)
+	rootCmd.AddCommand(ctlCmd)
+}
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Inspect and control a running daemon",
+	Long: `Talks to the management API of a running quantumd daemon over its
+control socket, which is set with control_socket in the config.`,
+}
+
+var ctlStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show daemon version, uptime and upload counts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		status, err := client.Status()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Version:              %s\n", status.Version)
+		fmt.Printf("Started:              %s (up %s)\n", status.StartedAt.Format("2006-01-02 15:04:05"), status.Uptime)
+		fmt.Printf("Queued uploads:       %d\n", status.QueueDepth)
+		fmt.Printf("Uploads in flight:    %d\n", status.UploadsInFlight)
+		fmt.Printf("Retrievals in flight: %d\n", status.RetrievalsInFlight)
+		if status.Degraded {
+			fmt.Printf("Degraded:             %s\n", status.DegradedReason)
+		}
+
+		states := make([]string, 0, len(status.Files))
+		for state := range status.Files {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		fmt.Println("Files:")
+		for _, state := range states {
+			fmt.Printf("  %-14s %d\n", state, status.Files[state])
+		}
+		return nil
+	},
+}
+
+var ctlFilesCmd = &cobra.Command{
+	Use:   "files",
+	Short: "List files and their upload state",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		files, err := client.Files(ctlFileStates...)
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			fmt.Println("No files found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tSTATE\tATTEMPTS\tUPDATED\tLAST ERROR")
+		for _, file := range files {
+			state := file.State
+			if file.Evicted {
+				state += " (evicted)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				file.Path,
+				state,
+				file.Attempts,
+				file.UpdatedAt.Format("2006-01-02 15:04:05"),
+				file.LastError)
+		}
+		return w.Flush()
+	},
+}
+
+var ctlUploadCmd = &cobra.Command{
+	Use:   "upload <file>...",
+	Short: "Upload files right away, skipping any backoff",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		for _, path := range args {
+			if err := client.Upload(path); err != nil {
+				return fmt.Errorf("failed to queue upload of %s: %w", path, err)
+			}
+			fmt.Printf("Queued upload of %s\n", path)
+		}
+		return nil
+	},
+}
+
+var ctlRetryCmd = &cobra.Command{
+	Use:   "retry",
+	Short: "Run a retry cycle now",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		if err := client.Retry(); err != nil {
+			return err
+		}
+		fmt.Println("Retry cycle triggered.")
+		return nil
+	},
+}
+
+var ctlRefreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Refresh zstor metadata now",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		if err := client.RefreshMetadata(); err != nil {
+			return err
+		}
+		fmt.Println("Metadata refresh triggered.")
+		return nil
+	},
+}
+
+var ctlBackendsCmd = &cobra.Command{
+	Use:   "backends",
+	Short: "Show backend health as last seen by the daemon",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		backends, err := client.Backends()
+		if err != nil {
+			return err
+		}
+
+		if len(backends) == 0 {
+			fmt.Println("No backend statuses found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDRESS\tTYPE\tNAMESPACE\tSTATUS\tLAST SEEN")
+		for _, backend := range backends {
+			statusText := "DEAD"
+			if backend.Alive {
+				statusText = "ALIVE"
+			}
+			lastSeen := "Never"
+			if !backend.LastSeen.IsZero() {
+				lastSeen = backend.LastSeen.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				backend.Address, backend.BackendType, backend.Namespace, statusText, lastSeen)
+		}
+		return w.Flush()
+	},
+}
+
+var ctlScrubCmd = &cobra.Command{
+	Use:   "scrub",
+	Short: "Start a scrub of stored files now",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		if err := client.Scrub(); err != nil {
+			return err
+		}
+		fmt.Println("Scrub triggered, results are logged and listed by 'quantumd ctl scrubs'.")
+		return nil
+	},
+}
+
+var ctlScrubsCmd = &cobra.Command{
+	Use:   "scrubs",
+	Short: "List the result of the last scrub of each file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		scrubs, err := client.Scrubs()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tRESULT\tSHARDS\tSCRUBBED\tERROR")
+		listed := 0
+		for _, scrub := range scrubs {
+			if ctlScrubsFailed && scrub.Result != "failed" {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%s\n",
+				scrub.Path,
+				scrub.Result,
+				scrub.HealthyShards,
+				scrub.HealthyShards+scrub.DamagedShards,
+				scrub.ScrubbedAt.Format("2006-01-02 15:04:05"),
+				scrub.Error)
+			listed++
+		}
+		if listed == 0 {
+			fmt.Println("No scrub results found.")
+			return nil
+		}
+		return w.Flush()
+	},
+}
+
+var ctlRepairsCmd = &cobra.Command{
+	Use:   "repairs",
+	Short: "List recent repairs of files with shards on dead backends",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newControlClient()
+		if err != nil {
+			return err
+		}
+		repairs, err := client.Repairs(ctlRepairsLimit)
+		if err != nil {
+			return err
+		}
+
+		if len(repairs) == 0 {
+			fmt.Println("No repairs found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tPATH\tACTION\tRESULT\tSHARDS\tERROR")
+		for _, repair := range repairs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\n",
+				repair.RepairedAt.Format("2006-01-02 15:04:05"),
+				repair.Path,
+				repair.Action,
+				repair.Result,
+				repair.HealthyShards,
+				repair.ExpectedShards,
+				repair.Error)
+		}
+		return w.Flush()
+	},
+}
+
+// newControlClient creates a client for the control socket from the config
+func newControlClient() (*control.Client, error) {
+	cfg, err := config.LoadConfig(ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return control.NewClient(cfg.ControlSocket), nil
+}
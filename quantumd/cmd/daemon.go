@@ -3,7 +3,11 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/daemon"
@@ -26,27 +30,40 @@ var daemonCmd = &cobra.Command{
 			return err
 		}
 
-		zstorClient, err := zstor.NewClient(cfg.ZstorConfigPath)
+		zstorClient, err := zstor.NewClient(cfg.ZstorConfigPath, cfg.ZstorClient)
 		if err != nil {
 			return fmt.Errorf("failed to initialize zstor client: %w", err)
 		}
 
 		// Initialize zstor metrics scraper
-		metricsScraper, err := zstor.NewMetricsScraper(cfg.ZstorConfigPath)
+		metricsScraper, err := zstor.NewMetricsScraper(cfg.ZstorConfigPath, prometheus.DefaultRegisterer)
 		if err != nil {
 			return fmt.Errorf("failed to initialize zstor metrics scraper: %w", err)
 		}
 
 		// Create daemon instance
-		d, err := daemon.NewDaemon(cfg, zstorClient, metricsScraper)
+		d, err := daemon.NewDaemon(cfg, zstorClient, metricsScraper, Version, prometheus.DefaultRegisterer)
 		if err != nil {
 			return fmt.Errorf("failed to initialize daemon: %w", err)
 		}
 
-		d.Init()
+		if err := d.Init(); err != nil {
+			return fmt.Errorf("failed to start daemon: %w", err)
+		}
+
+		// Stop taking new work on SIGTERM/SIGINT and let in-flight uploads finish
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-sigChan
+			log.Printf("Received %s, shutting down gracefully...", sig)
+			d.Shutdown()
+		}()
+
 		// Run main loop
 		d.Run()
 
+		log.Println("Quantum Daemon exited")
 		return nil
 	},
 }
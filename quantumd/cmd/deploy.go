@@ -41,23 +41,23 @@ The command will retry failed deployments on new nodes from the specified farms
 
 			fmt.Println("Metadata deployments:")
 			for _, deployment := range metaDeployments {
-				fmt.Printf("  Contract ID: %d, Node ID: %d, ZDB Info: %s\n",
+				fmt.Printf("  Contract ID: %d, Node ID: %d, ZDB Info: %+v\n",
 					deployment.ContractID, deployment.NodeID, deployment.Zdbs[0])
 			}
 
 			fmt.Println("Data deployments:")
 			for _, deployment := range dataDeployments {
-				fmt.Printf("  Contract ID: %d, Node ID: %d, ZDB Info: %s\n",
+				fmt.Printf("  Contract ID: %d, Node ID: %d, ZDB Info: %+v\n",
 					deployment.ContractID, deployment.NodeID, deployment.Zdbs[0])
 			}
 			return
 		}
 
-		if len(cfg.MetaNodes) == 0 && len(cfg.Farms) == 0 {
-			fmt.Println("Error: either meta_nodes or farms must be specified in config")
+		if len(cfg.MetaNodes) == 0 && len(cfg.Farms) == 0 && len(cfg.Groups) == 0 {
+			fmt.Println("Error: either meta_nodes, farms or groups must be specified in config")
 			os.Exit(1)
 		}
-		if cfg.ExpectedShards > 0 && len(cfg.DataNodes) == 0 && len(cfg.Farms) == 0 {
+		if cfg.ExpectedShards > 0 && len(cfg.DataNodes) == 0 && len(cfg.Farms) == 0 && len(cfg.Groups) == 0 {
 			fmt.Println("Error: either data_nodes or farms must be specified when expected_shards > 0")
 			os.Exit(1)
 		}
@@ -76,7 +76,19 @@ The command will retry failed deployments on new nodes from the specified farms
 			os.Exit(1)
 		}
 
-		zstorConfig, err := zstor.GenerateRemoteConfig(cfg, metaDeployments, dataDeployments)
+		dataGroups, err := grid.GroupDataDeployments(&gridClient, cfg, dataDeployments)
+		if err != nil {
+			fmt.Printf("Error grouping data backends: %v\n", err)
+			os.Exit(1)
+		}
+
+		existing, err := zstor.LoadExistingConfig(cfg.ZstorConfigPath)
+		if err != nil {
+			fmt.Printf("Error loading existing zstor config: %v\n", err)
+			os.Exit(1)
+		}
+
+		zstorConfig, err := zstor.GenerateRemoteConfig(cfg, metaDeployments, dataGroups, existing)
 		if err != nil {
 			fmt.Printf("Error generating remote config: %v\n", err)
 			os.Exit(1)
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/grid"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/service"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+)
+
+var expandTotalStorageSize string
+
+var expandCmd = &cobra.Command{
+	Use:   "expand",
+	Short: "Grow the storage capacity of an existing deployment",
+	Long: `Grows the data backend ZDBs of an existing deployment in place to fit a new
+total storage size. The size of each data ZDB is computed from the total and
+the shard settings, as with total_storage_size. Once every data ZDB is resized,
+the new size is written to the config, the services are regenerated, and
+zstor and zdbfs are restarted to pick it up. The zstor config is left as is.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runExpand(expandTotalStorageSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	expandCmd.Flags().StringVar(&expandTotalStorageSize, "total-storage-size", "", "New total storage size, such as 2T")
+	expandCmd.MarkFlagRequired("total-storage-size")
+	rootCmd.AddCommand(expandCmd)
+}
+
+func runExpand(totalStorageSize string) error {
+	cfg, err := config.LoadConfig(ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if cfg.ExpectedShards == 0 || cfg.MinShards == 0 {
+		return errors.New("expected_shards and min_shards must be set to calculate data backend size")
+	}
+	for _, group := range cfg.Groups {
+		if group.DataSize != "" {
+			return fmt.Errorf("group %s has its own data_size, which expand doesn't support", group.Name)
+		}
+	}
+
+	totalBytes, err := util.ParseSize(totalStorageSize)
+	if err != nil {
+		return fmt.Errorf("failed to parse total storage size: %w", err)
+	}
+	currentBytes, err := strconv.ParseUint(cfg.ZdbfsSize, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse current zdbfs size: %w", err)
+	}
+	if totalBytes <= currentBytes {
+		return fmt.Errorf("new total storage size %s must be larger than the current %s",
+			util.FormatSize(totalBytes), util.FormatSize(currentBytes))
+	}
+
+	backendSizeBytes, err := util.ComputeBackendSize(int64(totalBytes), int64(cfg.ExpectedShards), int64(cfg.MinShards))
+	if err != nil {
+		return fmt.Errorf("failed to compute backend size: %w", err)
+	}
+	// Convert bytes to GB, rounding up
+	sizeGB := int((backendSizeBytes + (1024*1024*1024 - 1)) / (1024 * 1024 * 1024))
+	fmt.Printf("Growing total storage from %s to %s, %d GB per data backend\n",
+		util.FormatSize(currentBytes), util.FormatSize(totalBytes), sizeGB)
+
+	gridClient, err := grid.NewGridClient(cfg.Network, cfg.Mnemonic, cfg.RelayURL, cfg.RMBTimeout)
+	if err != nil {
+		return errors.Wrap(err, "failed to create grid client")
+	}
+
+	metaDeployments, dataDeployments, err := grid.LoadExistingDeployments(&gridClient, cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to load existing deployments")
+	}
+	if len(dataDeployments) == 0 {
+		return errors.New("no existing data backends found for the given deployment name")
+	}
+
+	// Every data ZDB is resized before anything changes locally. ZDBs that
+	// grew while others failed do no harm, and the command can be run again.
+	var failed []uint32
+	for _, deployment := range dataDeployments {
+		current := deployment.Zdbs[0].SizeGB
+		if current >= uint64(sizeGB) {
+			fmt.Printf("Data ZDB on node %d already has %d GB\n", deployment.NodeID, current)
+			continue
+		}
+		fmt.Printf("Resizing data ZDB on node %d from %d GB to %d GB...\n", deployment.NodeID, current, sizeGB)
+		if err := grid.ResizeZDB(&gridClient, deployment, sizeGB); err != nil {
+			fmt.Printf("warn: %v\n", err)
+			failed = append(failed, deployment.NodeID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to resize the data ZDBs on nodes %v, free up space on those nodes or move their ZDBs, then run expand again", failed)
+	}
+	if expected := cfg.DataBackendsPerGroup() * len(cfg.DataGroups()); len(dataDeployments) < expected {
+		fmt.Printf("warn: only %d of %d data ZDBs exist, run 'quantumd deploy' to add the missing ones at the new size\n",
+			len(dataDeployments), expected)
+	}
+
+	// Keep the new size in the config, so later deployments and setups use it
+	values := map[string]string{"total_storage_size": totalStorageSize}
+	if cfg.DataSize != "" {
+		values["data_size"] = fmt.Sprintf("%dG", sizeGB)
+	}
+	if err := config.UpdateFile(ConfigFile, values); err != nil {
+		return err
+	}
+	cfg, err = config.LoadConfig(ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+
+	// Renders the zdbfs service with the new size. The zstor config is left
+	// alone, since it holds no zdb sizes.
+	if err := service.Setup(cfg, metaDeployments, dataDeployments); err != nil {
+		return errors.Wrap(err, "failed to update services")
+	}
+
+	// zdbfs is unmounted first so nothing is written while zstor restarts,
+	// and mounted again last with the new size
+	// The backends and the config hold the new size by now, so a failed
+	// step is recovered by finishing the restart rather than by going back
+	fmt.Println("Restarting zstor and zdbfs, the filesystem is unavailable until zdbfs is back...")
+	if err := service.StopServiceByName("zdbfs"); err != nil {
+		fmt.Println("zdbfs couldn't be stopped and still runs with the old size. The new size takes effect once zstor and zdbfs are restarted.")
+		return err
+	}
+	if err := service.StopServiceByName("zstor"); err != nil {
+		printExpandRecovery("zstor couldn't be stopped", "zstor", "zdbfs")
+		return err
+	}
+	if err := service.StartServiceByName("zstor"); err != nil {
+		printExpandRecovery("zstor didn't start", "zstor", "zdbfs")
+		return err
+	}
+	if err := service.StartServiceByName("zdbfs"); err != nil {
+		printExpandRecovery("zdbfs didn't start", "zdbfs")
+		return err
+	}
+
+	fmt.Printf("Storage expanded to %s.\n", util.FormatSize(totalBytes))
+	return nil
+}
+
+// printExpandRecovery tells the operator how to finish a restart that failed
+// partway, with the services still to be started in order
+func printExpandRecovery(problem string, services ...string) {
+	fmt.Printf("%s, and the filesystem stays unmounted until zdbfs is started again.\n", problem)
+	fmt.Println("Check 'quantumd services' and the service logs, then run:")
+	for _, name := range services {
+		fmt.Printf("  quantumd start %s\n", name)
+	}
+	fmt.Println("The backends and the config already hold the new size, so expand doesn't need to run again.")
+}
@@ -2,11 +2,12 @@ package cmd
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"net"
-	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/hook"
 )
 
 const hookSocketPath = "/tmp/zdb-hook.sock"
@@ -16,11 +17,22 @@ var hookCmd = &cobra.Command{
 	Use:   "hook [args...]",
 	Short: "A hook to be called by zdb to notify the daemon of events.",
 	Long: `This command is called by zdb when certain events occur.
-It communicates with the main quantumd daemon via a Unix socket, passing all arguments directly.`,
+It sends the event to the main quantumd daemon over a Unix socket as a JSON line,
+and spools it to disk when the daemon can't be reached.`,
 	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		event := hook.NewEvent(args)
+
 		// Connect to the unix socket
 		conn, err := net.Dial("unix", hookSocketPath)
+		if err != nil && !hook.IsBlocking(event.Action) {
+			// Keep the event for the daemon to replay once it's back
+			conn, err = hook.DialOrSpool(hookSocketPath, event)
+			if err == nil && conn == nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "could not connect to quantumd daemon socket at %s, spooled event to %s\n", hookSocketPath, hook.SpoolPath)
+				return nil
+			}
+		}
 		if err != nil {
 			// Log the error to stderr but exit with 0
 			fmt.Fprintf(cmd.ErrOrStderr(), "could not connect to quantumd daemon socket at %s: %v. is the daemon running?\n", hookSocketPath, err)
@@ -28,12 +40,8 @@ It communicates with the main quantumd daemon via a Unix socket, passing all arg
 		}
 		defer conn.Close()
 
-		// Join all arguments into a single space-separated string
-		message := strings.Join(args, " ") + "\n"
-
-		// Write the message to the socket
-		_, err = conn.Write([]byte(message))
-		if err != nil {
+		// Send the event as a single JSON line
+		if err := json.NewEncoder(conn).Encode(event); err != nil {
 			// Log the error to stderr but exit with 0
 			fmt.Fprintf(cmd.ErrOrStderr(), "failed to send hook message to daemon: %v\n", err)
 			return nil
@@ -42,12 +50,16 @@ It communicates with the main quantumd daemon via a Unix socket, passing all arg
 		// Read response from daemon for blocking hooks
 		scanner := bufio.NewScanner(conn)
 		if scanner.Scan() {
-			response := scanner.Text()
-			fmt.Printf("Hook response from daemon: %s\n", response)
+			var reply hook.Reply
+			if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "invalid response from daemon: %v\n", err)
+				return nil
+			}
+			fmt.Printf("Hook response from daemon: %s %s (%dms)\n", event.Action, reply.Status, reply.DurationMs)
 
 			// Exit with appropriate code based on response
-			if strings.HasPrefix(response, "ERROR: ") {
-				return fmt.Errorf("hook failed: %s", response[7:])
+			if reply.Status == hook.StatusError {
+				return fmt.Errorf("hook failed (%s): %s", reply.Code, reply.Error)
 			}
 		}
 
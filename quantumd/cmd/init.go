@@ -47,7 +47,19 @@ It essentially runs 'deploy' followed by 'setup'.`,
 			os.Exit(1)
 		}
 
-		zstorConfig, err := zstor.GenerateRemoteConfig(cfg, metaDeployments, dataDeployments)
+		dataGroups, err := grid.GroupDataDeployments(&gridClient, cfg, dataDeployments)
+		if err != nil {
+			fmt.Printf("Error grouping data backends: %v\n", err)
+			os.Exit(1)
+		}
+
+		existing, err := zstor.LoadExistingConfig(cfg.ZstorConfigPath)
+		if err != nil {
+			fmt.Printf("Error loading existing zstor config: %v\n", err)
+			os.Exit(1)
+		}
+
+		zstorConfig, err := zstor.GenerateRemoteConfig(cfg, metaDeployments, dataGroups, existing)
 		if err != nil {
 			fmt.Printf("Error generating remote config: %v\n", err)
 			os.Exit(1)
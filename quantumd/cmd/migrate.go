@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/deployer"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/workloads"
+	"github.com/spf13/cobra"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/grid"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/service"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// migrateRetryInterval is the pause between passes over the files that still
+// have shards on the old backend
+const migrateRetryInterval = 30 * time.Second
+
+var (
+	migrateFromNode uint32
+	migrateToNode   uint32
+	migrateTimeout  time.Duration
+)
+
+var migrateBackendCmd = &cobra.Command{
+	Use:   "migrate-backend",
+	Short: "Move the backend ZDBs on one node to another node",
+	Long: `Moves the backend ZDBs of this deployment off a node, such as a node that is
+about to be decommissioned. For each ZDB on the node, a replacement of the
+same size is deployed on the target node, or on a node picked from the
+configured farms when no target is given. The replacement takes the old ZDB's
+place in the zstor config and zstor is reloaded.
+
+Then the shards on the old ZDB are moved: files with data shards on it are
+rebuilt by zstor, and zstor stores the metadata of every file again to fill a
+replaced metadata ZDB. The old contract is only
+cancelled once the metadata shows that nothing refers to the old ZDB anymore.
+If that doesn't happen within the timeout, the old ZDB is kept and the
+command can be run again later.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runMigrateBackend(migrateFromNode, migrateToNode, migrateTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	migrateBackendCmd.Flags().Uint32Var(&migrateFromNode, "from-node", 0, "Node to move the backend ZDBs off")
+	migrateBackendCmd.Flags().Uint32Var(&migrateToNode, "to-node", 0, "Node to move the backend ZDBs to, picked from the configured farms if not set")
+	migrateBackendCmd.Flags().DurationVar(&migrateTimeout, "timeout", 2*time.Hour, "How long to wait for the shards to move off each ZDB")
+	migrateBackendCmd.MarkFlagRequired("from-node")
+	rootCmd.AddCommand(migrateBackendCmd)
+}
+
+func runMigrateBackend(fromNode, toNode uint32, timeout time.Duration) error {
+	if toNode != 0 && fromNode == toNode {
+		return errors.New("--to-node must be a different node than --from-node")
+	}
+
+	cfg, err := config.LoadConfig(ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	gridClient, err := grid.NewGridClient(cfg.Network, cfg.Mnemonic, cfg.RelayURL, cfg.RMBTimeout)
+	if err != nil {
+		return errors.Wrap(err, "failed to create grid client")
+	}
+	defer gridClient.Close()
+
+	metaDeployments, dataDeployments, err := grid.LoadExistingDeployments(&gridClient, cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to load existing deployments")
+	}
+
+	moved := 0
+	for _, nodeType := range []string{"meta", "data"} {
+		deployments := &dataDeployments
+		if nodeType == "meta" {
+			deployments = &metaDeployments
+		}
+		for i, old := range *deployments {
+			if old.NodeID != fromNode {
+				continue
+			}
+			replacement, err := migrateZDB(&gridClient, cfg, nodeType, old, metaDeployments, dataDeployments, toNode, timeout)
+			if err != nil {
+				return err
+			}
+			if replacement.ContractID != 0 {
+				(*deployments)[i] = replacement
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		return fmt.Errorf("no backend ZDBs of this deployment found on node %d", fromNode)
+	}
+
+	fmt.Printf("Moved %d backend ZDBs off node %d.\n", moved, fromNode)
+	return nil
+}
+
+// migrateZDB moves a single backend ZDB to a new deployment. Until the zstor
+// config is updated, a failure cancels the new deployment again. After that,
+// the old deployment is kept until its shards have moved, and a later run
+// picks up from there. The replacement is only returned when it was deployed
+// in this run.
+func migrateZDB(gridClient *deployer.TFPluginClient, cfg *config.Config, nodeType string, old workloads.Deployment, meta, data []workloads.Deployment, toNode uint32, timeout time.Duration) (workloads.Deployment, error) {
+	oldBackend, err := zstor.BackendFromDeployment(cfg, old)
+	if err != nil {
+		return workloads.Deployment{}, err
+	}
+	zstorCfg, err := zstor.LoadConfig(cfg.ZstorConfigPath)
+	if err != nil {
+		return workloads.Deployment{}, err
+	}
+
+	var replacement workloads.Deployment
+	var newBackend zstor.BackendConfig
+	if zstorCfg.HasBackend(oldBackend) {
+		fmt.Printf("Deploying a replacement for the %s ZDB on node %d...\n", nodeType, old.NodeID)
+		replacement, err = grid.DeployReplacement(gridClient, cfg, nodeType, old, meta, data, toNode, []uint32{old.NodeID})
+		if err != nil {
+			return workloads.Deployment{}, err
+		}
+
+		newBackend, err = zstor.BackendFromDeployment(cfg, replacement)
+		if err == nil {
+			err = swapZstorBackend(cfg.ZstorConfigPath, oldBackend, newBackend)
+		}
+		if err != nil {
+			if cancelErr := grid.CancelDeployment(gridClient, replacement); cancelErr != nil {
+				fmt.Printf("warn: failed to cancel contract %d of the replacement, cancel it by hand: %v\n", replacement.ContractID, cancelErr)
+			}
+			return workloads.Deployment{}, err
+		}
+		fmt.Printf("zstor config updated, node %d replaces node %d\n", replacement.NodeID, old.NodeID)
+
+		// Rebuilds below run the zstor binary on the new config either way,
+		// so a failed reload only delays the monitor picking it up
+		sm, err := service.NewServiceManager()
+		if err == nil {
+			err = sm.SignalService("zstor", "SIGUSR1")
+		}
+		if err != nil {
+			fmt.Printf("warn: failed to reload zstor, restart it to use the new config: %v\n", err)
+		}
+	} else {
+		fmt.Printf("The %s ZDB on node %d was already replaced in the zstor config, moving its remaining shards\n", nodeType, old.NodeID)
+	}
+
+	if nodeType == "meta" {
+		err = moveMetaShards(cfg.ZstorConfigPath, newBackend, timeout)
+	} else {
+		err = moveDataShards(cfg.ZstorConfigPath, oldBackend, timeout)
+	}
+	if err != nil {
+		return workloads.Deployment{}, fmt.Errorf("%w. The old ZDB on node %d (contract %d) is kept, run the migration again once the problem is solved",
+			err, old.NodeID, old.ContractID)
+	}
+
+	if err := grid.CancelDeployment(gridClient, old); err != nil {
+		return workloads.Deployment{}, fmt.Errorf("shards moved off node %d, but cancelling its contract failed, cancel contract %d by hand: %w",
+			old.NodeID, old.ContractID, err)
+	}
+	fmt.Printf("Cancelled contract %d of the %s ZDB on node %d\n", old.ContractID, nodeType, old.NodeID)
+	return replacement, nil
+}
+
+// swapZstorBackend puts a new backend in the place of an old one in the zstor
+// config
+func swapZstorBackend(zstorConfigPath string, old, replacement zstor.BackendConfig) error {
+	zstorCfg, err := zstor.LoadConfig(zstorConfigPath)
+	if err != nil {
+		return err
+	}
+	if !zstorCfg.ReplaceBackend(old, replacement) {
+		return fmt.Errorf("backend %s is not in the zstor config", old.Address)
+	}
+	return zstorCfg.SaveConfig(zstorConfigPath)
+}
+
+// moveDataShards rebuilds every file with a shard on the old data backend,
+// until the metadata shows none are left or the timeout passes
+func moveDataShards(zstorConfigPath string, old zstor.BackendConfig, timeout time.Duration) error {
+	client, err := zstor.NewExecClient(zstorConfigPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create zstor client")
+	}
+	defer client.MetaStore.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		allMetadata, err := client.GetAllMetadata()
+		if err != nil {
+			return errors.Wrap(err, "failed to read metadata")
+		}
+		var remaining []string
+		for key, metadata := range allMetadata {
+			for _, shard := range metadata.Shards {
+				if shard.CI.IsOn(old) {
+					remaining = append(remaining, key)
+					break
+				}
+			}
+		}
+		if len(remaining) == 0 {
+			fmt.Printf("No files have shards on %s anymore\n", old.Address)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d files still have shards on %s after %s", len(remaining), old.Address, timeout)
+		}
+
+		fmt.Printf("Rebuilding %d files with shards on %s...\n", len(remaining), old.Address)
+		failed := 0
+		for _, key := range remaining {
+			if err := client.RebuildKey(key); err != nil {
+				fmt.Printf("warn: %v\n", err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			fmt.Printf("Failed to rebuild %d files, retrying in %s\n", failed, migrateRetryInterval)
+			time.Sleep(migrateRetryInterval)
+		}
+	}
+}
+
+// moveMetaShards has zstor store the metadata of every file again until the
+// new meta backend holds all of it. zstor writes metadata to all meta backends
+// in its current config, so the shards are encoded by zstor itself. With no
+// replacement given, every meta backend is refilled.
+func moveMetaShards(zstorConfigPath string, replacement zstor.BackendConfig, timeout time.Duration) error {
+	zstorCfg, err := zstor.LoadConfig(zstorConfigPath)
+	if err != nil {
+		return err
+	}
+	var indices []int
+	for i, backend := range zstorCfg.Meta.Config.Backends {
+		if replacement.Address == "" || (backend.Address == replacement.Address && backend.Namespace == replacement.Namespace) {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) == 0 {
+		return fmt.Errorf("meta backend %s is not in the zstor config", replacement.Address)
+	}
+
+	client, err := zstor.NewExecClient(zstorConfigPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create zstor client")
+	}
+	defer client.MetaStore.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, index := range indices {
+		address := zstorCfg.Meta.Config.Backends[index].Address
+		for {
+			missing, failed, err := client.RefillMetaBackend(ctx, index)
+			if err != nil {
+				return errors.Wrap(err, "failed to refill metadata")
+			}
+			if missing == 0 {
+				fmt.Printf("Meta backend %s holds the metadata of all files\n", address)
+				break
+			}
+
+			fmt.Printf("Stored the metadata of %d files again for %s, %d failed\n", missing-failed, address, failed)
+			if failed > 0 {
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("metadata of %d files still couldn't be stored after %s", failed, timeout)
+				case <-time.After(migrateRetryInterval):
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+)
+
+var rearmAll bool
+
+func init() {
+	rearmCmd.Flags().BoolVarP(&rearmAll, "all", "a", false, "Re-arm all quarantined files")
+	rootCmd.AddCommand(rearmCmd)
+}
+
+var rearmCmd = &cobra.Command{
+	Use:   "rearm [file...]",
+	Short: "Re-arm quarantined uploads so the daemon retries them",
+	Long: `Files that failed to upload too many times are moved to a dead-letter
+state and are no longer retried. This command resets their attempt count, so
+the daemon picks them up again on its next retry cycle. Use 'quantumd check'
+to list quarantined files.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !rearmAll && len(args) == 0 {
+			return fmt.Errorf("please specify files to re-arm or use the --all flag")
+		}
+
+		cfg, err := config.LoadConfig(ConfigFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+
+		j, err := journal.Open(cfg.DatabasePath)
+		if err != nil {
+			return err
+		}
+		defer j.Close()
+
+		var paths []string
+		if !rearmAll {
+			paths = args
+		}
+		count, err := j.Rearm(paths...)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Re-armed %d files.\n", count)
+		return nil
+	},
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -18,6 +19,7 @@ import (
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/grid"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/hook"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/service"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
 )
 
@@ -74,7 +76,15 @@ func runRestore() error {
 	}
 
 	// 3. Generate zstor config
-	zstorConfig, err := zstor.GenerateRemoteConfig(cfg, metaDeployments, dataDeployments)
+	dataGroups, err := grid.GroupDataDeployments(&gridClient, cfg, dataDeployments)
+	if err != nil {
+		return errors.Wrap(err, "failed to group data backends")
+	}
+	existing, err := zstor.LoadExistingConfig(cfg.ZstorConfigPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to load existing zstor config")
+	}
+	zstorConfig, err := zstor.GenerateRemoteConfig(cfg, metaDeployments, dataGroups, existing)
 	if err != nil {
 		return errors.Wrap(err, "failed to generate remote config")
 	}
@@ -83,6 +93,15 @@ func runRestore() error {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
+	// Without an existing config, the meta backends are listed in deployment
+	// order, which differs from the order zstor wrote the metadata in once a
+	// backend was replaced
+	if existing == nil {
+		if err := restoreMetaOrder(cfg); err != nil {
+			return errors.Wrap(err, "failed to restore meta backend order")
+		}
+	}
+
 	// 4. Setup hook symlink
 	if err := hook.SetupSymlink(); err != nil {
 		return fmt.Errorf("failed to setup hook symlink: %w", err)
@@ -160,6 +179,44 @@ func runRestore() error {
 	return nil
 }
 
+// restoreMetaOrder reorders the meta backends of the zstor config to match
+// the order of the metadata shards stored on them
+func restoreMetaOrder(cfg *config.Config) error {
+	zstorCfg, err := zstor.LoadConfig(cfg.ZstorConfigPath)
+	if err != nil {
+		return err
+	}
+	store, err := zstor.NewMetaStore(zstorCfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	order, err := store.ShardOrder(ctx)
+	if errors.Is(err, zstor.ErrMetadataNotFound) {
+		fmt.Println("No metadata found to check the meta backend order against, keeping deployment order.")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	backends := zstorCfg.Meta.Config.Backends
+	ordered := make([]zstor.BackendConfig, len(order))
+	changed := false
+	for i, backend := range order {
+		ordered[i] = backends[backend]
+		changed = changed || backend != i
+	}
+	if !changed {
+		return nil
+	}
+	fmt.Println("Reordering meta backends to match the stored metadata...")
+	zstorCfg.Meta.Config.Backends = ordered
+	return zstorCfg.SaveConfig(cfg.ZstorConfigPath)
+}
+
 func waitForServices(cfg *config.Config) error {
 	fmt.Println("Waiting for services to initialize...")
 	timeout := time.After(30 * time.Second)
@@ -254,80 +311,68 @@ func recoverData(cfg *config.Config) error {
 		return errors.Wrap(err, "failed to set temp namespace mode")
 	}
 
-	metaIndexDir := fmt.Sprintf("%s/index/zdbfs-meta", cfg.ZdbRootPath)
-	metaDataDir := fmt.Sprintf("%s/data/zdbfs-meta", cfg.ZdbRootPath)
-	dataIndexDir := fmt.Sprintf("%s/index/zdbfs-data", cfg.ZdbRootPath)
-	dataDataDir := fmt.Sprintf("%s/data/zdbfs-data", cfg.ZdbRootPath)
-
-	fmt.Println("Recovering metadata indexes...")
-	if err := zstorCmd("retrieve", "--file", fmt.Sprintf("%s/zdb-namespace", metaIndexDir)); err != nil {
-		// If the namespace file itself isn't found, it's a real error.
-		if errors.Is(err, os.ErrNotExist) || strings.Contains(err.Error(), "not found") {
-			fmt.Println("No metadata namespace info found, which might be okay. Continuing...")
-		} else {
-			return errors.Wrap(err, "failed to retrieve metadata namespace info")
+	// zdbfs needs its metadata before anything else, so that namespace goes
+	// first
+	namespaces := cfg.Namespaces.Names()
+	sort.SliceStable(namespaces, func(i, j int) bool {
+		return namespaces[i] == "zdbfs-meta" && namespaces[j] != "zdbfs-meta"
+	})
+	for _, include := range cfg.Namespaces.Include {
+		if util.IsNamespacePattern(include) {
+			fmt.Printf("warn: namespaces matching %q can't be restored by name, only namespaces listed explicitly are restored\n", include)
 		}
 	}
 
-	for i := 0; ; i++ {
-		filePath := fmt.Sprintf("%s/i%d", metaIndexDir, i)
-		err := zstorCmd("retrieve", "--file", filePath)
-		if err != nil {
-			if err.Error() == "not found" {
-				fmt.Printf("Finished retrieving metadata indexes at i%d.\n", i-1)
-				break
-			}
-			return errors.Wrapf(err, "error retrieving metadata index %s", filePath)
+	for _, namespace := range namespaces {
+		if err := recoverNamespace(cfg, namespace, zstorCmd); err != nil {
+			return err
 		}
 	}
 
-	fmt.Println("Retrieving latest metadata data file...")
-	lastMetaIndex, err := findLastIndex(metaIndexDir)
-	if err != nil {
-		fmt.Printf("Could not find last metadata index, this might be okay if no data was written: %v\n", err)
-	} else {
-		if err := zstorCmd("retrieve", "--file", fmt.Sprintf("%s/d%d", metaDataDir, lastMetaIndex)); err != nil {
-			if err.Error() != "not found" {
-				return errors.Wrap(err, "failed to retrieve latest metadata data file")
-			}
-			fmt.Println("Latest metadata data file not found, which might be okay.")
-		}
-	}
+	return nil
+}
+
+// recoverNamespace retrieves the namespace info and all index files of a
+// namespace, and the data file that was last being written to. Older data
+// files are retrieved on demand through the missing-data hook.
+func recoverNamespace(cfg *config.Config, namespace string, zstorCmd func(args ...string) error) error {
+	indexDir := fmt.Sprintf("%s/index/%s", cfg.ZdbRootPath, namespace)
+	dataDir := fmt.Sprintf("%s/data/%s", cfg.ZdbRootPath, namespace)
 
-	fmt.Println("Recovering data indexes...")
-	if err := zstorCmd("retrieve", "--file", fmt.Sprintf("%s/zdb-namespace", dataIndexDir)); err != nil {
+	fmt.Printf("Recovering indexes of namespace %s...\n", namespace)
+	if err := zstorCmd("retrieve", "--file", fmt.Sprintf("%s/zdb-namespace", indexDir)); err != nil {
+		// If the namespace file itself isn't found, it's a real error.
 		if errors.Is(err, os.ErrNotExist) || strings.Contains(err.Error(), "not found") {
-			fmt.Println("No data namespace info found, which might be okay. Continuing...")
+			fmt.Printf("No namespace info found for %s, which might be okay. Continuing...\n", namespace)
 		} else {
-			return errors.Wrap(err, "failed to retrieve data namespace info")
+			return errors.Wrapf(err, "failed to retrieve namespace info of %s", namespace)
 		}
 	}
 
 	for i := 0; ; i++ {
-		filePath := fmt.Sprintf("%s/i%d", dataIndexDir, i)
+		filePath := fmt.Sprintf("%s/i%d", indexDir, i)
 		err := zstorCmd("retrieve", "--file", filePath)
 		if err != nil {
 			if err.Error() == "not found" {
-				fmt.Printf("Finished retrieving data indexes at i%d.\n", i-1)
+				fmt.Printf("Finished retrieving indexes of %s at i%d.\n", namespace, i-1)
 				break
 			}
-			return errors.Wrapf(err, "error retrieving data index %s", filePath)
+			return errors.Wrapf(err, "error retrieving index %s", filePath)
 		}
 	}
 
-	fmt.Println("Retrieving latest data data file...")
-	lastDataIndex, err := findLastIndex(dataIndexDir)
+	fmt.Printf("Retrieving latest data file of namespace %s...\n", namespace)
+	lastIndex, err := findLastIndex(indexDir)
 	if err != nil {
-		fmt.Printf("Could not find last data index, this might be okay if no data was written: %v\n", err)
-	} else {
-		if err := zstorCmd("retrieve", "--file", fmt.Sprintf("%s/d%d", dataDataDir, lastDataIndex)); err != nil {
-			if err.Error() != "not found" {
-				return errors.Wrap(err, "failed to retrieve latest data data file")
-			}
-			fmt.Println("Latest data data file not found, which might be okay.")
+		fmt.Printf("Could not find last index of %s, this might be okay if no data was written: %v\n", namespace, err)
+		return nil
+	}
+	if err := zstorCmd("retrieve", "--file", fmt.Sprintf("%s/d%d", dataDir, lastIndex)); err != nil {
+		if err.Error() != "not found" {
+			return errors.Wrapf(err, "failed to retrieve latest data file of %s", namespace)
 		}
+		fmt.Printf("Latest data file of %s not found, which might be okay.\n", namespace)
 	}
-
 	return nil
 }
 
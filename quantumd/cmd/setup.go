@@ -28,20 +28,10 @@ var (
 )
 
 func DownloadBinaries() error {
-	var quantumdVersion string
-	// Get quantumd version for metadata decoder. We use the same version since
-	// these are released together
-	if Version != "dev" {
-		quantumdVersion = strings.TrimPrefix(Version, "v")
-	} else {
-		quantumdVersion = "dev"
-	}
-
 	binaries := map[string]string{
-		"zdbfs":                  fmt.Sprintf("https://github.com/threefoldtech/0-db-fs/releases/download/v%s/zdbfs-%s-amd64-linux-static", zdbfsVersion, zdbfsVersion),
-		"zdb":                    fmt.Sprintf("https://github.com/threefoldtech/0-db/releases/download/v%s/zdb-%s-linux-amd64-static", zdbVersion, zdbVersion),
-		"zstor":                  fmt.Sprintf("https://github.com/threefoldtech/0-stor_v2/releases/download/v%s/zstor_v2-x86_64-linux-musl", zstorVersion),
-		"zstor-metadata-decoder": fmt.Sprintf("https://github.com/threefoldtech/quantum-storage/releases/download/v%s/zstor-metadata-decoder_linux_amd64", quantumdVersion),
+		"zdbfs": fmt.Sprintf("https://github.com/threefoldtech/0-db-fs/releases/download/v%s/zdbfs-%s-amd64-linux-static", zdbfsVersion, zdbfsVersion),
+		"zdb":   fmt.Sprintf("https://github.com/threefoldtech/0-db/releases/download/v%s/zdb-%s-linux-amd64-static", zdbVersion, zdbVersion),
+		"zstor": fmt.Sprintf("https://github.com/threefoldtech/0-stor_v2/releases/download/v%s/zstor_v2-x86_64-linux-musl", zstorVersion),
 	}
 
 	for name, url := range binaries {
@@ -53,8 +43,6 @@ func DownloadBinaries() error {
 			expectedVersion = zdbVersion
 		case "zstor":
 			expectedVersion = zstorVersion
-		case "zstor-metadata-decoder":
-			expectedVersion = quantumdVersion
 		}
 
 		needsDL, err := needsDownload(name, expectedVersion)
@@ -95,13 +83,6 @@ func needsDownload(binaryName, expectedVersion string) (bool, error) {
 		return true, nil
 	}
 
-	// If quantumd is a dev build, we can't download the corresponding metadata
-	// decoder version. For dev testing, we provide our own decoder binary
-	if currentVersion == "dev" {
-		fmt.Printf("Binary %s has dev version, skipping download\n", binaryName)
-		return false, nil
-	}
-
 	if currentVersion == expectedVersion {
 		fmt.Printf("Binary %s already has correct version %s, skipping download\n", binaryName, expectedVersion)
 		return false, nil
@@ -258,12 +239,7 @@ func getBinaryVersion(binaryPath string) (string, error) {
 				return cleanVersion(versionPart), nil
 			}
 		}
-	} else if strings.Contains(binaryPath, "zstor") && !strings.Contains(binaryPath, "zstor-metadata-decoder") {
-		parts := strings.Fields(outputStr)
-		if len(parts) >= 2 {
-			return cleanVersion(strings.TrimPrefix(parts[1], "v")), nil
-		}
-	} else if strings.Contains(binaryPath, "zstor-metadata-decoder") {
+	} else if strings.Contains(binaryPath, "zstor") {
 		parts := strings.Fields(outputStr)
 		if len(parts) >= 2 {
 			return cleanVersion(strings.TrimPrefix(parts[1], "v")), nil
@@ -4,16 +4,22 @@ import (
 	"fmt"
 	"os"
 	"text/tabwriter"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/control"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
 )
 
 var statusCmd = &cobra.Command{
 	Use:   "status",
-	Short: "Show the current status of zdb backends",
-	Long:  `This command shows the current status of all zdb backends by querying the zstor prometheus endpoint.`,
+	Short: "Show the current status of zdb backends and the recovery point",
+	Long: `This command shows the current status of all zdb backends by querying the zstor prometheus endpoint.
+When the daemon is running, it also shows per namespace how much local data is
+not yet offloaded to the backends and how old it is.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Load config to get zstor config path
 		cfg, err := config.LoadConfig(ConfigFile)
@@ -22,7 +28,7 @@ var statusCmd = &cobra.Command{
 		}
 
 		// Initialize zstor metrics scraper
-		metricsScraper, err := zstor.NewMetricsScraper(cfg.ZstorConfigPath)
+		metricsScraper, err := zstor.NewMetricsScraper(cfg.ZstorConfigPath, prometheus.DefaultRegisterer)
 		if err != nil {
 			return fmt.Errorf("failed to initialize zstor metrics scraper: %w", err)
 		}
@@ -40,7 +46,16 @@ var statusCmd = &cobra.Command{
 			return fmt.Errorf("failed to print backend status: %w", err)
 		}
 
-		return nil
+		fmt.Println()
+		fmt.Println("Recovery Point:")
+		fmt.Println("===============")
+
+		status, err := control.NewClient(cfg.ControlSocket).Status()
+		if err != nil {
+			fmt.Printf("Daemon not reachable: %v\n", err)
+			return nil
+		}
+		return printRPOStatus(status)
 	},
 }
 
@@ -86,3 +101,33 @@ func printBackendStatus(scraper *zstor.MetricsScraper) error {
 	// Flush the writer to ensure all data is written
 	return w.Flush()
 }
+
+func printRPOStatus(status *control.Status) error {
+	if len(status.RPO) == 0 {
+		fmt.Println("Not computed yet, the daemon computes it on each retry cycle.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tOLDEST PENDING\tPENDING FILES\tPENDING SIZE")
+	fmt.Fprintln(w, "---------\t--------------\t-------------\t------------")
+	for _, ns := range status.RPO {
+		age := "-"
+		if !ns.OldestAt.IsZero() {
+			age = (time.Duration(ns.AgeSeconds) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n",
+			ns.Namespace,
+			age,
+			ns.PendingFiles,
+			util.FormatSize(uint64(ns.PendingBytes)))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if status.Degraded {
+		fmt.Printf("\nDEGRADED: %s\n", status.DegradedReason)
+	}
+	return nil
+}
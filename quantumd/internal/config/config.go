@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
@@ -28,22 +29,90 @@ type Config struct {
 	ZdbRootPath          string        `yaml:"zdb_root_path"`
 	QsfsMountpoint       string        `yaml:"qsfs_mountpoint"`
 	CachePath            string        `yaml:"cache_path"`
+	CacheHighWatermark   string        `yaml:"cache_high_watermark"`
+	CacheLowWatermark    string        `yaml:"cache_low_watermark"`
 	RetryInterval        time.Duration `yaml:"retry_interval"`
+	MetaRefreshInterval  time.Duration `yaml:"metadata_refresh_interval"`
+	MetaRescanInterval   time.Duration `yaml:"metadata_rescan_interval"`
+	UploadWorkers        int           `yaml:"upload_workers"`
+	UploadMaxAttempts    int           `yaml:"upload_max_attempts"`
+	UploadBackoffBase    time.Duration `yaml:"upload_backoff_base"`
+	UploadBackoffMax     time.Duration `yaml:"upload_backoff_max"`
+	ShutdownTimeout      time.Duration `yaml:"shutdown_timeout"`
+	HookTimeout          time.Duration `yaml:"hook_timeout"`
+	RPOThreshold         time.Duration `yaml:"rpo_threshold"`
+	ScrubInterval        time.Duration `yaml:"scrub_interval"`
+	ScrubSample          float64       `yaml:"scrub_sample"`
+	ScrubBandwidth       string        `yaml:"scrub_bandwidth"`
+	ScrubScratchPath     string        `yaml:"scrub_scratch_path"`
+	AutoRepair           bool          `yaml:"auto_repair"`
+	RepairDryRun         bool          `yaml:"repair_dry_run"`
+	RepairMaxPerHour     int           `yaml:"repair_max_per_hour"`
+	RepairGracePeriod    time.Duration `yaml:"repair_grace_period"`
+	AutoReplaceBackends  bool          `yaml:"auto_replace_backends"`
+	ReplaceGracePeriod   time.Duration `yaml:"replace_grace_period"`
+	ReplaceAuditLog      string        `yaml:"replace_audit_log"`
 	DatabasePath         string        `yaml:"database_path"`
+	ControlSocket        string        `yaml:"control_socket"`
 	ZdbRotateTime        time.Duration `yaml:"zdb_rotate_time"`
 	ZdbConnectionType    string        `yaml:"zdb_connection_type"`
 	ZdbDataSize          string        `yaml:"zdb_data_size"`
 	ZstorConfigPath      string        `yaml:"zstor_config_path"`
+	ZstorClient          string        `yaml:"zstor_client"`
 	PrometheusPort       int           `yaml:"prometheus_port"`
 	MaxDeploymentRetries int           `yaml:"max_deployment_retries"`
 
+	// Data backend groups, such as one per site, and how many groups and
+	// nodes per group can be lost without losing data
+	Groups          []Group `yaml:"groups"`
+	RedundantGroups int     `yaml:"redundant_groups"`
+	RedundantNodes  int     `yaml:"redundant_nodes"`
+
+	// How nodes picked from farms are ranked, and how many zdbs of a type
+	// may share a farm or country. Zero caps mean no limit.
+	NodeScoring         NodeScoring `yaml:"node_scoring"`
+	MaxShardsPerFarm    int         `yaml:"max_shards_per_farm"`
+	MaxShardsPerCountry int         `yaml:"max_shards_per_country"`
+
+	// Which zdb namespaces are offloaded to zstor, and how
+	Namespaces util.NamespacePolicy `yaml:"namespaces"`
+
 	// For templates and internal use
 	MetaSizeGb   int       `yaml:"-"`
 	DataSizeGb   int       `yaml:"-"`
 	ZdbfsSize    string    `yaml:"-"`
 	MetaBackends []Backend `yaml:"-"`
 	DataBackends []Backend `yaml:"-"`
+
+	// Parsed cache watermarks in bytes, zero when eviction is disabled
+	CacheHighWatermarkBytes uint64 `yaml:"-"`
+	CacheLowWatermarkBytes  uint64 `yaml:"-"`
+
+	// Parsed scrub bandwidth budget in bytes per second
+	ScrubBandwidthBytes uint64 `yaml:"-"`
+}
+
+// Group is a set of data backends deployed on its own farms or nodes, usually
+// one physical site. Each group holds a data zdb for each expected shard.
+type Group struct {
+	Name     string   `yaml:"name"`
+	Farms    []uint64 `yaml:"farms"`
+	Nodes    []uint32 `yaml:"nodes"`
+	DataSize string   `yaml:"data_size"`
+
+	// Parsed data size, the global data backend size unless set
+	DataSizeGb int `yaml:"-"`
+}
+
+// NodeScoring weighs the scores nodes picked from farms are ranked by. Each
+// score is between 0 and 1, and a weight of 0 leaves it out.
+type NodeScoring struct {
+	TimeSinceBoot float64 `yaml:"time_since_boot"`
+	Capacity      float64 `yaml:"capacity"`
+	Price         float64 `yaml:"price"`
+	Diversity     float64 `yaml:"diversity"`
 }
+
 type Backend struct {
 	Address   string
 	Namespace string
@@ -89,6 +158,41 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.RetryInterval = 10 * time.Minute
 	}
 
+	if cfg.MetaRefreshInterval <= 0 {
+		cfg.MetaRefreshInterval = 5 * time.Minute
+	}
+
+	if cfg.MetaRescanInterval <= 0 {
+		cfg.MetaRescanInterval = 24 * time.Hour
+	}
+
+	if cfg.UploadWorkers <= 0 {
+		cfg.UploadWorkers = 4
+	}
+
+	if cfg.UploadMaxAttempts <= 0 {
+		cfg.UploadMaxAttempts = 10
+	}
+
+	if cfg.UploadBackoffBase <= 0 {
+		cfg.UploadBackoffBase = time.Minute
+	}
+
+	if cfg.UploadBackoffMax <= 0 {
+		cfg.UploadBackoffMax = time.Hour
+	}
+	if cfg.UploadBackoffMax < cfg.UploadBackoffBase {
+		cfg.UploadBackoffMax = cfg.UploadBackoffBase
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 2 * time.Minute
+	}
+
+	if cfg.HookTimeout <= 0 {
+		cfg.HookTimeout = 2 * time.Minute
+	}
+
 	if cfg.ZdbRotateTime == 0 {
 		cfg.ZdbRotateTime = cfg.RetryInterval
 	}
@@ -116,10 +220,32 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.QsfsMountpoint = "/mnt/qsfs"
 	}
 
+	if cfg.Namespaces.Include == nil {
+		cfg.Namespaces.Include = util.DefaultIncludedNamespaces
+	}
+	if cfg.Namespaces.Exclude == nil {
+		cfg.Namespaces.Exclude = util.DefaultExcludedNamespaces
+	}
+	if err := cfg.Namespaces.Validate(); err != nil {
+		return nil, err
+	}
+
 	if cfg.ZstorConfigPath == "" {
 		cfg.ZstorConfigPath = "/etc/zstor.toml"
 	}
 
+	if cfg.ZstorClient == "" {
+		cfg.ZstorClient = "socket"
+	}
+
+	if cfg.DatabasePath == "" {
+		cfg.DatabasePath = "/var/lib/quantumd/quantumd.db"
+	}
+
+	if cfg.ControlSocket == "" {
+		cfg.ControlSocket = "/var/run/quantumd.sock"
+	}
+
 	if cfg.DeploymentName == "" {
 		return nil, fmt.Errorf("deployment_name is required in config")
 	}
@@ -134,6 +260,72 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("zdb_data_size cannot be smaller than 524288 bytes (0.5 MB)")
 	}
 
+	// Parse the cache watermarks. Eviction is only enabled when the high
+	// watermark is set, and the low watermark defaults to 80% of it.
+	if cfg.CacheHighWatermark != "" {
+		high, err := util.ParseSize(cfg.CacheHighWatermark)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cache_high_watermark: %w", err)
+		}
+		low := high / 10 * 8
+		if cfg.CacheLowWatermark != "" {
+			low, err = util.ParseSize(cfg.CacheLowWatermark)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse cache_low_watermark: %w", err)
+			}
+		}
+		if low >= high {
+			return nil, fmt.Errorf("cache_low_watermark must be smaller than cache_high_watermark")
+		}
+		cfg.CacheHighWatermarkBytes = high
+		cfg.CacheLowWatermarkBytes = low
+	}
+
+	// Scrubbing is only enabled when an interval is set
+	if cfg.ScrubSample <= 0 || cfg.ScrubSample > 1 {
+		cfg.ScrubSample = 1
+	}
+	if cfg.ScrubBandwidth == "" {
+		cfg.ScrubBandwidth = "10M"
+	}
+	if cfg.ScrubScratchPath == "" {
+		cfg.ScrubScratchPath = "/var/lib/quantumd/scrub"
+	}
+	bandwidth, err := util.ParseSize(cfg.ScrubBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scrub_bandwidth: %w", err)
+	}
+	cfg.ScrubBandwidthBytes = bandwidth
+
+	// Repairs are only run when auto_repair is set
+	if cfg.RepairMaxPerHour <= 0 {
+		cfg.RepairMaxPerHour = 10
+	}
+	if cfg.RepairGracePeriod == 0 {
+		cfg.RepairGracePeriod = 15 * time.Minute
+	}
+
+	// Backends are only replaced when auto_replace_backends is set
+	if cfg.ReplaceGracePeriod == 0 {
+		cfg.ReplaceGracePeriod = 24 * time.Hour
+	}
+	if cfg.ReplaceAuditLog == "" {
+		cfg.ReplaceAuditLog = "/var/lib/quantumd/replacements.log"
+	}
+
+	// Without any weights set, nodes are ranked mostly by how far they are
+	// from the other zdbs of the deployment
+	scoring := cfg.NodeScoring
+	if scoring.TimeSinceBoot < 0 || scoring.Capacity < 0 || scoring.Price < 0 || scoring.Diversity < 0 {
+		return nil, fmt.Errorf("node_scoring weights can't be negative")
+	}
+	if scoring == (NodeScoring{}) {
+		cfg.NodeScoring = NodeScoring{TimeSinceBoot: 1, Capacity: 1, Price: 1, Diversity: 2}
+	}
+	if cfg.MaxShardsPerFarm < 0 || cfg.MaxShardsPerCountry < 0 {
+		return nil, fmt.Errorf("max_shards_per_farm and max_shards_per_country can't be negative")
+	}
+
 	// Parse MetaSize to GB
 	if cfg.MetaSize != "" {
 		metaSizeGb, err := util.ParseSizeToGB(cfg.MetaSize)
@@ -171,6 +363,10 @@ func LoadConfig(path string) (*Config, error) {
 		fmt.Printf("Calculated data backend size: %d GB per backend\n", cfg.DataSizeGb)
 	}
 
+	if err := cfg.parseGroups(); err != nil {
+		return nil, err
+	}
+
 	// If TotalStorageSize is present, use it to calculate zdbfs_size
 	if cfg.TotalStorageSize != "" {
 		totalBytes, err := util.ParseSize(cfg.TotalStorageSize)
@@ -194,3 +390,159 @@ func LoadConfig(path string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// parseGroups checks the data backend groups and fills in their defaults.
+// Losing the redundant groups must leave enough groups to hold the minimal
+// shards, assuming zstor spreads shards evenly over the groups.
+func (cfg *Config) parseGroups() error {
+	if cfg.RedundantGroups < 0 || cfg.RedundantNodes < 0 {
+		return fmt.Errorf("redundant_groups and redundant_nodes can't be negative")
+	}
+	if len(cfg.Groups) == 0 {
+		if cfg.RedundantGroups > 0 {
+			return fmt.Errorf("redundant_groups needs groups to be configured")
+		}
+		return nil
+	}
+	if cfg.ExpectedShards == 0 || cfg.MinShards == 0 {
+		return fmt.Errorf("expected_shards and min_shards must be set when groups are configured")
+	}
+	if len(cfg.DataNodes) > 0 {
+		return fmt.Errorf("data_nodes can't be combined with groups, list the nodes under each group instead")
+	}
+
+	groupOfNode := make(map[uint32]string)
+	groupOfFarm := make(map[uint64]string)
+	for i := range cfg.Groups {
+		group := &cfg.Groups[i]
+		if group.Name == "" {
+			group.Name = fmt.Sprintf("group%d", i+1)
+		}
+		if len(group.Farms) == 0 && len(group.Nodes) == 0 {
+			return fmt.Errorf("group %s needs farms or nodes", group.Name)
+		}
+		for _, node := range group.Nodes {
+			if other, ok := groupOfNode[node]; ok {
+				return fmt.Errorf("node %d is in both group %s and group %s", node, other, group.Name)
+			}
+			groupOfNode[node] = group.Name
+		}
+		for _, farm := range group.Farms {
+			if other, ok := groupOfFarm[farm]; ok {
+				return fmt.Errorf("farm %d is in both group %s and group %s", farm, other, group.Name)
+			}
+			groupOfFarm[farm] = group.Name
+		}
+
+		group.DataSizeGb = cfg.DataSizeGb
+		if group.DataSize != "" {
+			dataSizeGb, err := util.ParseSizeToGB(group.DataSize)
+			if err != nil {
+				return fmt.Errorf("failed to parse data_size of group %s: %w", group.Name, err)
+			}
+			group.DataSizeGb = dataSizeGb
+		}
+	}
+
+	if cfg.RedundantGroups >= len(cfg.Groups) {
+		return fmt.Errorf("redundant_groups must be smaller than the number of groups (%d)", len(cfg.Groups))
+	}
+	if cfg.RedundantNodes >= cfg.ExpectedShards {
+		return fmt.Errorf("redundant_nodes must be smaller than expected_shards")
+	}
+	surviving := len(cfg.Groups) - cfg.RedundantGroups
+	if cfg.ExpectedShards*surviving < cfg.MinShards*len(cfg.Groups) {
+		return fmt.Errorf("expected_shards must be at least %d for the minimal shards to survive losing %d of %d groups",
+			(cfg.MinShards*len(cfg.Groups)+surviving-1)/surviving, cfg.RedundantGroups, len(cfg.Groups))
+	}
+	return nil
+}
+
+// DataGroups returns the data backend groups. Without groups in the config,
+// all data backends form a single group on the global farms and data nodes.
+func (cfg *Config) DataGroups() []Group {
+	if len(cfg.Groups) > 0 {
+		return cfg.Groups
+	}
+	return []Group{{
+		Name:       "default",
+		Farms:      cfg.Farms,
+		Nodes:      cfg.DataNodes,
+		DataSize:   cfg.DataSize,
+		DataSizeGb: cfg.DataSizeGb,
+	}}
+}
+
+// DataBackendsPerGroup returns how many data backends each group gets. zstor
+// spreads the expected shards of a file evenly over the groups, so a group
+// receives ceil(expected_shards / groups) of them, and redundant_nodes more
+// backends let it lose that many nodes and still take all of its shards.
+// Without groups, the single group gets expected_shards + redundant_nodes.
+func (cfg *Config) DataBackendsPerGroup() int {
+	groups := len(cfg.DataGroups())
+	return (cfg.ExpectedShards+groups-1)/groups + cfg.RedundantNodes
+}
+
+// UpdateFile sets top level keys in a config file, keeping the rest of the
+// file as it is. A key is set where it is, or where it's commented out when
+// it's only in a comment, and added at the end otherwise. Top level keys are
+// the ones at the indentation of the first key in the file, so nested keys
+// of the same name are left alone.
+func UpdateFile(path string, values map[string]string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat config file: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	indent := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") && trimmed != "---" {
+			indent = line[:len(line)-len(strings.TrimLeft(line, " "))]
+			break
+		}
+	}
+
+	set := make(map[string]bool)
+	commented := make(map[string]int)
+	for i, line := range lines {
+		if !strings.HasPrefix(line, indent) {
+			continue
+		}
+		rest := line[len(indent):]
+		for key, value := range values {
+			switch {
+			case strings.HasPrefix(rest, key+":"):
+				lines[i] = fmt.Sprintf("%s%s: %q", indent, key, value)
+				set[key] = true
+			case strings.HasPrefix(rest, "#"):
+				// Only the first commented out line, in case the file
+				// lists alternatives
+				_, found := commented[key]
+				if !found && strings.HasPrefix(strings.TrimPrefix(rest[1:], " "), key+":") {
+					commented[key] = i
+				}
+			}
+		}
+	}
+	for key, value := range values {
+		if set[key] {
+			continue
+		}
+		if i, found := commented[key]; found {
+			lines[i] = fmt.Sprintf("%s%s: %q", indent, key, value)
+		} else {
+			lines = append(lines, fmt.Sprintf("%s%s: %q", indent, key, value))
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
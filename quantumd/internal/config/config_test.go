@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{
+			name:   "set",
+			before: "network: main\ntotal_storage_size: \"1T\"\nmin_shards: 2\n",
+			after:  "network: main\ntotal_storage_size: \"2T\"\nmin_shards: 2\n",
+		},
+		{
+			name:   "commented out",
+			before: "network: main\n# total_storage_size is ignored when data_size is set\n#total_storage_size: \"1T\"\n# total_storage_size: \"500G\"\n",
+			after:  "network: main\n# total_storage_size is ignored when data_size is set\ntotal_storage_size: \"2T\"\n# total_storage_size: \"500G\"\n",
+		},
+		{
+			name:   "indented file",
+			before: "---\n  network: main\n  total_storage_size: \"1T\"\n",
+			after:  "---\n  network: main\n  total_storage_size: \"2T\"\n",
+		},
+		{
+			name:   "nested key of the same name",
+			before: "groups:\n  - name: a\n    total_storage_size: \"1T\"\n#   total_storage_size: \"1T\"\nnetwork: main\n",
+			after:  "groups:\n  - name: a\n    total_storage_size: \"1T\"\n#   total_storage_size: \"1T\"\nnetwork: main\ntotal_storage_size: \"2T\"\n",
+		},
+		{
+			name:   "missing",
+			before: "network: main",
+			after:  "network: main\ntotal_storage_size: \"2T\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.before), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := UpdateFile(path, map[string]string{"total_storage_size": "2T"}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.after {
+				t.Errorf("got:\n%s\nwant:\n%s", data, tt.after)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("file mode changed to %v", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestDataBackendsPerGroup(t *testing.T) {
+	tests := []struct {
+		name           string
+		groups         int
+		expectedShards int
+		redundantNodes int
+		want           int
+	}{
+		{"no groups", 0, 20, 0, 20},
+		{"no groups with redundant nodes", 0, 20, 2, 22},
+		{"even split", 2, 32, 0, 16},
+		{"uneven split rounds up", 3, 32, 0, 11},
+		{"redundant nodes on top", 2, 32, 1, 17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ExpectedShards: tt.expectedShards, RedundantNodes: tt.redundantNodes}
+			for i := 0; i < tt.groups; i++ {
+				cfg.Groups = append(cfg.Groups, Group{})
+			}
+			if got := cfg.DataBackendsPerGroup(); got != tt.want {
+				t.Errorf("got %d data backends per group, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Package control holds the types and client of the daemon's management API,
+// served as JSON over HTTP on a local unix socket
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Status is the overall state of a running daemon
+type Status struct {
+	Version            string         `json:"version"`
+	StartedAt          time.Time      `json:"started_at"`
+	Uptime             string         `json:"uptime"`
+	QueueDepth         int            `json:"queue_depth"`
+	UploadsInFlight    int            `json:"uploads_in_flight"`
+	RetrievalsInFlight int            `json:"retrievals_in_flight"`
+	Files              map[string]int `json:"files"`
+
+	// Degraded is set while the RPO of a namespace is over the configured
+	// threshold, explained by DegradedReason
+	Degraded       bool           `json:"degraded"`
+	DegradedReason string         `json:"degraded_reason,omitempty"`
+	RPO            []NamespaceRPO `json:"rpo"`
+}
+
+// NamespaceRPO is the recovery point of a namespace: the local files that
+// have no matching remote checksum, and would be lost if the frontend died
+type NamespaceRPO struct {
+	Namespace string `json:"namespace"`
+	// OldestAt is the modification time of the oldest such file, zero when
+	// everything is offloaded
+	OldestAt     time.Time `json:"oldest_at"`
+	AgeSeconds   float64   `json:"age_seconds"`
+	PendingBytes int64     `json:"pending_bytes"`
+	PendingFiles int       `json:"pending_files"`
+}
+
+// File is the upload state of a single zdb file, as recorded in the journal
+type File struct {
+	Path           string    `json:"path"`
+	State          string    `json:"state"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	LocalChecksum  string    `json:"local_checksum,omitempty"`
+	RemoteChecksum string    `json:"remote_checksum,omitempty"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	Evicted        bool      `json:"evicted,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Backend is the last known status of a zstor backend
+type Backend struct {
+	Address     string    `json:"address"`
+	BackendType string    `json:"backend_type"`
+	Namespace   string    `json:"namespace"`
+	Alive       bool      `json:"alive"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Scrub is the result of the last scrub of a stored file
+type Scrub struct {
+	Path string `json:"path"`
+	// Result is ok, repaired, queued or failed
+	Result        string    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+	HealthyShards int       `json:"healthy_shards"`
+	DamagedShards int       `json:"damaged_shards"`
+	ScrubbedAt    time.Time `json:"scrubbed_at"`
+}
+
+// Repair is a repair of a file with shards on dead backends
+type Repair struct {
+	Path string `json:"path"`
+	// Action is rebuild or store, Result is repaired, queued, failed or
+	// planned
+	Action         string    `json:"action"`
+	Result         string    `json:"result"`
+	Error          string    `json:"error,omitempty"`
+	HealthyShards  int       `json:"healthy_shards"`
+	ExpectedShards int       `json:"expected_shards"`
+	RepairedAt     time.Time `json:"repaired_at"`
+}
+
+// UploadRequest asks the daemon to upload a file right away
+type UploadRequest struct {
+	Path string `json:"path"`
+}
+
+// ErrorResponse is returned by the API for failed requests
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Client talks to the control API of a running daemon
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client for the control socket at the given path
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &Client{
+		http: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+}
+
+// Status returns the daemon status
+func (c *Client) Status() (*Status, error) {
+	var status Status
+	if err := c.do(http.MethodGet, "/v1/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Files returns the files in the given states, or all files if no state is
+// given
+func (c *Client) Files(states ...string) ([]File, error) {
+	path := "/v1/files"
+	if len(states) > 0 {
+		path += "?" + url.Values{"state": states}.Encode()
+	}
+	var files []File
+	if err := c.do(http.MethodGet, path, nil, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Upload queues an upload of a file, regardless of its state or backoff
+func (c *Client) Upload(path string) error {
+	return c.do(http.MethodPost, "/v1/uploads", UploadRequest{Path: path}, nil)
+}
+
+// Retry triggers a retry cycle
+func (c *Client) Retry() error {
+	return c.do(http.MethodPost, "/v1/retry", nil, nil)
+}
+
+// RefreshMetadata triggers a refresh of the zstor metadata
+func (c *Client) RefreshMetadata() error {
+	return c.do(http.MethodPost, "/v1/metadata/refresh", nil, nil)
+}
+
+// Backends returns the status of the zstor backends
+func (c *Client) Backends() ([]Backend, error) {
+	var backends []Backend
+	if err := c.do(http.MethodGet, "/v1/backends", nil, &backends); err != nil {
+		return nil, err
+	}
+	return backends, nil
+}
+
+// Scrub starts a scrub cycle, regardless of when the last one ran
+func (c *Client) Scrub() error {
+	return c.do(http.MethodPost, "/v1/scrub", nil, nil)
+}
+
+// Scrubs returns the result of the last scrub of each file
+func (c *Client) Scrubs() ([]Scrub, error) {
+	var scrubs []Scrub
+	if err := c.do(http.MethodGet, "/v1/scrubs", nil, &scrubs); err != nil {
+		return nil, err
+	}
+	return scrubs, nil
+}
+
+// Repairs returns the most recent repairs, newest first. A limit of zero
+// returns them all.
+func (c *Client) Repairs(limit int) ([]Repair, error) {
+	path := "/v1/repairs"
+	if limit > 0 {
+		path += "?" + url.Values{"limit": {strconv.Itoa(limit)}}.Encode()
+	}
+	var repairs []Repair
+	if err := c.do(http.MethodGet, path, nil, &repairs); err != nil {
+		return nil, err
+	}
+	return repairs, nil
+}
+
+func (c *Client) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored, requests always go to the unix socket
+	req, err := http.NewRequest(method, "http://quantumd"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return fmt.Errorf("daemon returned an error: %s", errResp.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
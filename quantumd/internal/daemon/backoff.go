@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+)
+
+// backoffDelay returns how long to wait before the next upload attempt of a
+// file that has failed the given number of times. The delay doubles with each
+// attempt up to the configured maximum, and a random jitter of up to half the
+// delay keeps files that failed together from being retried together.
+func (d *Daemon) backoffDelay(attempts int) time.Duration {
+	delay := d.cfg.UploadBackoffBase
+	for i := 1; i < attempts && delay < d.cfg.UploadBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > d.cfg.UploadBackoffMax {
+		delay = d.cfg.UploadBackoffMax
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// handleUploadFailure records a failed upload in the journal and either
+// schedules another attempt or moves the file to the dead-letter state once
+// it has used up its attempts
+func (d *Daemon) handleUploadFailure(result uploadResult) {
+	entry, err := d.journal.Get(result.filePath)
+	if err != nil {
+		log.Printf("Failed to read upload journal: %v", err)
+		return
+	}
+	attempts := 1
+	if entry != nil {
+		attempts = entry.Attempts
+	}
+
+	if attempts >= d.cfg.UploadMaxAttempts {
+		log.Printf("Upload of %s failed %d times, moving it to the dead-letter state", result.filePath, attempts)
+		if err := d.journal.MarkDead(result.filePath, result.err); err != nil {
+			log.Printf("Failed to update upload journal: %v", err)
+		}
+		d.updateDeadLetterCount()
+		d.resolveQueuedScrub(result.filePath, result.err)
+		d.resolveQueuedRepairs(result.filePath, result.err)
+		return
+	}
+
+	delay := d.backoffDelay(attempts)
+	log.Printf("Retrying upload of %s in %s (attempt %d/%d)", result.filePath, delay.Round(time.Second), attempts, d.cfg.UploadMaxAttempts)
+	nextAttempt := time.Now().Add(delay)
+	if result.verifyFailed {
+		err = d.journal.MarkVerifyFailed(result.filePath, result.err, nextAttempt)
+	} else {
+		err = d.journal.MarkFailed(result.filePath, result.err, nextAttempt)
+	}
+	if err != nil {
+		log.Printf("Failed to update upload journal: %v", err)
+	}
+	d.scheduleUpload(result.filePath, delay)
+}
+
+// scheduleUpload queues an upload of a single file after a delay
+func (d *Daemon) scheduleUpload(filePath string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		d.QueueUpload([]string{filePath}, isIndexFile(filePath))
+	})
+}
+
+// updateDeadLetterCount refreshes the dead-letter gauge from the journal
+func (d *Daemon) updateDeadLetterCount() {
+	count, err := d.journal.CountByState(journal.StateDead)
+	if err != nil {
+		log.Printf("Failed to count dead-letter files: %v", err)
+		return
+	}
+	d.metrics.deadLetterFiles.Set(float64(count))
+}
@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"bytes"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// evictionCandidate is a local data file that may be removed from the cache
+type evictionCandidate struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// enforceCacheLimits evicts uploaded data files, oldest first, once the local
+// data directory grows past the high watermark, until it's back under the low
+// watermark. Only files whose local checksum matches the uploaded one are
+// evicted, so zdb can always retrieve them again through the missing-data hook.
+// Evictions are recorded in the journal, so the retry cycle leaves the files
+// in zstor rather than retrieving them again.
+func (d *Daemon) enforceCacheLimits() {
+	dataDir := filepath.Join(d.cfg.ZdbRootPath, "data")
+	size, err := dirSize(dataDir)
+	if err != nil {
+		log.Printf("Failed to measure cache size: %v", err)
+		return
+	}
+	d.metrics.cacheSizeBytes.Set(float64(size))
+
+	high := int64(d.cfg.CacheHighWatermarkBytes)
+	low := int64(d.cfg.CacheLowWatermarkBytes)
+	if high == 0 || size <= high {
+		return
+	}
+	log.Printf("Cache size %d bytes is above the high watermark of %d bytes, evicting...", size, high)
+
+	// Eligible files never include the active data file of a namespace
+	eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath, d.cfg.Namespaces)
+	if err != nil {
+		log.Printf("Failed to get eligible files: %v", err)
+		return
+	}
+	entries, err := d.journal.All()
+	if err != nil {
+		log.Printf("Failed to read upload journal: %v", err)
+		return
+	}
+
+	var candidates []evictionCandidate
+	for _, filePath := range eligibleFiles {
+		if isIndexFile(filePath) || d.isUploadPending(filePath) {
+			continue
+		}
+		if !d.cfg.Namespaces.Evictable(util.NamespaceOf(filePath)) {
+			continue
+		}
+		entry, exists := entries[filePath]
+		if !exists || entry.State != journal.StateUploaded {
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, evictionCandidate{
+			path:    filePath,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.Before(candidates[j].modTime)
+	})
+
+	evicted := 0
+	for _, candidate := range candidates {
+		if size <= low {
+			break
+		}
+
+		localHash := zstor.GetLocalHash(candidate.path)
+		if localHash == nil || !bytes.Equal(localHash, entries[candidate.path].RemoteChecksum) {
+			log.Printf("Not evicting %s, local file doesn't match the uploaded checksum", candidate.path)
+			continue
+		}
+
+		// Record the eviction first, a file that is gone without it would be
+		// retrieved again by the next retry cycle
+		if err := d.journal.MarkEvicted(candidate.path); err != nil {
+			log.Printf("Failed to evict %s: %v", candidate.path, err)
+			continue
+		}
+		if err := os.Remove(candidate.path); err != nil {
+			log.Printf("Failed to evict %s: %v", candidate.path, err)
+			if err := d.journal.ClearEvicted(candidate.path); err != nil {
+				log.Printf("Failed to update journal for %s: %v", candidate.path, err)
+			}
+			continue
+		}
+		size -= candidate.size
+		evicted++
+		d.metrics.cacheEvictions.Inc()
+		d.metrics.cacheEvictedBytes.Add(float64(candidate.size))
+	}
+	d.metrics.cacheSizeBytes.Set(float64(size))
+
+	if size > low {
+		log.Printf("Evicted %d files, cache size %d bytes is still above the low watermark of %d bytes", evicted, size, low)
+	} else {
+		log.Printf("Evicted %d files, cache size is now %d bytes", evicted, size)
+	}
+}
+
+// dirSize returns the total size of the regular files below a directory
+func dirSize(root string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while walking, zstor removes them too
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
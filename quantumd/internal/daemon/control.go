@@ -0,0 +1,275 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/control"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+)
+
+// newControlServer sets up the routes of the control API
+func (d *Daemon) newControlServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", d.handleControlStatus)
+	mux.HandleFunc("GET /v1/files", d.handleControlFiles)
+	mux.HandleFunc("POST /v1/uploads", d.handleControlUpload)
+	mux.HandleFunc("POST /v1/retry", d.handleControlRetry)
+	mux.HandleFunc("POST /v1/metadata/refresh", d.handleControlRefresh)
+	mux.HandleFunc("GET /v1/backends", d.handleControlBackends)
+	mux.HandleFunc("POST /v1/scrub", d.handleControlScrub)
+	mux.HandleFunc("GET /v1/scrubs", d.handleControlScrubs)
+	mux.HandleFunc("GET /v1/repairs", d.handleControlRepairs)
+	return &http.Server{Handler: mux}
+}
+
+// StartControlServer serves the control API on the configured unix socket
+func (d *Daemon) StartControlServer() {
+	socketPath := d.cfg.ControlSocket
+	if err := os.RemoveAll(socketPath); err != nil {
+		log.Fatalf("Failed to remove existing control socket: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		log.Fatalf("Failed to create control socket directory: %v", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatalf("Failed to listen on control socket %s: %v", socketPath, err)
+	}
+	// The API can force uploads, so keep it to the daemon's own user
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		log.Printf("Failed to restrict control socket permissions: %v", err)
+	}
+
+	log.Printf("Control API listening on %s", socketPath)
+	if err := d.controlServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Control API stopped: %v", err)
+	}
+}
+
+func (d *Daemon) handleControlStatus(w http.ResponseWriter, r *http.Request) {
+	counts, err := d.journal.CountsByState()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	files := make(map[string]int, len(counts))
+	for state, count := range counts {
+		files[string(state)] = count
+	}
+	now := time.Now()
+	reason := d.degradedReason(now)
+	writeJSON(w, http.StatusOK, control.Status{
+		Version:            d.version,
+		StartedAt:          d.startedAt,
+		Uptime:             time.Since(d.startedAt).Round(time.Second).String(),
+		QueueDepth:         d.uploadQueue.Len(),
+		UploadsInFlight:    int(d.activeUploads.Load()),
+		RetrievalsInFlight: int(d.activeRetrievals.Load()),
+		Files:              files,
+		Degraded:           reason != "",
+		DegradedReason:     reason,
+		RPO:                d.rpoStatus(now),
+	})
+}
+
+func (d *Daemon) handleControlFiles(w http.ResponseWriter, r *http.Request) {
+	var states []journal.State
+	for _, state := range r.URL.Query()["state"] {
+		states = append(states, journal.State(state))
+	}
+
+	var (
+		entries map[string]journal.Entry
+		err     error
+	)
+	if len(states) > 0 {
+		entries, err = d.journal.ListByState(states...)
+	} else {
+		entries, err = d.journal.All()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	files := make([]control.File, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, control.File{
+			Path:           entry.Path,
+			State:          string(entry.State),
+			Attempts:       entry.Attempts,
+			LastError:      entry.LastError,
+			LocalChecksum:  hex.EncodeToString(entry.LocalChecksum),
+			RemoteChecksum: hex.EncodeToString(entry.RemoteChecksum),
+			NextAttemptAt:  entry.NextAttemptAt,
+			Evicted:        entry.Evicted,
+			UpdatedAt:      entry.UpdatedAt,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	writeJSON(w, http.StatusOK, files)
+}
+
+func (d *Daemon) handleControlUpload(w http.ResponseWriter, r *http.Request) {
+	var req control.UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	filePath := filepath.Clean(req.Path)
+	if !filepath.IsAbs(filePath) {
+		writeError(w, http.StatusBadRequest, errors.New("path must be absolute"))
+		return
+	}
+	// Only accept the files a hook could have uploaded
+	namespace, ok := util.ZdbFileNamespace(d.cfg.ZdbRootPath, filePath)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not a zdb data or index file under %s", filePath, d.cfg.ZdbRootPath))
+		return
+	}
+	if !d.cfg.Namespaces.Allows(namespace) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("namespace %s is not offloaded by the namespace policy", namespace))
+		return
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	log.Printf("Upload of %s requested through the control API", filePath)
+	d.QueueUpload([]string{filePath}, isIndexFile(filePath))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *Daemon) handleControlRetry(w http.ResponseWriter, r *http.Request) {
+	log.Println("Retry cycle requested through the control API")
+	select {
+	case d.retryChan <- true:
+	default:
+		// A retry cycle is already waiting to run
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *Daemon) handleControlRefresh(w http.ResponseWriter, r *http.Request) {
+	log.Println("Metadata refresh requested through the control API")
+	d.requestMetadataRefresh(true)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *Daemon) handleControlBackends(w http.ResponseWriter, r *http.Request) {
+	statuses := d.metricsScraper.GetBackendStatuses()
+
+	backends := make([]control.Backend, 0, len(statuses))
+	for _, status := range statuses {
+		backends = append(backends, control.Backend{
+			Address:     status.Address,
+			BackendType: status.BackendType,
+			Namespace:   status.Namespace,
+			Alive:       status.IsAlive,
+			LastSeen:    status.LastSeen,
+		})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].BackendType != backends[j].BackendType {
+			return backends[i].BackendType < backends[j].BackendType
+		}
+		return backends[i].Address < backends[j].Address
+	})
+	writeJSON(w, http.StatusOK, backends)
+}
+
+func (d *Daemon) handleControlScrub(w http.ResponseWriter, r *http.Request) {
+	if d.dataReader == nil {
+		writeError(w, http.StatusConflict, errors.New("scrubbing is disabled, set scrub_interval to enable it"))
+		return
+	}
+	if d.scrubbing.Load() {
+		writeError(w, http.StatusConflict, errors.New("a scrub is already running"))
+		return
+	}
+
+	log.Println("Scrub requested through the control API")
+	d.requestScrub(true)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *Daemon) handleControlScrubs(w http.ResponseWriter, r *http.Request) {
+	entries, err := d.journal.Scrubs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	scrubs := make([]control.Scrub, 0, len(entries))
+	for _, entry := range entries {
+		scrubs = append(scrubs, control.Scrub{
+			Path:          entry.Path,
+			Result:        string(entry.Result),
+			Error:         entry.Error,
+			HealthyShards: entry.HealthyShards,
+			DamagedShards: entry.DamagedShards,
+			ScrubbedAt:    entry.ScrubbedAt,
+		})
+	}
+	sort.Slice(scrubs, func(i, j int) bool { return scrubs[i].Path < scrubs[j].Path })
+	writeJSON(w, http.StatusOK, scrubs)
+}
+
+func (d *Daemon) handleControlRepairs(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %w", err))
+			return
+		}
+	}
+
+	entries, err := d.journal.Repairs(limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	repairs := make([]control.Repair, 0, len(entries))
+	for _, entry := range entries {
+		repairs = append(repairs, control.Repair{
+			Path:           entry.Path,
+			Action:         string(entry.Action),
+			Result:         string(entry.Result),
+			Error:          entry.Error,
+			HealthyShards:  entry.HealthyShards,
+			ExpectedShards: entry.ExpectedShards,
+			RepairedAt:     entry.RepairedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, repairs)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write control API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, control.ErrorResponse{Error: err.Error()})
+}
@@ -8,14 +8,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/hook"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+	"golang.org/x/sync/singleflight"
 )
 
 // Metrics holds all Prometheus metrics for the daemon
@@ -23,82 +27,233 @@ type Metrics struct {
 	lastRetryRunTime     prometheus.Gauge
 	healthyFileConfigs   prometheus.Gauge
 	unhealthyFileConfigs prometheus.Gauge
+	uploadQueueDepth     prometheus.Gauge
+	uploadsInFlight      prometheus.Gauge
+	deadLetterFiles      prometheus.Gauge
+	cacheSizeBytes       prometheus.Gauge
+	cacheEvictions       prometheus.Counter
+	cacheEvictedBytes    prometheus.Counter
+	cacheHits            prometheus.Counter
+	cacheMisses          prometheus.Counter
+	retrievalDuration    prometheus.Histogram
+	retrievalSize        prometheus.Histogram
+	verifyFailures       prometheus.Counter
+
+	metadataRefreshDuration *prometheus.HistogramVec
+	metadataEntriesChanged  *prometheus.CounterVec
+
+	rpoAge          *prometheus.GaugeVec
+	rpoPendingBytes *prometheus.GaugeVec
+	degraded        prometheus.Gauge
+
+	scrubFiles       *prometheus.CounterVec
+	scrubReadBytes   prometheus.Counter
+	scrubFailedFiles prometheus.Gauge
+
+	repairs *prometheus.CounterVec
 }
 
-// Daemon represents the main daemon structure
+// Daemon represents the main daemon structure. The metadata store, the
+// pending uploads and the refresh state are owned by the main loop in Run.
+// Other goroutines only reach them through its channels, while everything
+// else they touch has its own synchronization.
 type Daemon struct {
 	cfg            *config.Config
-	zstorClient    *zstor.Client
+	zstorClient    zstor.Client
 	metricsScraper *zstor.MetricsScraper
 
-	// In-memory metadata store
-	metadataStore map[string]zstor.Metadata
+	// In-memory metadata store, and when the metadata of each path was last
+	// confirmed, either by a lookup or an upload
+	metadataStore     map[string]zstor.Metadata
+	metadataCheckedAt map[string]time.Time
 
-	// Pending uploads list
+	// Set while a metadata refresh is running, so refreshes don't overlap
+	metadataRefreshing bool
+
+	// Persistent record of the upload state of each file
+	journal *journal.Journal
+
+	// Uploads currently queued or in flight
 	pendingUploads map[string]bool
 
+	// Recovery point of each namespace as of the last retry cycle, read by
+	// the control API, and whether the daemon was last found degraded
+	rpo      atomic.Pointer[map[string]namespaceRPO]
+	degraded bool
+
+	// Upload work waiting for a free worker
+	uploadQueue *uploadQueue
+
+	// Listener for zdb hooks
+	hookHandler *hook.Handler
+
+	// Management API served on the control socket
+	controlServer *http.Server
+	version       string
+	startedAt     time.Time
+
+	// In-flight work that shutdown waits for
+	workers          sync.WaitGroup
+	retrievals       sync.WaitGroup
+	replacements     sync.WaitGroup
+	activeUploads    atomic.Int32
+	activeRetrievals atomic.Int32
+	shutdownOnce     sync.Once
+
+	// Coalesces concurrent retrievals of the same file
+	retrievalGroup singleflight.Group
+
+	// Reads files from the data backends for scrubbing, nil when scrubbing
+	// is disabled
+	dataReader *zstor.DataReader
+	scrubbing  atomic.Bool
+
+	// Repairs of files with shards on dead backends. The cooldown state
+	// belongs to the single running repair, the rate limit is counted from
+	// the journal.
+	repairing  atomic.Bool
+	repairedAt map[string]time.Time
+
 	// Prometheus metrics
 	metrics *Metrics
 
 	// Channels for communication
-	hookChan         chan string
 	retryChan        chan bool
 	uploadCompleteCh chan uploadResult
-	metadataChan     chan map[string]zstor.Metadata
+	metadataChan     chan metadataUpdate
+	refreshChan      chan bool
+	metricsUpdateCh  chan struct{}
+	scrubChan        chan bool
 
 	// Channels for internal communication
 	quitChan chan bool
 
-	// Channel for upload requests
+	// Channel for upload requests coming from outside the main loop, such as
+	// zdb hooks
 	uploadRequestCh chan uploadRequest
 }
 
-// uploadRequest represents a request to upload a file
+// uploadRequest represents a request to upload one or more files. Index
+// requests with several files are stored together with StoreBatch
 type uploadRequest struct {
-	filePath string
-	isIndex  bool
+	filePaths []string
+	isIndex   bool
 }
 
 // uploadResult represents the result of an upload operation
 type uploadResult struct {
-	filePath string
-	metadata *zstor.Metadata
-	err      error
+	filePath      string
+	localChecksum []byte
+	// dataChecksum is the hash of the data file an index file points into,
+	// taken before the index upload
+	dataChecksum []byte
+	metadata     *zstor.Metadata
+	err          error
+	// verifyFailed is set when the store succeeded but the stored file
+	// didn't pass verification
+	verifyFailed bool
 }
 
-// NewDaemon creates a new daemon instance
-func NewDaemon(cfg *config.Config, zstorClient *zstor.Client, metricsScraper *zstor.MetricsScraper) (*Daemon, error) {
+// NewDaemon creates a new daemon instance, with its metrics registered on reg
+func NewDaemon(cfg *config.Config, zstorClient zstor.Client, metricsScraper *zstor.MetricsScraper, version string, reg prometheus.Registerer) (*Daemon, error) {
+	j, err := journal.Open(cfg.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload journal: %w", err)
+	}
+
 	d := &Daemon{
-		cfg:              cfg,
-		zstorClient:      zstorClient,
-		metricsScraper:   metricsScraper,
-		metadataStore:    make(map[string]zstor.Metadata),
-		pendingUploads:   make(map[string]bool),
-		metrics:          &Metrics{},
-		hookChan:         make(chan string, 100),
-		retryChan:        make(chan bool, 1),
-		uploadCompleteCh: make(chan uploadResult, 100),
-		metadataChan:     make(chan map[string]zstor.Metadata, 1),
-		uploadRequestCh:  make(chan uploadRequest, 100),
-		quitChan:         make(chan bool),
-	}
-
-	d.initMetrics()
+		cfg:               cfg,
+		zstorClient:       zstorClient,
+		metricsScraper:    metricsScraper,
+		metadataStore:     make(map[string]zstor.Metadata),
+		metadataCheckedAt: make(map[string]time.Time),
+		journal:           j,
+		pendingUploads:    make(map[string]bool),
+		repairedAt:        make(map[string]time.Time),
+		metrics:           &Metrics{},
+		retryChan:         make(chan bool, 1),
+		uploadCompleteCh:  make(chan uploadResult, 100),
+		metadataChan:      make(chan metadataUpdate, 1),
+		refreshChan:       make(chan bool, 1),
+		metricsUpdateCh:   make(chan struct{}, 1),
+		scrubChan:         make(chan bool, 1),
+		uploadRequestCh:   make(chan uploadRequest, 100),
+		quitChan:          make(chan bool),
+		version:           version,
+		startedAt:         time.Now(),
+	}
+
+	if cfg.ScrubInterval > 0 {
+		zstorCfg, err := zstor.LoadConfig(cfg.ZstorConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load zstor config for scrubbing: %w", err)
+		}
+		d.dataReader, err = zstor.NewDataReader(zstorCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up scrubbing: %w", err)
+		}
+	}
+
+	if cfg.AutoReplaceBackends && cfg.Mnemonic == "" {
+		return nil, fmt.Errorf("auto_replace_backends needs the mnemonic to deploy replacements")
+	}
+	// The shards on a replaced data backend are only rebuilt by the repair loop
+	if cfg.AutoReplaceBackends && !cfg.AutoRepair {
+		return nil, fmt.Errorf("auto_replace_backends needs auto_repair to rebuild the shards of replaced backends")
+	}
+
+	d.initMetrics(reg)
+	d.uploadQueue = newUploadQueue(d.metrics.uploadQueueDepth, cfg.Namespaces)
+	d.controlServer = d.newControlServer()
+
+	d.hookHandler, err = hook.NewHandler(cfg.ZdbRootPath, cfg.Namespaces, zstorClient, d, d, cfg.HookTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize hook handler: %w", err)
+	}
 	return d, nil
 }
 
-// Init initializes the daemon by refreshing metadata and starting all goroutines
+// Init initializes the daemon from the upload journal, or by refreshing
+// metadata on first start, and then starts all goroutines
 func (d *Daemon) Init() error {
-	// Initialize metadata store
-	if err := d.RefreshMetadata(); err != nil {
-		return fmt.Errorf("failed to initialize metadata: %w", err)
+	count, err := d.journal.Count()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		// Nothing recorded yet, so build the journal from the remote metadata
+		if err := d.RefreshMetadata(); err != nil {
+			return fmt.Errorf("failed to initialize metadata: %w", err)
+		}
+	} else {
+		log.Printf("Resuming from upload journal with %d files", count)
+		if err := d.resumeFromJournal(); err != nil {
+			return fmt.Errorf("failed to resume from upload journal: %w", err)
+		}
+
+		// The metadata is still needed for backend health, but uploads don't
+		// have to wait for it
+		d.requestMetadataRefresh(true)
 	}
+
+	d.updateDeadLetterCount()
+	d.updateScrubFailedCount()
+
 	// Start all goroutines
+	d.StartUploadWorkers()
 	go d.StartHookHandler()
+	go d.StartControlServer()
 	go d.StartRetryLoop()
 	go d.StartPrometheusServer()
 	go d.StartMetricsScraper()
 	go d.StartMetadataRefresh()
+	go d.StartScrubLoop()
+	d.replacements.Add(1)
+	go func() {
+		defer d.replacements.Done()
+		d.StartReplaceLoop()
+	}()
 	return nil
 }
 
@@ -106,25 +261,29 @@ func (d *Daemon) Init() error {
 func (d *Daemon) Run() {
 	for {
 		select {
-		case hookMsg := <-d.hookChan:
-			d.handleHookMessage(hookMsg)
 		case <-d.retryChan:
 			d.handleRetry()
 		case result := <-d.uploadCompleteCh:
 			d.handleUploadResult(result)
-		case metadata := <-d.metadataChan:
-			d.handleMetadataUpdate(metadata)
+		case <-d.metricsUpdateCh:
+			d.handleMetricsUpdate()
+		case full := <-d.refreshChan:
+			d.handleMetadataRefresh(full)
+		case update := <-d.metadataChan:
+			d.handleMetadataUpdate(update)
+		case force := <-d.scrubChan:
+			d.handleScrub(force)
 		case req := <-d.uploadRequestCh:
 			d.handleUploadRequest(req)
 		case <-d.quitChan:
-			log.Println("Daemon shutting down...")
+			d.drain()
 			return
 		}
 	}
 }
 
-// initMetrics initializes all Prometheus metrics
-func (d *Daemon) initMetrics() {
+// initMetrics initializes all Prometheus metrics and registers them on reg
+func (d *Daemon) initMetrics(reg prometheus.Registerer) {
 	d.metrics.lastRetryRunTime = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "last_retry_run_time",
@@ -143,49 +302,330 @@ func (d *Daemon) initMetrics() {
 			Help: "The number of files with unhealthy backend configurations.",
 		},
 	)
-	prometheus.MustRegister(d.metrics.lastRetryRunTime)
-	prometheus.MustRegister(d.metrics.healthyFileConfigs)
-	prometheus.MustRegister(d.metrics.unhealthyFileConfigs)
+	d.metrics.uploadQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "upload_queue_depth",
+			Help: "The number of upload requests waiting for a free worker.",
+		},
+	)
+	d.metrics.uploadsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "uploads_in_flight",
+			Help: "The number of uploads currently being performed.",
+		},
+	)
+	d.metrics.deadLetterFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dead_letter_files",
+			Help: "The number of files quarantined after too many failed uploads.",
+		},
+	)
+	d.metrics.cacheSizeBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cache_size_bytes",
+			Help: "The size of the local zdb data directory.",
+		},
+	)
+	d.metrics.cacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "The number of uploaded data files evicted from the local cache.",
+		},
+	)
+	d.metrics.cacheEvictedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_evicted_bytes_total",
+			Help: "The number of bytes freed by evicting data files from the local cache.",
+		},
+	)
+	d.metrics.cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "The number of requested data files that were still present locally.",
+		},
+	)
+	d.metrics.cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "The number of requested data files that had to be retrieved from zstor.",
+		},
+	)
+	d.metrics.retrievalDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "retrieval_duration_seconds",
+			Help:    "The time taken by successful retrievals from zstor.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+		},
+	)
+	d.metrics.retrievalSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "retrieval_size_bytes",
+			Help:    "The size of files retrieved from zstor.",
+			Buckets: prometheus.ExponentialBuckets(1<<20, 2, 10),
+		},
+	)
+	d.metrics.verifyFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "upload_verification_failures_total",
+			Help: "The number of uploads whose stored checksum or shard count didn't pass verification.",
+		},
+	)
+	d.metrics.metadataRefreshDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "metadata_refresh_duration_seconds",
+			Help:    "The time taken by metadata refreshes, by mode (incremental or full).",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+		},
+		[]string{"mode"},
+	)
+	d.metrics.metadataEntriesChanged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metadata_entries_changed_total",
+			Help: "The number of in-memory metadata entries added, changed or removed by refreshes, by mode (incremental or full).",
+		},
+		[]string{"mode"},
+	)
+	d.metrics.rpoAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rpo_age_seconds",
+			Help: "The age of the oldest local file without a matching remote checksum, by namespace.",
+		},
+		[]string{"namespace"},
+	)
+	d.metrics.rpoPendingBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rpo_pending_bytes",
+			Help: "The size of the local files without a matching remote checksum, by namespace.",
+		},
+		[]string{"namespace"},
+	)
+	d.metrics.degraded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "daemon_degraded",
+			Help: "Set to 1 while the RPO of a namespace is over the configured threshold.",
+		},
+	)
+	d.metrics.scrubFiles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scrub_files_total",
+			Help: "The number of files scrubbed, by result (ok, repaired or failed).",
+		},
+		[]string{"result"},
+	)
+	d.metrics.scrubReadBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "scrub_read_bytes_total",
+			Help: "The number of shard bytes read from the data backends by scrubs.",
+		},
+	)
+	d.metrics.scrubFailedFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "scrub_failed_files",
+			Help: "The number of files whose last scrub failed and couldn't be repaired.",
+		},
+	)
+	d.metrics.repairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "repairs_total",
+			Help: "The number of repairs of files with shards on dead backends, by action and result.",
+		},
+		[]string{"action", "result"},
+	)
+	reg.MustRegister(d.metrics.lastRetryRunTime)
+	reg.MustRegister(d.metrics.healthyFileConfigs)
+	reg.MustRegister(d.metrics.unhealthyFileConfigs)
+	reg.MustRegister(d.metrics.uploadQueueDepth)
+	reg.MustRegister(d.metrics.uploadsInFlight)
+	reg.MustRegister(d.metrics.deadLetterFiles)
+	reg.MustRegister(d.metrics.cacheSizeBytes)
+	reg.MustRegister(d.metrics.cacheEvictions)
+	reg.MustRegister(d.metrics.cacheEvictedBytes)
+	reg.MustRegister(d.metrics.cacheHits)
+	reg.MustRegister(d.metrics.cacheMisses)
+	reg.MustRegister(d.metrics.retrievalDuration)
+	reg.MustRegister(d.metrics.retrievalSize)
+	reg.MustRegister(d.metrics.verifyFailures)
+	reg.MustRegister(d.metrics.metadataRefreshDuration)
+	reg.MustRegister(d.metrics.metadataEntriesChanged)
+	reg.MustRegister(d.metrics.rpoAge)
+	reg.MustRegister(d.metrics.rpoPendingBytes)
+	reg.MustRegister(d.metrics.degraded)
+	reg.MustRegister(d.metrics.scrubFiles)
+	reg.MustRegister(d.metrics.scrubReadBytes)
+	reg.MustRegister(d.metrics.scrubFailedFiles)
+	reg.MustRegister(d.metrics.repairs)
 }
 
-// RefreshMetadata fetches all metadata and updates the in-memory store
-func (d *Daemon) RefreshMetadata() error {
-	log.Println("Refreshing metadata...")
-
-	// Get eligible files
-	eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath)
+// syncJournal records the remote checksums found in the metadata in the
+// upload journal, so uploads done outside of the daemon are accounted for
+func (d *Daemon) syncJournal(metadata map[string]zstor.Metadata) {
+	entries, err := d.journal.All()
 	if err != nil {
-		return fmt.Errorf("failed to get eligible files: %w", err)
+		log.Printf("Failed to read upload journal: %v", err)
+		return
 	}
-	log.Printf("Found %d eligible files", len(eligibleFiles))
 
-	// Fetch all metadata
-	allMetadata, err := d.zstorClient.GetAllMetadata()
-	if err != nil {
-		return fmt.Errorf("failed to fetch all metadata: %w", err)
+	updated := 0
+	for filePath, meta := range metadata {
+		// Metadata that couldn't be matched to a local path is keyed by hash
+		if !filepath.IsAbs(filePath) {
+			continue
+		}
+		entry, exists := entries[filePath]
+		if exists && bytes.Equal(entry.RemoteChecksum, meta.Checksum) {
+			continue
+		}
+		if isIndexFile(filePath) {
+			err = d.syncIndexChecksum(filePath, meta.Checksum, metadata, entries)
+		} else {
+			err = d.journal.SetRemoteChecksum(filePath, meta.Checksum)
+		}
+		if err != nil {
+			log.Printf("Failed to update upload journal: %v", err)
+			continue
+		}
+		updated++
 	}
-	log.Printf("Retrieved metadata for %d files", len(allMetadata))
 
-	// Assign filenames to metadata
-	filenameMetadata, err := zstor.AssignFilenamesToMetadata(eligibleFiles, allMetadata, d.cfg.ZdbRootPath)
-	if err != nil {
-		return fmt.Errorf("failed to assign filenames to metadata: %w", err)
+	if updated > 0 {
+		log.Printf("Updated %d upload journal entries from metadata", updated)
 	}
+}
 
-	// Update in-memory store
-	d.metadataStore = filenameMetadata
+// resumeFromJournal requeues every file that didn't finish uploading before
+// the daemon last stopped. Files still backing off are rescheduled for their
+// next attempt.
+func (d *Daemon) resumeFromJournal() error {
+	entries, err := d.journal.ListByState(journal.StatePending, journal.StateUploading, journal.StateFailed, journal.StateVerifyFailed)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Metadata refreshed, found metadata for %d files", len(filenameMetadata))
+	for filePath, entry := range entries {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			continue
+		}
+		if wait := time.Until(entry.NextAttemptAt); wait > 0 {
+			log.Printf("Resuming upload of %s in %s (attempts: %d)", filePath, wait.Round(time.Second), entry.Attempts)
+			d.scheduleUpload(filePath, wait)
+			continue
+		}
+		log.Printf("Resuming upload of %s (state: %s, attempts: %d)", filePath, entry.State, entry.Attempts)
+		d.uploadFile(filePath, isIndexFile(filePath))
+	}
 	return nil
 }
 
+// StartUploadWorkers starts the fixed size pool of upload workers
+func (d *Daemon) StartUploadWorkers() {
+	log.Printf("Starting %d upload workers", d.cfg.UploadWorkers)
+	for i := 0; i < d.cfg.UploadWorkers; i++ {
+		d.workers.Add(1)
+		go d.uploadWorker()
+	}
+}
+
+// uploadWorker performs uploads from the queue one at a time until the queue
+// is closed
+func (d *Daemon) uploadWorker() {
+	defer d.workers.Done()
+	for {
+		req, ok := d.uploadQueue.Pop()
+		if !ok {
+			return
+		}
+		d.activeUploads.Add(1)
+		d.metrics.uploadsInFlight.Inc()
+		d.performUpload(req)
+		d.metrics.uploadsInFlight.Dec()
+		d.activeUploads.Add(-1)
+	}
+}
+
 // StartHookHandler starts the hook handler
 func (d *Daemon) StartHookHandler() {
-	handler, err := hook.NewHandler(d.cfg.ZdbRootPath, d.zstorClient)
-	if err != nil {
-		log.Fatalf("Failed to initialize hook handler: %v", err)
+	d.hookHandler.ListenAndServe()
+}
+
+// Shutdown asks the main loop to stop. The daemon stops accepting new work
+// and waits up to the configured shutdown timeout for in-flight uploads and
+// retrievals before Run returns. It's safe to call more than once.
+func (d *Daemon) Shutdown() {
+	d.shutdownOnce.Do(func() {
+		close(d.quitChan)
+	})
+}
+
+// drain is run by the main loop once shutdown starts. Queued uploads that
+// haven't started are left pending in the journal for the next start.
+func (d *Daemon) drain() {
+	log.Println("Daemon shutting down, no longer accepting new work...")
+	if err := d.hookHandler.Close(); err != nil {
+		log.Printf("Failed to close hook socket: %v", err)
+	}
+	if err := d.controlServer.Close(); err != nil {
+		log.Printf("Failed to close control socket: %v", err)
+	}
+	if queued := d.uploadQueue.Len(); queued > 0 {
+		log.Printf("Leaving %d queued uploads for the next start", queued)
+	}
+	d.uploadQueue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		// Hooks are waited for first, since they can still start retrievals
+		d.hookHandler.Wait()
+		d.workers.Wait()
+		d.retrievals.Wait()
+		// A replacement in progress can hold a new contract that isn't in
+		// the zstor config yet, and would be left behind unused
+		d.replacements.Wait()
+		close(done)
+	}()
+
+	log.Printf("Waiting up to %s for %d uploads and %d retrievals in flight...",
+		d.cfg.ShutdownTimeout, d.activeUploads.Load(), d.activeRetrievals.Load())
+	deadline := time.NewTimer(d.cfg.ShutdownTimeout)
+	defer deadline.Stop()
+	progress := time.NewTicker(10 * time.Second)
+	defer progress.Stop()
+
+wait:
+	for {
+		select {
+		case result := <-d.uploadCompleteCh:
+			d.handleUploadResult(result)
+		case <-progress.C:
+			log.Printf("Still waiting for %d uploads and %d retrievals in flight...",
+				d.activeUploads.Load(), d.activeRetrievals.Load())
+		case <-done:
+			log.Println("All in-flight work finished")
+			break wait
+		case <-deadline.C:
+			log.Printf("Shutdown deadline reached, abandoning %d uploads and %d retrievals in flight",
+				d.activeUploads.Load(), d.activeRetrievals.Load())
+			break wait
+		}
 	}
-	handler.ListenAndServe()
+
+	// Record any results that came in after the last worker finished
+	for {
+		select {
+		case result := <-d.uploadCompleteCh:
+			d.handleUploadResult(result)
+			continue
+		default:
+		}
+		break
+	}
+
+	if d.dataReader != nil {
+		d.dataReader.Close()
+	}
+	if err := d.journal.Close(); err != nil {
+		log.Printf("Failed to close upload journal: %v", err)
+	}
+	log.Println("Daemon stopped")
 }
 
 // StartRetryLoop starts the retry loop
@@ -219,7 +659,7 @@ func (d *Daemon) StartMetricsScraper() {
 	if err := d.metricsScraper.ScrapeMetrics(); err != nil {
 		log.Printf("Failed to scrape zstor metrics: %v", err)
 	} else {
-		d.handleMetricsUpdate()
+		d.notifyMetricsUpdate()
 	}
 
 	// Then run every 30 seconds
@@ -233,7 +673,7 @@ func (d *Daemon) StartMetricsScraper() {
 				log.Printf("Failed to scrape zstor metrics: %v", err)
 			} else {
 				log.Println("Successfully scraped zstor metrics")
-				d.handleMetricsUpdate()
+				d.notifyMetricsUpdate()
 			}
 		case <-d.quitChan:
 			return
@@ -241,65 +681,37 @@ func (d *Daemon) StartMetricsScraper() {
 	}
 }
 
-// StartMetadataRefresh starts the metadata refresh loop
-func (d *Daemon) StartMetadataRefresh() {
-	// Refresh metadata every 5 minutes
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			// Fetch metadata in background and send to channel
-			go func() {
-				// Get eligible files
-				eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath)
-				if err != nil {
-					log.Printf("Failed to get eligible files: %v", err)
-					return
-				}
-
-				// Fetch all metadata
-				allMetadata, err := d.zstorClient.GetAllMetadata()
-				if err != nil {
-					log.Printf("Failed to fetch all metadata: %v", err)
-					return
-				}
-
-				// Assign filenames to metadata
-				filenameMetadata, err := zstor.AssignFilenamesToMetadata(eligibleFiles, allMetadata, d.cfg.ZdbRootPath)
-				if err != nil {
-					log.Printf("Failed to assign filenames to metadata: %v", err)
-					return
-				}
-
-				// Send to channel
-				d.metadataChan <- filenameMetadata
-			}()
-		case <-d.quitChan:
-			return
-		}
+// notifyMetricsUpdate tells the main loop that a new backend status snapshot
+// is available. The metadata store belongs to the main loop, so the health
+// of each file is recomputed there rather than in the scraper goroutine.
+func (d *Daemon) notifyMetricsUpdate() {
+	select {
+	case d.metricsUpdateCh <- struct{}{}:
+	default:
+		// An update is already waiting to be handled
 	}
 }
 
-// handleHookMessage processes a hook message
-func (d *Daemon) handleHookMessage(msg string) {
-	log.Printf("Received hook message: %s", msg)
-	// TODO: Implement hook message handling
-	// This would parse the message and trigger appropriate actions
-}
-
 // handleRetry processes the retry loop
 func (d *Daemon) handleRetry() {
 	log.Println("Running retry cycle...")
 
 	// Get eligible files
-	eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath)
+	eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath, d.cfg.Namespaces)
 	if err != nil {
 		log.Printf("Failed to get eligible files: %v", err)
 		return
 	}
 
+	entries, err := d.journal.All()
+	if err != nil {
+		log.Printf("Failed to read upload journal: %v", err)
+		return
+	}
+
+	// Files found to match their remote checksum, for the RPO
+	offloaded := make(map[string]bool)
+
 	// Check each eligible file
 	for _, filePath := range eligibleFiles {
 		// Skip if upload is pending
@@ -307,14 +719,47 @@ func (d *Daemon) handleRetry() {
 			continue
 		}
 
+		entry, inJournal := entries[filePath]
+		uploaded := inJournal && entry.State == journal.StateUploaded
+
+		// Index files waiting for their data file are already stored, unless
+		// they changed since
+		if inJournal && entry.State == journal.StateAwaitingData {
+			localHash := zstor.GetLocalHash(filePath)
+			if localHash != nil && !bytes.Equal(entry.RemoteChecksum, localHash) {
+				log.Printf("File %s hash mismatch, queuing for re-upload...", filePath)
+				d.uploadFile(filePath, true)
+				continue
+			}
+			d.checkAwaitingIndex(filePath)
+			continue
+		}
+
+		// Dead-letter files wait for an operator, and failed files for their
+		// backoff to run out
+		if inJournal && entry.State == journal.StateDead {
+			continue
+		}
+		failed := entry.State == journal.StateFailed || entry.State == journal.StateVerifyFailed
+		if inJournal && failed && time.Now().Before(entry.NextAttemptAt) {
+			continue
+		}
+
 		// Check if file exists locally
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			// File exists in metadata but not locally, retrieve it
-			if _, exists := d.metadataStore[filePath]; exists {
+			// Evicted files are only retrieved when zdb asks for them through
+			// the missing-data hook
+			if uploaded && entry.Evicted {
+				continue
+			}
+			// File exists remotely but not locally, retrieve it
+			if _, exists := d.metadataStore[filePath]; exists || uploaded {
 				log.Printf("File %s missing locally but exists in metadata, queuing for retrieval...", filePath)
 				// Run retrieval in background to avoid blocking the retry loop
+				d.retrievals.Add(1)
 				go func() {
-					if err := d.zstorClient.Retrieve(filePath); err != nil {
+					defer d.retrievals.Done()
+					if err := d.Retrieve(filePath); err != nil {
 						log.Printf("Failed to retrieve file %s: %v", filePath, err)
 					} else {
 						log.Printf("Successfully retrieved file %s", filePath)
@@ -324,29 +769,28 @@ func (d *Daemon) handleRetry() {
 			continue
 		}
 
-		// Check metadata to see if file is already stored
-		metadata, exists := d.metadataStore[filePath]
-
-		// If metadata doesn't exist, upload the file
-		if !exists {
+		if !uploaded {
+			// Never uploaded, or the last attempt didn't succeed
 			log.Printf("File %s needs upload, queuing...", filePath)
-			// Determine if it's an index file
-			isIndex := strings.Contains(filePath, "/index/")
-			d.uploadFile(filePath, isIndex)
+			d.uploadFile(filePath, isIndexFile(filePath))
 		} else {
-			// File exists both locally and in metadata, compare hashes
+			// File exists both locally and remotely, compare hashes
 			localHash := zstor.GetLocalHash(filePath)
-			if localHash != nil && !bytes.Equal(metadata.Checksum, localHash) {
+			if localHash != nil && !bytes.Equal(entry.RemoteChecksum, localHash) {
 				log.Printf("File %s hash mismatch, queuing for re-upload...", filePath)
-				// Determine if it's an index file
-				isIndex := strings.Contains(filePath, "/index/")
-				d.uploadFile(filePath, isIndex)
+				d.uploadFile(filePath, isIndexFile(filePath))
+			} else if localHash != nil {
+				offloaded[filePath] = true
 			}
 		}
 	}
+	d.updateRPO(eligibleFiles, offloaded)
 
 	// Update metrics
 	d.updateHealthyFileConfigs()
+	d.updateDeadLetterCount()
+
+	d.enforceCacheLimits()
 }
 
 // handleUploadResult processes the result of an upload operation
@@ -355,6 +799,10 @@ func (d *Daemon) handleUploadResult(result uploadResult) {
 
 	if result.err != nil {
 		log.Printf("Upload failed for %s: %v", result.filePath, result.err)
+		if result.verifyFailed {
+			d.metrics.verifyFailures.Inc()
+		}
+		d.handleUploadFailure(result)
 		return
 	}
 
@@ -363,6 +811,26 @@ func (d *Daemon) handleUploadResult(result uploadResult) {
 	// Update metadata store with new metadata
 	if result.metadata != nil {
 		d.metadataStore[result.filePath] = *result.metadata
+		d.metadataCheckedAt[result.filePath] = time.Now()
+
+		var err error
+		if isIndexFile(result.filePath) {
+			err = d.recordIndexUpload(result)
+		} else {
+			err = d.journal.MarkUploaded(result.filePath, result.localChecksum, result.metadata.Checksum)
+		}
+		if err != nil {
+			log.Printf("Failed to update upload journal: %v", err)
+		}
+		d.resolveQueuedScrub(result.filePath, nil)
+		d.resolveQueuedRepairs(result.filePath, nil)
+	}
+
+	// A newly uploaded data file may complete its index, and may be what's
+	// needed to get back under the cache watermark
+	if !isIndexFile(result.filePath) {
+		d.completeAwaitingIndex(result.filePath)
+		d.enforceCacheLimits()
 	}
 }
 
@@ -373,6 +841,8 @@ func (d *Daemon) handleMetricsUpdate() {
 
 	// Update healthy file configs metric
 	d.updateHealthyFileConfigs()
+	d.updateRPOMetrics()
+	d.handleRepair()
 
 	log.Println("Updated last_retry_run_time metric.")
 }
@@ -382,8 +852,10 @@ func (d *Daemon) updateHealthyFileConfigs() {
 	healthyCount := 0
 	unhealthyCount := 0
 
+	// Use the same snapshot for every file
+	backendStatuses := d.metricsScraper.GetBackendStatuses()
 	for filePath, metadata := range d.metadataStore {
-		if d.isFileBackendHealthy(filePath, metadata) {
+		if isFileBackendHealthy(filePath, metadata, backendStatuses) {
 			healthyCount++
 		} else {
 			unhealthyCount++
@@ -397,10 +869,7 @@ func (d *Daemon) updateHealthyFileConfigs() {
 }
 
 // isFileBackendHealthy checks if a file has a healthy backend configuration
-func (d *Daemon) isFileBackendHealthy(filePath string, metadata zstor.Metadata) bool {
-	// Get all backend statuses
-	backendStatuses := d.metricsScraper.GetBackendStatuses()
-
+func isFileBackendHealthy(filePath string, metadata zstor.Metadata, backendStatuses map[string]zstor.BackendStatus) bool {
 	// Count healthy backends for this file
 	healthyBackends := 0
 
@@ -431,15 +900,6 @@ func (d *Daemon) isFileBackendHealthy(filePath string, metadata zstor.Metadata)
 	return result
 }
 
-// handleMetadataUpdate processes a metadata update
-func (d *Daemon) handleMetadataUpdate(metadata map[string]zstor.Metadata) {
-	d.metadataStore = metadata
-	log.Println("Metadata updated")
-
-	// Update healthy file configs metric
-	d.updateHealthyFileConfigs()
-}
-
 // isUploadPending checks if an upload is pending for a file
 func (d *Daemon) isUploadPending(filePath string) bool {
 	return d.pendingUploads[filePath]
@@ -455,62 +915,142 @@ func (d *Daemon) markUploadPending(filePath string) bool {
 	return true
 }
 
-// handleUploadRequest processes an upload request by performing the actual upload in the background
+// handleUploadRequest queues an upload request for the worker pool
 func (d *Daemon) handleUploadRequest(req uploadRequest) {
-	// Start upload in background
-	go func() {
-		var err error
-		var metadata *zstor.Metadata
+	// Drop any files that already have an upload queued or in flight
+	var files []string
+	for _, filePath := range req.filePaths {
+		if !d.markUploadPending(filePath) {
+			log.Printf("Upload already pending for %s, skipping", filePath)
+			continue
+		}
+		if err := d.journal.MarkPending(filePath); err != nil {
+			log.Printf("Failed to update upload journal: %v", err)
+		}
+		files = append(files, filePath)
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	d.uploadQueue.Push(uploadRequest{
+		filePaths: files,
+		isIndex:   req.isIndex,
+	})
+}
 
+// performUpload uploads the files of a request and reports the results back
+// to the main loop. It runs on an upload worker.
+func (d *Daemon) performUpload(req uploadRequest) {
+	files := req.filePaths
+	log.Printf("Uploading %s", req.describe())
+
+	var err error
+
+	// Hash the files as they are just before upload, along with the data
+	// files the index files point into
+	localChecksums := make(map[string][]byte, len(files))
+	dataChecksums := make(map[string][]byte)
+	for _, filePath := range files {
+		if err := d.journal.MarkUploading(filePath); err != nil {
+			log.Printf("Failed to update upload journal: %v", err)
+		}
+		localChecksums[filePath] = zstor.GetLocalHash(filePath)
 		if req.isIndex {
-			// Use StoreBatch for all index files to ensure atomicity and correct pathing.
-			err = d.zstorClient.StoreBatch([]string{req.filePath}, filepath.Dir(req.filePath))
-		} else {
-			// Use the simplified Store for data files.
-			err = d.zstorClient.Store(req.filePath)
+			dataChecksums[filePath] = d.localDataChecksum(filePath)
 		}
+	}
 
-		if err != nil {
+	if req.isIndex {
+		// Use StoreBatch for all index files to ensure atomicity and correct pathing.
+		err = d.zstorClient.StoreBatch(files, filepath.Dir(files[0]))
+	} else {
+		// Use the simplified Store for data files.
+		for _, filePath := range files {
+			if err = d.zstorClient.Store(filePath); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		for _, filePath := range files {
 			d.uploadCompleteCh <- uploadResult{
-				filePath: req.filePath,
+				filePath: filePath,
 				err:      err,
 			}
-			return
 		}
+		return
+	}
 
-		// Fetch metadata for the uploaded file
-		metadata, err = d.zstorClient.GetMetadata(req.filePath)
+	// Fetch metadata for the uploaded files
+	for _, filePath := range files {
+		metadata, err := d.zstorClient.GetMetadata(filePath)
 		if err != nil {
 			d.uploadCompleteCh <- uploadResult{
-				filePath: req.filePath,
+				filePath: filePath,
 				err:      fmt.Errorf("failed to fetch metadata after upload: %w", err),
 			}
-			return
+			continue
+		}
+
+		if err := d.verifyUpload(localChecksums[filePath], metadata); err != nil {
+			d.uploadCompleteCh <- uploadResult{
+				filePath:     filePath,
+				metadata:     metadata,
+				err:          fmt.Errorf("upload verification failed: %w", err),
+				verifyFailed: true,
+			}
+			continue
 		}
 
 		d.uploadCompleteCh <- uploadResult{
-			filePath: req.filePath,
-			metadata: metadata,
-			err:      nil,
+			filePath:      filePath,
+			localChecksum: localChecksums[filePath],
+			dataChecksum:  dataChecksums[filePath],
+			metadata:      metadata,
+			err:           nil,
 		}
-	}()
+	}
 }
 
-// uploadFile sends an upload request to the main thread
-func (d *Daemon) uploadFile(filePath string, isIndex bool) {
-	// Mark as pending
-	if !d.markUploadPending(filePath) {
-		log.Printf("Upload already pending for %s, skipping", filePath)
-		return
+// verifyUpload checks the metadata zstor stored for a file against the hash
+// taken just before upload, and that enough shards were written
+func (d *Daemon) verifyUpload(localChecksum []byte, metadata *zstor.Metadata) error {
+	if localChecksum == nil {
+		return fmt.Errorf("file could not be hashed before upload")
+	}
+	if !bytes.Equal(metadata.Checksum, localChecksum) {
+		return fmt.Errorf("stored checksum %x doesn't match local checksum %x", []byte(metadata.Checksum), localChecksum)
+	}
+	if d.cfg.ExpectedShards > 0 && len(metadata.Shards) < d.cfg.ExpectedShards {
+		return fmt.Errorf("only %d shards stored, expected %d", len(metadata.Shards), d.cfg.ExpectedShards)
 	}
+	return nil
+}
 
-	// Send upload request to main thread
+// uploadFile queues an upload from within the main loop
+func (d *Daemon) uploadFile(filePath string, isIndex bool) {
+	d.handleUploadRequest(uploadRequest{
+		filePaths: []string{filePath},
+		isIndex:   isIndex,
+	})
+}
+
+// QueueUpload sends an upload request to the main loop. It implements
+// hook.Uploader and is safe to call from any goroutine.
+func (d *Daemon) QueueUpload(files []string, isIndex bool) {
 	d.uploadRequestCh <- uploadRequest{
-		filePath: filePath,
-		isIndex:  isIndex,
+		filePaths: files,
+		isIndex:   isIndex,
 	}
 }
 
+// isIndexFile reports whether a path belongs to the zdb index directory
+func isIndexFile(filePath string) bool {
+	return strings.Contains(filePath, "/index/")
+}
+
 // startPrometheusServer starts the Prometheus metrics server
 func startPrometheusServer(port int) {
 	http.Handle("/metrics", promhttp.Handler())
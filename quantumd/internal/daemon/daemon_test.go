@@ -0,0 +1,398 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/hook"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+	"golang.org/x/crypto/blake2b"
+)
+
+// testDataBackend is the data backend the fake zstor stores every shard on,
+// and reports as alive in its metrics
+const testDataBackend = "[2a02::2]:9900"
+
+// fakeZstor keeps stored files in memory. It's safe for concurrent use, like
+// the real clients.
+type fakeZstor struct {
+	mu     sync.Mutex
+	files  map[string][]byte
+	stores int
+}
+
+func newFakeZstor() *fakeZstor {
+	return &fakeZstor{files: make(map[string][]byte)}
+}
+
+func (f *fakeZstor) Store(filePath string) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[filePath] = content
+	f.stores++
+	return nil
+}
+
+func (f *fakeZstor) StoreBatch(files []string, originalDir string) error {
+	for _, filePath := range files {
+		if err := f.Store(filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeZstor) Check(filePath string) (string, error) {
+	metadata, err := f.GetMetadata(filePath)
+	if err != nil {
+		return "", nil
+	}
+	return hex.EncodeToString(metadata.Checksum), nil
+}
+
+func (f *fakeZstor) Retrieve(filePath string) error {
+	f.mu.Lock()
+	content, exists := f.files[filePath]
+	f.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("%s is not stored", filePath)
+	}
+	return os.WriteFile(filePath, content, 0644)
+}
+
+func (f *fakeZstor) Rebuild(filePath string) error {
+	_, err := f.GetMetadata(filePath)
+	return err
+}
+
+func (f *fakeZstor) Test() error {
+	return nil
+}
+
+func (f *fakeZstor) GetMetadata(filePath string) (*zstor.Metadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, exists := f.files[filePath]
+	if !exists {
+		return nil, fmt.Errorf("no metadata for %s", filePath)
+	}
+	return fakeMetadata(content), nil
+}
+
+func (f *fakeZstor) GetAllMetadata() (map[string]zstor.Metadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := make(map[string]zstor.Metadata, len(f.files))
+	for filePath, content := range f.files {
+		all[filePath] = *fakeMetadata(content)
+	}
+	return all, nil
+}
+
+func (f *fakeZstor) storeCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stores
+}
+
+// fakeMetadata describes a file stored as two shards on the test backend
+func fakeMetadata(content []byte) *zstor.Metadata {
+	hash, _ := blake2b.New(16, nil)
+	hash.Write(content)
+	checksum := hash.Sum(nil)
+	metadata := &zstor.Metadata{DataShards: 1, DisposableShards: 1, Checksum: checksum}
+	for i := 0; i < 2; i++ {
+		metadata.Shards = append(metadata.Shards, zstor.Shard{
+			ShardIdx: i,
+			CI:       zstor.CI{Address: testDataBackend, Namespace: "data1"},
+		})
+	}
+	return metadata
+}
+
+// fakeZstorMetrics serves zstor's metrics with the test backend alive, and
+// returns a zstor config pointing at them
+func fakeZstorMetrics(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# TYPE connection_status gauge")
+		fmt.Fprintf(w, "connection_status{address=%q,backend_type=\"data\",namespace=\"data1\"} 1\n", testDataBackend)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(t.TempDir(), "zstor.toml")
+	if err := os.WriteFile(configPath, []byte("prometheus_port = "+u.Port()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+// newTestDaemon sets up a daemon on a temporary zdb root, with its metrics on
+// a registry of its own
+func newTestDaemon(t *testing.T, client zstor.Client) *Daemon {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ZdbRootPath:       filepath.Join(dir, "zdb"),
+		DatabasePath:      filepath.Join(dir, "quantumd.db"),
+		ControlSocket:     filepath.Join(dir, "quantumd.sock"),
+		ZstorConfigPath:   fakeZstorMetrics(t),
+		ExpectedShards:    2,
+		RetryInterval:     time.Minute,
+		UploadWorkers:     3,
+		UploadMaxAttempts: 3,
+		UploadBackoffBase: time.Second,
+		UploadBackoffMax:  time.Second,
+		ShutdownTimeout:   30 * time.Second,
+		HookTimeout:       30 * time.Second,
+		Namespaces: util.NamespacePolicy{
+			Include: util.DefaultIncludedNamespaces,
+			Exclude: util.DefaultExcludedNamespaces,
+		},
+	}
+
+	reg := prometheus.NewRegistry()
+	scraper, err := zstor.NewMetricsScraper(cfg.ZstorConfigPath, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDaemon(cfg, client, scraper, "test", reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing again after the daemon stopped does nothing
+	t.Cleanup(func() { d.journal.Close() })
+	return d
+}
+
+// writeZdbFiles creates count data and index files in a namespace, the last
+// of which are the active ones, and returns the files eligible for upload
+func writeZdbFiles(t *testing.T, root, namespace string, count int) []string {
+	t.Helper()
+	dataDir := filepath.Join(root, "data", namespace)
+	indexDir := filepath.Join(root, "index", namespace)
+	for _, dir := range []string{dataDir, indexDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eligible := []string{filepath.Join(indexDir, "zdb-namespace")}
+	if err := os.WriteFile(eligible[0], []byte(namespace), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		dataPath := filepath.Join(dataDir, fmt.Sprintf("d%d", i))
+		indexPath := filepath.Join(indexDir, fmt.Sprintf("i%d", i))
+		if err := os.WriteFile(dataPath, bytes.Repeat([]byte{byte(i)}, 4096), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(indexPath, []byte(fmt.Sprintf("index %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i < count-1 {
+			eligible = append(eligible, dataPath, indexPath)
+		}
+	}
+	return eligible
+}
+
+// sendHook sends an event over the hook socket the way the hook command does,
+// and returns the daemon's reply
+func sendHook(socketPath string, action string, args hook.EventArgs) (hook.Reply, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return hook.Reply{}, err
+	}
+	defer conn.Close()
+
+	event := hook.Event{Version: hook.ProtocolVersion, ID: action, Action: action, Args: args, Time: time.Now()}
+	if err := json.NewEncoder(conn).Encode(event); err != nil {
+		return hook.Reply{}, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return hook.Reply{}, err
+	}
+	var reply hook.Reply
+	err = json.Unmarshal([]byte(line), &reply)
+	return reply, err
+}
+
+// TestDaemonConcurrentHooksRetriesScrapes runs the main loop while hooks,
+// retry cycles, backend scrapes and control API requests all come in at once,
+// as they do in production. Run it with -race.
+func TestDaemonConcurrentHooksRetriesScrapes(t *testing.T) {
+	client := newFakeZstor()
+	d := newTestDaemon(t, client)
+	root := d.cfg.ZdbRootPath
+	eligible := writeZdbFiles(t, root, "zdbfs-data", 6)
+	eligible = append(eligible, writeZdbFiles(t, root, "zdbfs-meta", 3)...)
+
+	// d0 was uploaded and then evicted, so only the missing-data hook
+	// brings it back
+	evicted := filepath.Join(root, "data", "zdbfs-data", "d0")
+	evictedContent, err := os.ReadFile(evicted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Store(evicted); err != nil {
+		t.Fatal(err)
+	}
+	checksum := zstor.GetLocalHash(evicted)
+	if err := d.journal.MarkUploaded(evicted, checksum, checksum); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.journal.MarkEvicted(evicted); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(evicted); err != nil {
+		t.Fatal(err)
+	}
+
+	hookSocket := filepath.Join(t.TempDir(), "hook.sock")
+	listener, err := net.Listen("unix", hookSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.hookHandler.Serve(listener)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Run()
+		close(stopped)
+	}()
+	d.StartUploadWorkers()
+
+	var wg sync.WaitGroup
+
+	// zdb raising hooks, several blocking on the evicted file at once
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := sendHook(hookSocket, "missing-data", hook.EventArgs{Path: evicted})
+			if err != nil || reply.Status != hook.StatusOK {
+				t.Errorf("missing-data hook: reply %+v, error %v", reply, err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, filePath := range eligible {
+			action, args := "jump-data", hook.EventArgs{Path: filePath}
+			if strings.Contains(filePath, "/index/") {
+				action = "jump-index"
+			}
+			reply, err := sendHook(hookSocket, action, args)
+			if err != nil || reply.Status != hook.StatusQueued {
+				t.Errorf("%s hook for %s: reply %+v, error %v", action, filePath, reply, err)
+			}
+		}
+	}()
+
+	// Retry cycles and status requests through the control API
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler := d.controlServer.Handler
+		for i := 0; i < 20; i++ {
+			for _, req := range []*http.Request{
+				httptest.NewRequest("POST", "/v1/retry", nil),
+				httptest.NewRequest("GET", "/v1/status", nil),
+				httptest.NewRequest("GET", "/v1/files", nil),
+				httptest.NewRequest("GET", "/v1/backends", nil),
+			} {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code >= 300 {
+					t.Errorf("%s %s: status %d", req.Method, req.URL, rec.Code)
+				}
+			}
+		}
+	}()
+
+	// Backend scrapes, each followed by a health update in the main loop
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := d.metricsScraper.ScrapeMetrics(); err != nil {
+				t.Errorf("scrape failed: %v", err)
+				return
+			}
+			d.notifyMetricsUpdate()
+		}
+	}()
+	wg.Wait()
+
+	// Everything settles once the queued uploads are done
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		entries, err := d.journal.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var waiting []string
+		for _, filePath := range eligible {
+			if entries[filePath].State != journal.StateUploaded {
+				waiting = append(waiting, fmt.Sprintf("%s (%s)", filePath, entries[filePath].State))
+			}
+		}
+		if len(waiting) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("files not uploaded: %s", strings.Join(waiting, ", "))
+		}
+		select {
+		case d.retryChan <- true:
+		default:
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	d.Shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(30 * time.Second):
+		t.Fatal("daemon didn't stop")
+	}
+
+	content, err := os.ReadFile(evicted)
+	if err != nil {
+		t.Fatalf("evicted file wasn't retrieved: %v", err)
+	}
+	if !bytes.Equal(content, evictedContent) {
+		t.Error("retrieved file doesn't match the evicted one")
+	}
+	if client.storeCount() < len(eligible) {
+		t.Errorf("got %d stores, want at least %d", client.storeCount(), len(eligible))
+	}
+}
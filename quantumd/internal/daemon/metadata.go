@@ -0,0 +1,274 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// metadataUpdate is the result of a metadata refresh. A full refresh covers
+// everything stored in zstor, while an incremental one only covers the paths
+// it looked up.
+type metadataUpdate struct {
+	full      bool
+	metadata  map[string]zstor.Metadata
+	checked   []string
+	startedAt time.Time
+	duration  time.Duration
+	err       error
+	// targeted is set for lookups of files changed remotely, such as by a
+	// rebuild, which run outside of the regular refreshes
+	targeted bool
+}
+
+// mode returns the label used for the refresh metrics
+func (u metadataUpdate) mode() string {
+	if u.full {
+		return "full"
+	}
+	return "incremental"
+}
+
+// RefreshMetadata fetches all metadata and updates the in-memory store. It's
+// used before the main loop starts.
+func (d *Daemon) RefreshMetadata() error {
+	log.Println("Refreshing metadata...")
+	update := d.fetchAllMetadata()
+	d.handleMetadataUpdate(update)
+	return update.err
+}
+
+// StartMetadataRefresh starts the metadata refresh loop. Metadata is kept
+// current by upload results, so the frequent refresh only looks up paths
+// that are unknown or changed since they were last checked, and everything
+// is only reloaded once per rescan interval to catch changes made outside of
+// the daemon, such as rebuilds.
+func (d *Daemon) StartMetadataRefresh() {
+	refreshTicker := time.NewTicker(d.cfg.MetaRefreshInterval)
+	defer refreshTicker.Stop()
+	rescanTicker := time.NewTicker(d.cfg.MetaRescanInterval)
+	defer rescanTicker.Stop()
+
+	for {
+		select {
+		case <-refreshTicker.C:
+			d.requestMetadataRefresh(false)
+		case <-rescanTicker.C:
+			d.requestMetadataRefresh(true)
+		case <-d.quitChan:
+			return
+		}
+	}
+}
+
+// requestMetadataRefresh asks the main loop to refresh metadata. It's safe to
+// call from any goroutine.
+func (d *Daemon) requestMetadataRefresh(full bool) {
+	select {
+	case d.refreshChan <- full:
+	default:
+		// A refresh is already waiting to run
+	}
+}
+
+// handleMetadataRefresh starts a refresh in the background. Only one refresh
+// runs at a time.
+func (d *Daemon) handleMetadataRefresh(full bool) {
+	if d.metadataRefreshing {
+		log.Println("Metadata refresh already running, skipping")
+		return
+	}
+
+	if full {
+		log.Println("Reloading all metadata...")
+		d.metadataRefreshing = true
+		go d.sendMetadataUpdate(d.fetchAllMetadata())
+		return
+	}
+
+	paths, err := d.staleMetadataPaths()
+	if err != nil {
+		log.Printf("Failed to find files to refresh metadata for: %v", err)
+		return
+	}
+	if len(paths) == 0 {
+		return
+	}
+	log.Printf("Refreshing metadata of %d new or changed files...", len(paths))
+	d.metadataRefreshing = true
+	go d.sendMetadataUpdate(d.fetchMetadataOf(paths))
+}
+
+// staleMetadataPaths returns the eligible files whose metadata hasn't been
+// checked since they were last modified. Files with an upload pending are
+// left out, since the upload brings their metadata.
+func (d *Daemon) staleMetadataPaths() ([]string, error) {
+	eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath, d.cfg.Namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get eligible files: %w", err)
+	}
+
+	var paths []string
+	for _, filePath := range eligibleFiles {
+		if d.isUploadPending(filePath) {
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+		checkedAt, checked := d.metadataCheckedAt[filePath]
+		if !checked || info.ModTime().After(checkedAt) {
+			paths = append(paths, filePath)
+		}
+	}
+	return paths, nil
+}
+
+// fetchAllMetadata fetches all metadata and assigns filenames to it, without
+// touching the in-memory store. It's safe to call outside the main loop.
+func (d *Daemon) fetchAllMetadata() metadataUpdate {
+	update := metadataUpdate{full: true, startedAt: time.Now()}
+	defer func() { update.duration = time.Since(update.startedAt) }()
+
+	// Get eligible files
+	eligibleFiles, err := util.GetEligibleZdbFiles(d.cfg.ZdbRootPath, d.cfg.Namespaces)
+	if err != nil {
+		update.err = fmt.Errorf("failed to get eligible files: %w", err)
+		return update
+	}
+
+	// Fetch all metadata
+	allMetadata, err := d.zstorClient.GetAllMetadata()
+	if err != nil {
+		update.err = fmt.Errorf("failed to fetch all metadata: %w", err)
+		return update
+	}
+	log.Printf("Retrieved metadata for %d files", len(allMetadata))
+
+	// Assign filenames to metadata
+	filenameMetadata, err := zstor.AssignFilenamesToMetadata(eligibleFiles, allMetadata, d.cfg.ZdbRootPath)
+	if err != nil {
+		update.err = fmt.Errorf("failed to assign filenames to metadata: %w", err)
+		return update
+	}
+
+	update.metadata = filenameMetadata
+	update.checked = eligibleFiles
+	return update
+}
+
+// fetchMetadataOf looks up the metadata of the given paths. Paths that can't
+// be looked up are left out of the update and tried again next time. It's
+// safe to call outside the main loop.
+func (d *Daemon) fetchMetadataOf(paths []string) metadataUpdate {
+	update := metadataUpdate{
+		metadata:  make(map[string]zstor.Metadata),
+		startedAt: time.Now(),
+	}
+	for _, filePath := range paths {
+		metadata, err := d.zstorClient.GetMetadata(filePath)
+		if err != nil {
+			if !errors.Is(err, zstor.ErrMetadataNotFound) {
+				log.Printf("Failed to refresh metadata of %s: %v", filePath, err)
+				continue
+			}
+		} else {
+			update.metadata[filePath] = *metadata
+		}
+		update.checked = append(update.checked, filePath)
+	}
+	update.duration = time.Since(update.startedAt)
+	return update
+}
+
+// refreshMetadataOf looks up the metadata of files that were changed
+// remotely, such as by a rebuild, and hands it to the main loop. It's safe to
+// call from any goroutine, and can run alongside a regular refresh.
+func (d *Daemon) refreshMetadataOf(paths []string) {
+	update := d.fetchMetadataOf(paths)
+	update.targeted = true
+	d.sendMetadataUpdate(update)
+}
+
+// sendMetadataUpdate hands a refresh result to the main loop, unless the
+// daemon is shutting down
+func (d *Daemon) sendMetadataUpdate(update metadataUpdate) {
+	select {
+	case d.metadataChan <- update:
+	case <-d.quitChan:
+	}
+}
+
+// handleMetadataUpdate merges the result of a refresh into the in-memory
+// store. Paths that were confirmed by an upload after the refresh started
+// keep what the upload recorded.
+func (d *Daemon) handleMetadataUpdate(update metadataUpdate) {
+	if !update.targeted {
+		d.metadataRefreshing = false
+	}
+	d.metrics.metadataRefreshDuration.WithLabelValues(update.mode()).Observe(update.duration.Seconds())
+
+	if update.err != nil {
+		log.Printf("Failed to refresh metadata: %v", update.err)
+		return
+	}
+
+	newer := func(filePath string) bool {
+		return d.metadataCheckedAt[filePath].After(update.startedAt)
+	}
+
+	changed := make(map[string]zstor.Metadata)
+	removed := 0
+
+	// A full refresh covers everything in zstor, so anything it didn't find
+	// is gone. An incremental one only knows about the paths it looked up.
+	if update.full {
+		for filePath := range d.metadataStore {
+			if _, exists := update.metadata[filePath]; !exists && !newer(filePath) {
+				delete(d.metadataStore, filePath)
+				removed++
+			}
+		}
+	}
+	for _, filePath := range update.checked {
+		if newer(filePath) {
+			continue
+		}
+		d.metadataCheckedAt[filePath] = update.startedAt
+		if _, exists := update.metadata[filePath]; exists {
+			continue
+		}
+		if _, exists := d.metadataStore[filePath]; exists {
+			delete(d.metadataStore, filePath)
+			removed++
+		}
+	}
+
+	for filePath, metadata := range update.metadata {
+		if newer(filePath) {
+			continue
+		}
+		if current, exists := d.metadataStore[filePath]; exists && reflect.DeepEqual(current, metadata) {
+			continue
+		}
+		d.metadataStore[filePath] = metadata
+		changed[filePath] = metadata
+	}
+
+	d.metrics.metadataEntriesChanged.WithLabelValues(update.mode()).Add(float64(len(changed) + removed))
+	d.syncJournal(changed)
+	log.Printf("Metadata %s refresh took %s: %d entries changed, %d removed, %d known",
+		update.mode(), update.duration.Round(time.Millisecond), len(changed), removed, len(d.metadataStore))
+
+	// Update healthy file configs metric
+	if len(changed) > 0 || removed > 0 {
+		d.updateHealthyFileConfigs()
+	}
+}
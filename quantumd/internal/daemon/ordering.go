@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// An index file iN points into the data file dN of the same namespace, so a
+// stored iN is only restorable once dN is stored as well. Index uploads that
+// finish before their data file are kept in the awaiting_data state, and are
+// completed once dN is stored with the checksum of the local file.
+
+// dataFileFor returns the data file an index file points into. Files without
+// a data file, such as the namespace descriptor, return false.
+func (d *Daemon) dataFileFor(indexPath string) (string, bool) {
+	name := filepath.Base(indexPath)
+	if !isIndexFile(indexPath) || !strings.HasPrefix(name, "i") {
+		return "", false
+	}
+	if _, err := strconv.Atoi(name[1:]); err != nil {
+		return "", false
+	}
+	return filepath.Join(d.cfg.ZdbRootPath, "data", util.NamespaceOf(indexPath), "d"+name[1:]), true
+}
+
+// indexFileFor returns the index file that points into a data file
+func (d *Daemon) indexFileFor(dataPath string) (string, bool) {
+	name := filepath.Base(dataPath)
+	if isIndexFile(dataPath) || !strings.HasPrefix(name, "d") {
+		return "", false
+	}
+	if _, err := strconv.Atoi(name[1:]); err != nil {
+		return "", false
+	}
+	return filepath.Join(d.cfg.ZdbRootPath, "index", util.NamespaceOf(dataPath), "i"+name[1:]), true
+}
+
+// localDataChecksum hashes the data file an index file points into. It's nil
+// when there is no data file or it isn't present locally, which for an
+// uploaded file means it was evicted after its checksum was confirmed.
+func (d *Daemon) localDataChecksum(indexPath string) []byte {
+	dataPath, ok := d.dataFileFor(indexPath)
+	if !ok {
+		return nil
+	}
+	if _, err := os.Stat(dataPath); err != nil {
+		return nil
+	}
+	return zstor.GetLocalHash(dataPath)
+}
+
+// dataStored reports whether a data file is stored in zstor with the given
+// local checksum. Without a local checksum any stored version will do.
+func (d *Daemon) dataStored(dataPath string, localChecksum []byte) (bool, error) {
+	entry, err := d.journal.Get(dataPath)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil || entry.State != journal.StateUploaded || entry.RemoteChecksum == nil {
+		return false, nil
+	}
+	return localChecksum == nil || bytes.Equal(entry.RemoteChecksum, localChecksum), nil
+}
+
+// recordIndexUpload records a successful index upload, as uploaded if its data
+// file is stored as well and as awaiting data otherwise. A data file that
+// isn't stored yet is queued for upload.
+func (d *Daemon) recordIndexUpload(result uploadResult) error {
+	dataPath, ok := d.dataFileFor(result.filePath)
+	if !ok {
+		return d.journal.MarkUploaded(result.filePath, result.localChecksum, result.metadata.Checksum)
+	}
+
+	stored, err := d.dataStored(dataPath, result.dataChecksum)
+	if err != nil {
+		return err
+	}
+	if stored {
+		return d.journal.MarkUploaded(result.filePath, result.localChecksum, result.metadata.Checksum)
+	}
+
+	log.Printf("Index %s is stored, but waits for data file %s", result.filePath, dataPath)
+	if err := d.journal.MarkAwaitingData(result.filePath, result.localChecksum, result.metadata.Checksum); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dataPath); err == nil && !d.isUploadPending(dataPath) {
+		d.uploadFile(dataPath, false)
+	}
+	return nil
+}
+
+// completeAwaitingIndex marks the index file pointing into a data file as
+// uploaded, once the data file is stored
+func (d *Daemon) completeAwaitingIndex(dataPath string) {
+	indexPath, ok := d.indexFileFor(dataPath)
+	if !ok {
+		return
+	}
+	completed, err := d.journal.CompleteAwaitingData(indexPath)
+	if err != nil {
+		log.Printf("Failed to update upload journal: %v", err)
+		return
+	}
+	if completed {
+		log.Printf("Index %s is complete now that %s is stored", indexPath, dataPath)
+	}
+}
+
+// checkAwaitingIndex completes an index file waiting for its data file if the
+// data file has been stored in the meantime, for instance by a metadata
+// refresh. It's run from the retry loop.
+func (d *Daemon) checkAwaitingIndex(indexPath string) {
+	dataPath, ok := d.dataFileFor(indexPath)
+	if !ok {
+		return
+	}
+	stored, err := d.dataStored(dataPath, d.localDataChecksum(indexPath))
+	if err != nil {
+		log.Printf("Failed to read upload journal: %v", err)
+		return
+	}
+	if stored {
+		d.completeAwaitingIndex(dataPath)
+	}
+}
+
+// syncIndexChecksum records the remote checksum of an index file found in the
+// metadata, as awaiting data unless its data file is stored as well
+func (d *Daemon) syncIndexChecksum(indexPath string, remoteChecksum []byte, metadata map[string]zstor.Metadata, entries map[string]journal.Entry) error {
+	dataPath, ok := d.dataFileFor(indexPath)
+	if !ok {
+		return d.journal.SetRemoteChecksum(indexPath, remoteChecksum)
+	}
+	_, inMetadata := metadata[dataPath]
+	if inMetadata || entries[dataPath].State == journal.StateUploaded {
+		return d.journal.SetRemoteChecksum(indexPath, remoteChecksum)
+	}
+	return d.journal.SetRemoteChecksumAwaitingData(indexPath, remoteChecksum)
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+func TestUploadQueueOrder(t *testing.T) {
+	q := newUploadQueue(prometheus.NewGauge(prometheus.GaugeOpts{Name: "depth"}), util.NamespacePolicy{})
+	for _, filePath := range []string{
+		"/opt/zdb/data/zdbfs-data/d1",
+		"/opt/zdb/index/zdbfs-data/i1",
+		"/opt/zdb/data/zdbfs-meta/d1",
+		"/opt/zdb/index/zdbfs-meta/i1",
+		"/opt/zdb/index/zdbfs-data/zdb-namespace",
+	} {
+		q.Push(uploadRequest{filePaths: []string{filePath}})
+	}
+
+	// The namespace descriptor and the zdbfs-meta index first, then the
+	// zdbfs-meta data, then everything else as it came in
+	want := []string{
+		"/opt/zdb/index/zdbfs-meta/i1",
+		"/opt/zdb/index/zdbfs-data/zdb-namespace",
+		"/opt/zdb/data/zdbfs-meta/d1",
+		"/opt/zdb/data/zdbfs-data/d1",
+		"/opt/zdb/index/zdbfs-data/i1",
+	}
+	for _, filePath := range want {
+		req, ok := q.Pop()
+		if !ok || req.filePaths[0] != filePath {
+			t.Fatalf("popped %v, want %s", req.filePaths, filePath)
+		}
+	}
+}
+
+// TestIndexAwaitsDataFile stores an index file ahead of its data file, which
+// the queue allows, and checks it's only counted as uploaded with its data
+func TestIndexAwaitsDataFile(t *testing.T) {
+	d := newTestDaemon(t, newFakeZstor())
+	writeZdbFiles(t, d.cfg.ZdbRootPath, "zdbfs-meta", 3)
+	indexPath := filepath.Join(d.cfg.ZdbRootPath, "index", "zdbfs-meta", "i1")
+	dataPath := filepath.Join(d.cfg.ZdbRootPath, "data", "zdbfs-meta", "d1")
+
+	d.handleUploadResult(storedResult(t, indexPath, d.localDataChecksum(indexPath)))
+	if state := journalState(t, d, indexPath); state != journal.StateAwaitingData {
+		t.Fatalf("index stored before its data file is %s, want %s", state, journal.StateAwaitingData)
+	}
+	// The data file is queued right away
+	if !d.isUploadPending(dataPath) {
+		t.Error("data file wasn't queued for the waiting index")
+	}
+
+	d.handleUploadResult(storedResult(t, dataPath, nil))
+	if state := journalState(t, d, indexPath); state != journal.StateUploaded {
+		t.Errorf("index is %s once its data file is stored, want %s", state, journal.StateUploaded)
+	}
+}
+
+// storedResult is the result of a successful upload of a local file
+func storedResult(t *testing.T, filePath string, dataChecksum []byte) uploadResult {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uploadResult{
+		filePath:      filePath,
+		localChecksum: zstor.GetLocalHash(filePath),
+		dataChecksum:  dataChecksum,
+		metadata:      fakeMetadata(content),
+	}
+}
+
+func journalState(t *testing.T, d *Daemon, filePath string) journal.State {
+	t.Helper()
+	entry, err := d.journal.Get(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		return ""
+	}
+	return entry.State
+}
@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"container/heap"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+)
+
+// uploadPriority orders work in the upload queue. Lower values go first.
+type uploadPriority int
+
+const (
+	// Namespace descriptors and the zdbfs-meta index are needed to restore
+	// anything at all, so they are uploaded first. Index files that finish
+	// before their data file are held back in the journal, see ordering.go.
+	priorityMetaIndex uploadPriority = iota
+	priorityMetaData
+	priorityData
+)
+
+// priorityFor returns the upload priority of a zdb file based on its
+// namespace and whether it is an index or data file
+func priorityFor(filePath string) uploadPriority {
+	if filepath.Base(filePath) == "zdb-namespace" {
+		return priorityMetaIndex
+	}
+
+	namespace := filepath.Base(filepath.Dir(filePath))
+	if namespace != "zdbfs-meta" {
+		return priorityData
+	}
+	if isIndexFile(filePath) {
+		return priorityMetaIndex
+	}
+	return priorityMetaData
+}
+
+// queuedUpload is an upload request waiting in the queue
+type queuedUpload struct {
+	req      uploadRequest
+	priority uploadPriority
+	// nsPriority is the namespace priority from the namespace policy
+	nsPriority int
+	seq        uint64
+}
+
+// uploadHeap implements heap.Interface, ordering by namespace priority, then
+// by file priority and then by arrival so that uploads of the same priority
+// are handled in FIFO order
+type uploadHeap []queuedUpload
+
+func (h uploadHeap) Len() int { return len(h) }
+func (h uploadHeap) Less(i, j int) bool {
+	if h[i].nsPriority != h[j].nsPriority {
+		return h[i].nsPriority > h[j].nsPriority
+	}
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h uploadHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *uploadHeap) Push(x any)   { *h = append(*h, x.(queuedUpload)) }
+func (h *uploadHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// uploadQueue is a blocking priority queue shared by the upload workers
+type uploadQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  uploadHeap
+	seq    uint64
+	closed bool
+	depth  prometheus.Gauge
+	policy util.NamespacePolicy
+}
+
+// newUploadQueue creates an empty queue that reports its length on the
+// given gauge and orders namespaces by the priorities of the policy
+func newUploadQueue(depth prometheus.Gauge, policy util.NamespacePolicy) *uploadQueue {
+	q := &uploadQueue{depth: depth, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds a request to the queue. A batch takes the highest priority of
+// any of its files.
+func (q *uploadQueue) Push(req uploadRequest) {
+	priority := priorityData
+	nsPriority := 0
+	for i, filePath := range req.filePaths {
+		if p := priorityFor(filePath); p < priority {
+			priority = p
+		}
+		if p := q.policy.Priority(util.NamespaceOf(filePath)); i == 0 || p > nsPriority {
+			nsPriority = p
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.seq++
+	heap.Push(&q.items, queuedUpload{req: req, priority: priority, nsPriority: nsPriority, seq: q.seq})
+	q.depth.Set(float64(len(q.items)))
+	q.cond.Signal()
+}
+
+// Pop blocks until a request is available and returns it. It returns false
+// once the queue has been closed.
+func (q *uploadQueue) Pop() (uploadRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return uploadRequest{}, false
+	}
+	item := heap.Pop(&q.items).(queuedUpload)
+	q.depth.Set(float64(len(q.items)))
+	return item.req, true
+}
+
+// Close wakes up all waiting workers and makes further calls to Pop return
+// false. Requests still in the queue are dropped.
+func (q *uploadQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Len returns the number of requests waiting in the queue
+func (q *uploadQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// describe returns a short description of a request for logging
+func (r uploadRequest) describe() string {
+	if len(r.filePaths) == 1 {
+		return r.filePaths[0]
+	}
+	return strings.Join(r.filePaths, ", ")
+}
@@ -0,0 +1,264 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// repairCooldown is how long a file is left alone after it was repaired, so
+// it isn't picked again before its new metadata is in
+const repairCooldown = time.Hour
+
+// repairTarget is a stored file with too few shards on live backends
+type repairTarget struct {
+	filePath string
+	checksum []byte
+	// healthy counts the shards on live backends, expected and minimum are
+	// the shard counts the file should have and needs to be rebuilt
+	healthy  int
+	expected int
+	minimum  int
+}
+
+// handleRepair looks for stored files with shards on backends that have been
+// dead for longer than the grace period, and repairs them in the background.
+// It runs in the main loop after each backend scrape, since it reads the
+// metadata store.
+func (d *Daemon) handleRepair() {
+	if !d.cfg.AutoRepair || d.repairing.Load() {
+		return
+	}
+
+	// Shards on backends that were swapped out of the config are lost, even
+	// though the scrape no longer reports them
+	zstorCfg, err := zstor.LoadConfig(d.cfg.ZstorConfigPath)
+	if err != nil {
+		log.Printf("Failed to load zstor config to check for lost shards: %v", err)
+		return
+	}
+	configured := make(map[string]bool)
+	for _, b := range configuredBackends(zstorCfg) {
+		configured[backendStatusKey(b.backendType, b.backend)] = true
+	}
+
+	targets := d.repairTargets(d.metricsScraper.GetBackendStatuses(), configured, time.Now())
+	if len(targets) == 0 {
+		return
+	}
+
+	d.repairing.Store(true)
+	d.retrievals.Add(1)
+	go func() {
+		defer d.retrievals.Done()
+		defer d.repairing.Store(false)
+		d.repair(targets)
+	}()
+}
+
+// repairTargets returns the stored files with fewer shards on live backends
+// than expected, the most damaged first. Files with an upload pending are
+// left out, since the upload stores them again anyway. configured holds the
+// status keys of the backends in the zstor config.
+func (d *Daemon) repairTargets(statuses map[string]zstor.BackendStatus, configured map[string]bool, now time.Time) []repairTarget {
+	// Without a scrape nothing is known about the backends yet
+	if len(statuses) == 0 {
+		return nil
+	}
+
+	var targets []repairTarget
+	for filePath, metadata := range d.metadataStore {
+		// Metadata that couldn't be matched to a local path is keyed by hash
+		if !filepath.IsAbs(filePath) || d.isUploadPending(filePath) {
+			continue
+		}
+
+		expected := d.cfg.ExpectedShards
+		if expected <= 0 {
+			expected = len(metadata.Shards)
+		}
+		minimum := d.cfg.MinShards
+		if minimum <= 0 {
+			minimum = metadata.DataShards
+		}
+		healthy := countLiveShards(metadata, statuses, configured, d.cfg.RepairGracePeriod, now)
+		if healthy >= expected {
+			continue
+		}
+		targets = append(targets, repairTarget{
+			filePath: filePath,
+			checksum: metadata.Checksum,
+			healthy:  healthy,
+			expected: expected,
+			minimum:  minimum,
+		})
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].healthy != targets[j].healthy {
+			return targets[i].healthy < targets[j].healthy
+		}
+		return targets[i].filePath < targets[j].filePath
+	})
+	return targets
+}
+
+// countLiveShards counts the shards of a file on live backends. A shard on a
+// dead backend still counts until the backend has been dead for the grace
+// period, and so does a shard on a configured backend missing from the
+// scrape, since nothing is known about it. A shard on a backend that is no
+// longer in the zstor config, such as one that was replaced, is lost.
+func countLiveShards(metadata zstor.Metadata, statuses map[string]zstor.BackendStatus, configured map[string]bool, grace time.Duration, now time.Time) int {
+	live := 0
+	for _, shard := range metadata.Shards {
+		key := fmt.Sprintf("%s-data-%s", shard.CI.Address, shard.CI.Namespace)
+		if !configured[key] {
+			continue
+		}
+		status, exists := statuses[key]
+		if !exists || status.IsAlive || status.DeadFor(now) < grace {
+			live++
+		}
+	}
+	return live
+}
+
+// repair repairs the targets within the hourly rate limit and records each
+// repair in the journal. Targets over the limit are left for a later scrape.
+// The limit counts the repairs recorded in the journal, so restarts don't
+// reset it. Only one repair runs at a time, so the cooldown state is only
+// touched here.
+func (d *Daemon) repair(targets []repairTarget) {
+	now := time.Now()
+	for filePath, repairedAt := range d.repairedAt {
+		if now.Sub(repairedAt) >= repairCooldown {
+			delete(d.repairedAt, filePath)
+		}
+	}
+	attempts, err := d.journal.CountRepairsSince(now.Add(-time.Hour))
+	if err != nil {
+		log.Printf("Failed to count recent repairs: %v", err)
+		return
+	}
+
+	var rebuilt []string
+	for i, target := range targets {
+		select {
+		case <-d.quitChan:
+			return
+		default:
+		}
+
+		if _, cooling := d.repairedAt[target.filePath]; cooling {
+			continue
+		}
+		if !d.cfg.RepairDryRun && attempts >= d.cfg.RepairMaxPerHour {
+			log.Printf("Reached the limit of %d repairs per hour, leaving %d files for later",
+				d.cfg.RepairMaxPerHour, len(targets)-i)
+			break
+		}
+
+		entry := d.repairFile(target)
+		d.repairedAt[target.filePath] = entry.RepairedAt
+		if entry.Result != journal.RepairPlanned {
+			attempts++
+		}
+		if entry.Result == journal.RepairDone && entry.Action == journal.RepairRebuild {
+			rebuilt = append(rebuilt, target.filePath)
+		}
+
+		d.metrics.repairs.WithLabelValues(string(entry.Action), string(entry.Result)).Inc()
+		if err := d.journal.RecordRepair(entry); err != nil {
+			log.Printf("Failed to record repair: %v", err)
+		}
+		// Only queued once the queued repair is in the journal, so the
+		// upload result can't come in before there is a repair to resolve
+		if entry.Result == journal.RepairQueued {
+			d.QueueUpload([]string{target.filePath}, isIndexFile(target.filePath))
+		}
+	}
+
+	// A rebuild moves shards to other backends
+	if len(rebuilt) > 0 {
+		d.refreshMetadataOf(rebuilt)
+	}
+}
+
+// repairFile has zstor rebuild a file that still has enough shards left to be
+// decoded. A file with fewer shards is reported as queued when its local
+// copy is intact, for the caller to store it again from that copy, and as
+// failed otherwise. The queued store counts as repaired once its upload is
+// confirmed. In dry-run mode the repair
+// is only logged.
+func (d *Daemon) repairFile(target repairTarget) journal.RepairEntry {
+	entry := journal.RepairEntry{
+		Path:           target.filePath,
+		Action:         journal.RepairRebuild,
+		Result:         journal.RepairFailed,
+		HealthyShards:  target.healthy,
+		ExpectedShards: target.expected,
+		RepairedAt:     time.Now(),
+	}
+	if target.healthy < target.minimum {
+		entry.Action = journal.RepairStore
+	}
+
+	if d.cfg.RepairDryRun {
+		log.Printf("Dry run: would %s %s, which has %d of %d shards on live backends",
+			entry.Action, target.filePath, target.healthy, target.expected)
+		entry.Result = journal.RepairPlanned
+		return entry
+	}
+
+	var err error
+	switch entry.Action {
+	case journal.RepairRebuild:
+		log.Printf("Rebuilding %s, which has %d of %d shards on live backends", target.filePath, target.healthy, target.expected)
+		err = d.zstorClient.Rebuild(target.filePath)
+	case journal.RepairStore:
+		localHash := zstor.GetLocalHash(target.filePath)
+		if localHash == nil || !bytes.Equal(localHash, target.checksum) {
+			log.Printf("ALERT: %s has %d shards on live backends, too few to rebuild, and no intact local copy to store it from",
+				target.filePath, target.healthy)
+			err = errors.New("too few shards to rebuild and no intact local copy")
+			break
+		}
+		log.Printf("Storing %s again from the local copy, it has %d shards on live backends and needs %d to be rebuilt",
+			target.filePath, target.healthy, target.minimum)
+		entry.Result = journal.RepairQueued
+		return entry
+	}
+	if err != nil {
+		log.Printf("Failed to repair %s: %v", target.filePath, err)
+		entry.Error = err.Error()
+		return entry
+	}
+
+	entry.Result = journal.RepairDone
+	return entry
+}
+
+// resolveQueuedRepairs records the outcome of an upload for a file a repair
+// queued to be stored again: repaired once the upload is confirmed, failed
+// once the file runs out of upload attempts. It runs in the main loop.
+func (d *Daemon) resolveQueuedRepairs(filePath string, uploadErr error) {
+	result, message := journal.RepairDone, ""
+	if uploadErr != nil {
+		result, message = journal.RepairFailed, uploadErr.Error()
+	}
+	resolved, err := d.journal.ResolveQueuedRepairs(filePath, result, message)
+	if err != nil {
+		log.Printf("Failed to record repair: %v", err)
+		return
+	}
+	if resolved > 0 {
+		d.metrics.repairs.WithLabelValues(string(journal.RepairStore), string(result)).Add(float64(resolved))
+	}
+}
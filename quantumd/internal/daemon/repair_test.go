@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+func TestRepairStoreQueuedUntilUploaded(t *testing.T) {
+	d := newTestDaemon(t, newFakeZstor())
+	d.cfg.RepairMaxPerHour = 10
+	writeZdbFiles(t, d.cfg.ZdbRootPath, "zdbfs-data", 2)
+	filePath := filepath.Join(d.cfg.ZdbRootPath, "data", "zdbfs-data", "d0")
+
+	d.repair([]repairTarget{{
+		filePath: filePath,
+		checksum: zstor.GetLocalHash(filePath),
+		healthy:  1,
+		expected: 4,
+		minimum:  2,
+	}})
+	if result := lastRepair(t, d).Result; result != journal.RepairQueued {
+		t.Fatalf("store is %s before its upload, want %s", result, journal.RepairQueued)
+	}
+	select {
+	case req := <-d.uploadRequestCh:
+		if req.filePaths[0] != filePath {
+			t.Errorf("queued upload of %v, want %s", req.filePaths, filePath)
+		}
+	default:
+		t.Fatal("no upload queued for the store")
+	}
+
+	d.handleUploadResult(storedResult(t, filePath, nil))
+	if result := lastRepair(t, d).Result; result != journal.RepairDone {
+		t.Errorf("store is %s once its upload is confirmed, want %s", result, journal.RepairDone)
+	}
+}
+
+func TestRepairRateLimitCountsJournal(t *testing.T) {
+	client := newFakeZstor()
+	d := newTestDaemon(t, client)
+	d.cfg.RepairMaxPerHour = 2
+
+	// Repairs from before a restart still count, dry runs and repairs older
+	// than an hour don't
+	for _, entry := range []journal.RepairEntry{
+		{Path: "/opt/zdb/data/zdbfs-data/d1", Action: journal.RepairRebuild, Result: journal.RepairDone, RepairedAt: time.Now().Add(-10 * time.Minute)},
+		{Path: "/opt/zdb/data/zdbfs-data/d2", Action: journal.RepairRebuild, Result: journal.RepairPlanned, RepairedAt: time.Now()},
+		{Path: "/opt/zdb/data/zdbfs-data/d3", Action: journal.RepairRebuild, Result: journal.RepairFailed, RepairedAt: time.Now().Add(-2 * time.Hour)},
+	} {
+		if err := d.journal.RecordRepair(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var targets []repairTarget
+	for _, name := range []string{"d4", "d5", "d6"} {
+		targets = append(targets, repairTarget{filePath: "/opt/zdb/data/zdbfs-data/" + name, healthy: 3, expected: 4, minimum: 2})
+	}
+	d.repair(targets)
+
+	repairs, err := d.journal.Repairs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 4 || repairs[0].Path != "/opt/zdb/data/zdbfs-data/d4" {
+		t.Errorf("got %d repairs, newest %s, want only d4 repaired within the limit", len(repairs), repairs[0].Path)
+	}
+}
+
+func TestCountLiveShards(t *testing.T) {
+	now := time.Now()
+	grace := 15 * time.Minute
+	backend := func(address string) zstor.BackendConfig {
+		return zstor.BackendConfig{Address: address, Namespace: "data1"}
+	}
+	statuses := map[string]zstor.BackendStatus{
+		backendStatusKey("data", backend("[2a02::1]:9900")): {IsAlive: true},
+		backendStatusKey("data", backend("[2a02::2]:9900")): {IsAlive: false, DeadSince: now.Add(-time.Minute)},
+		backendStatusKey("data", backend("[2a02::3]:9900")): {IsAlive: false, DeadSince: now.Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		live    bool
+	}{
+		{"alive", "[2a02::1]:9900", true},
+		{"dead within the grace period", "[2a02::2]:9900", true},
+		{"dead past the grace period", "[2a02::3]:9900", false},
+		{"configured but not scraped yet", "[2a02::4]:9900", true},
+		// A replaced backend drops out of the config and the scrape
+		{"replaced", "[2a02::5]:9900", false},
+	}
+	configured := make(map[string]bool)
+	for _, tt := range tests {
+		if tt.address != "[2a02::5]:9900" {
+			configured[backendStatusKey("data", backend(tt.address))] = true
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := zstor.Metadata{Shards: []zstor.Shard{{CI: zstor.CI{Address: tt.address, Namespace: "data1"}}}}
+			live := countLiveShards(metadata, statuses, configured, grace, now) == 1
+			if live != tt.live {
+				t.Errorf("shard counted live: %v, want %v", live, tt.live)
+			}
+		})
+	}
+}
+
+func lastRepair(t *testing.T, d *Daemon) journal.RepairEntry {
+	t.Helper()
+	repairs, err := d.journal.Repairs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) == 0 {
+		t.Fatal("no repair recorded")
+	}
+	return repairs[0]
+}
@@ -0,0 +1,358 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/deployer"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/workloads"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/grid"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/service"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// replaceCheckInterval is how often the daemon looks for backends that have
+// been dead long enough to be replaced
+const replaceCheckInterval = 10 * time.Minute
+
+// metaRefillTimeout bounds how long a new meta backend is refilled before the
+// dead zdb's contract is cancelled, and metaRefillRetryInterval is the wait
+// between passes that left files behind
+const (
+	metaRefillTimeout       = 2 * time.Hour
+	metaRefillRetryInterval = time.Minute
+)
+
+// configuredBackend is a backend in the zstor config. deadFor is only set
+// for dead backends.
+type configuredBackend struct {
+	backendType string
+	backend     zstor.BackendConfig
+	deadFor     time.Duration
+}
+
+// replaceAuditEntry is a line of the replacement audit log
+type replaceAuditEntry struct {
+	Time        time.Time `json:"time"`
+	Step        string    `json:"step"`
+	BackendType string    `json:"backend_type"`
+	Address     string    `json:"address"`
+	Namespace   string    `json:"namespace"`
+	Detail      string    `json:"detail,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// StartReplaceLoop periodically replaces backends that have been dead for
+// longer than the grace period. Replacements run one at a time in this
+// goroutine, and take at most one backend per check.
+func (d *Daemon) StartReplaceLoop() {
+	if !d.cfg.AutoReplaceBackends {
+		return
+	}
+	log.Printf("Replacing backends that are dead for more than %s", d.cfg.ReplaceGracePeriod)
+
+	ticker := time.NewTicker(replaceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.replaceDeadBackend()
+		case <-d.quitChan:
+			return
+		}
+	}
+}
+
+// replaceDeadBackend replaces the backend that has been dead the longest, if
+// it's past the grace period. Nothing is replaced while most backends are
+// dead, since that points to a network problem on this machine rather than
+// lost backends.
+func (d *Daemon) replaceDeadBackend() {
+	zstorCfg, err := zstor.LoadConfig(d.cfg.ZstorConfigPath)
+	if err != nil {
+		log.Printf("Failed to load zstor config to check for dead backends: %v", err)
+		return
+	}
+
+	statuses := d.metricsScraper.GetBackendStatuses()
+	now := time.Now()
+	backends := configuredBackends(zstorCfg)
+	dead := 0
+	var target *configuredBackend
+	for _, b := range backends {
+		status, exists := statuses[backendStatusKey(b.backendType, b.backend)]
+		if !exists || status.IsAlive {
+			continue
+		}
+		dead++
+		b.deadFor = status.DeadFor(now)
+		if b.deadFor >= d.cfg.ReplaceGracePeriod && (target == nil || b.deadFor > target.deadFor) {
+			target = &b
+		}
+	}
+	if target == nil {
+		return
+	}
+	if dead*2 > len(backends) {
+		log.Printf("%d of %d backends are dead, not replacing any until this machine's connectivity is checked", dead, len(backends))
+		return
+	}
+
+	d.replaceBackend(*target, statuses)
+}
+
+// replaceBackend deploys a new zdb for a dead backend, swaps it into the zstor
+// config, reloads zstor and cancels the contract of the dead zdb. A new meta
+// backend is refilled before the contract is cancelled, while the shards of
+// files on a new data backend are rebuilt by the repair loop. Every step is
+// recorded in the audit log. A replacement that can't be put in the config
+// is cancelled again, so no contract is left behind unused.
+func (d *Daemon) replaceBackend(target configuredBackend, statuses map[string]zstor.BackendStatus) {
+	audit := func(step, detail string, err error) {
+		d.auditReplacement(target, step, detail, err)
+	}
+	audit("start", fmt.Sprintf("dead for %s", target.deadFor.Round(time.Second)), nil)
+
+	gridClient, err := grid.NewGridClient(d.cfg.Network, d.cfg.Mnemonic, d.cfg.RelayURL, d.cfg.RMBTimeout)
+	if err != nil {
+		audit("failed", "", fmt.Errorf("failed to create grid client: %w", err))
+		return
+	}
+	defer gridClient.Close()
+
+	meta, data, err := grid.LoadExistingDeployments(&gridClient, d.cfg)
+	if err != nil {
+		audit("failed", "", fmt.Errorf("failed to load deployments: %w", err))
+		return
+	}
+	deployments := data
+	if target.backendType == "meta" {
+		deployments = meta
+	}
+	dead, found := findBackendDeployment(deployments, target.backend.Namespace)
+	if !found {
+		audit("failed", "", fmt.Errorf("no %s deployment found for namespace %s", target.backendType, target.backend.Namespace))
+		return
+	}
+
+	// Other nodes with dead zdbs aren't trusted with the replacement either
+	var avoid []uint32
+	for _, group := range []struct {
+		backendType string
+		deployments []workloads.Deployment
+	}{{"meta", meta}, {"data", data}} {
+		for _, deployment := range group.deployments {
+			backend, err := zstor.BackendFromDeployment(d.cfg, deployment)
+			if err != nil {
+				continue
+			}
+			if status, exists := statuses[backendStatusKey(group.backendType, backend)]; exists && !status.IsAlive {
+				avoid = append(avoid, deployment.NodeID)
+			}
+		}
+	}
+
+	replacement, err := grid.DeployReplacement(&gridClient, d.cfg, target.backendType, dead, meta, data, 0, avoid)
+	if err != nil {
+		audit("failed", "", err)
+		return
+	}
+	audit("deployed", fmt.Sprintf("node %d, contract %d", replacement.NodeID, replacement.ContractID), nil)
+
+	backend, err := d.swapBackend(target.backend, replacement)
+	if err != nil {
+		audit("failed", "", err)
+		d.cancelDeployment(&gridClient, target, replacement, "rolled_back")
+		return
+	}
+	audit("config_updated", fmt.Sprintf("node %d replaces node %d", replacement.NodeID, dead.NodeID), nil)
+
+	sm, err := service.NewServiceManager()
+	if err == nil {
+		err = sm.SignalService("zstor", "SIGUSR1")
+	}
+	if err != nil {
+		// The dead contract is kept, so the operator can see where things
+		// stopped. zstor picks up the new config once restarted.
+		log.Printf("ALERT: zstor config was updated for the replacement of %s, but zstor couldn't be reloaded", target.backend.Address)
+		audit("failed", "", fmt.Errorf("failed to reload zstor: %w", err))
+		return
+	}
+	audit("zstor_reloaded", "", nil)
+
+	// A new meta backend starts out empty, and the old one may be the only
+	// other copy of some shards, so its contract is kept until every file's
+	// metadata is on the new backend too
+	if target.backendType == "meta" {
+		if err := d.refillMetaBackend(backend); err != nil {
+			log.Printf("ALERT: meta backend %s wasn't refilled, contract %d of the dead zdb is kept", backend.Address, dead.ContractID)
+			audit("failed", fmt.Sprintf("contract %d kept", dead.ContractID), err)
+			return
+		}
+		audit("meta_refilled", "", nil)
+	}
+
+	d.cancelDeployment(&gridClient, target, dead, "contract_cancelled")
+}
+
+// swapBackend puts the zdb of a new deployment in the place of the old backend
+// in the zstor config, and returns the new backend
+func (d *Daemon) swapBackend(old zstor.BackendConfig, replacement workloads.Deployment) (zstor.BackendConfig, error) {
+	backend, err := zstor.BackendFromDeployment(d.cfg, replacement)
+	if err != nil {
+		return zstor.BackendConfig{}, err
+	}
+	// Reload right before writing, to keep any other changes
+	zstorCfg, err := zstor.LoadConfig(d.cfg.ZstorConfigPath)
+	if err != nil {
+		return zstor.BackendConfig{}, err
+	}
+	if !zstorCfg.ReplaceBackend(old, backend) {
+		return zstor.BackendConfig{}, fmt.Errorf("backend %s is no longer in the zstor config", old.Address)
+	}
+	return backend, zstorCfg.SaveConfig(d.cfg.ZstorConfigPath)
+}
+
+// refillMetaBackend has zstor store the metadata of every file again until
+// the new meta backend holds all of it, or metaRefillTimeout passes. zstor
+// has to be reloaded with the new backend first.
+func (d *Daemon) refillMetaBackend(backend zstor.BackendConfig) error {
+	client, err := zstor.NewExecClient(d.cfg.ZstorConfigPath)
+	if err != nil {
+		return err
+	}
+	defer client.MetaStore.Close()
+
+	zstorCfg, err := zstor.LoadConfig(d.cfg.ZstorConfigPath)
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, b := range zstorCfg.Meta.Config.Backends {
+		if b.Address == backend.Address && b.Namespace == backend.Namespace {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("meta backend %s is no longer in the zstor config", backend.Address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), metaRefillTimeout)
+	defer cancel()
+	// A shutdown stops the refill between files, keeping the old contract
+	go func() {
+		select {
+		case <-d.quitChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		missing, failed, err := client.RefillMetaBackend(ctx, index)
+		if err != nil {
+			return fmt.Errorf("failed to refill meta backend: %w", err)
+		}
+		if missing == 0 {
+			return nil
+		}
+		log.Printf("Stored the metadata of %d files again for meta backend %s, %d failed", missing-failed, backend.Address, failed)
+
+		// Check again right away after a clean pass, since files may have
+		// been stored with the old config meanwhile
+		if failed == 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("metadata of %d files still missing on meta backend after %s", failed, metaRefillTimeout)
+		case <-d.quitChan:
+			return fmt.Errorf("daemon stopped with the metadata of %d files missing on meta backend", failed)
+		case <-time.After(metaRefillRetryInterval):
+		}
+	}
+}
+
+// cancelDeployment cancels the contract of a deployment and records it under
+// the given step
+func (d *Daemon) cancelDeployment(gridClient *deployer.TFPluginClient, target configuredBackend, deployment workloads.Deployment, step string) {
+	detail := fmt.Sprintf("node %d, contract %d", deployment.NodeID, deployment.ContractID)
+	if err := grid.CancelDeployment(gridClient, deployment); err != nil {
+		log.Printf("ALERT: failed to cancel contract %d, it needs to be cancelled by hand", deployment.ContractID)
+		d.auditReplacement(target, "failed", detail, err)
+		return
+	}
+	d.auditReplacement(target, step, detail, nil)
+}
+
+// auditReplacement logs a step of a replacement and appends it to the audit
+// log
+func (d *Daemon) auditReplacement(target configuredBackend, step, detail string, stepErr error) {
+	entry := replaceAuditEntry{
+		Time:        time.Now(),
+		Step:        step,
+		BackendType: target.backendType,
+		Address:     target.backend.Address,
+		Namespace:   target.backend.Namespace,
+		Detail:      detail,
+	}
+	if stepErr != nil {
+		entry.Error = stepErr.Error()
+		log.Printf("Replacement of %s backend %s %s: %v", target.backendType, target.backend.Address, step, stepErr)
+	} else {
+		log.Printf("Replacement of %s backend %s %s %s", target.backendType, target.backend.Address, step, detail)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode replacement audit entry: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(d.cfg.ReplaceAuditLog), 0755); err != nil {
+		log.Printf("Failed to create replacement audit log directory: %v", err)
+		return
+	}
+	f, err := os.OpenFile(d.cfg.ReplaceAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open replacement audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write replacement audit log: %v", err)
+	}
+}
+
+// configuredBackends lists the meta and data backends of a zstor config
+func configuredBackends(zstorCfg *zstor.ZstorConfig) []configuredBackend {
+	var backends []configuredBackend
+	for _, backend := range zstorCfg.Meta.Config.Backends {
+		backends = append(backends, configuredBackend{backendType: "meta", backend: backend})
+	}
+	for _, group := range zstorCfg.Groups {
+		for _, backend := range group.Backends {
+			backends = append(backends, configuredBackend{backendType: "data", backend: backend})
+		}
+	}
+	return backends
+}
+
+// backendStatusKey returns the key of a backend in the scraped statuses
+func backendStatusKey(backendType string, backend zstor.BackendConfig) string {
+	return fmt.Sprintf("%s-%s-%s", backend.Address, backendType, backend.Namespace)
+}
+
+// findBackendDeployment returns the deployment whose zdb holds a namespace
+func findBackendDeployment(deployments []workloads.Deployment, namespace string) (workloads.Deployment, bool) {
+	for _, deployment := range deployments {
+		if len(deployment.Zdbs) > 0 && deployment.Zdbs[0].Namespace == namespace {
+			return deployment, true
+		}
+	}
+	return workloads.Deployment{}, false
+}
@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Retrieve downloads a data file from zstor. Concurrent calls for the same
+// path share a single download and its result. It implements hook.Retriever
+// and is safe to call from any goroutine.
+func (d *Daemon) Retrieve(filePath string) error {
+	result := <-d.retrievalGroup.DoChan(filePath, func() (any, error) {
+		// Checking inside the shared call means a file that is still being
+		// written by a retrieval is never mistaken for a cached one
+		if _, err := os.Stat(filePath); err == nil {
+			d.metrics.cacheHits.Inc()
+			return nil, nil
+		}
+		d.metrics.cacheMisses.Inc()
+		return nil, d.retrieve(filePath)
+	})
+	if result.Shared {
+		log.Printf("Shared retrieval of %s with other waiters", filePath)
+	}
+	return result.Err
+}
+
+// retrieve performs a single retrieval and records its latency and size
+func (d *Daemon) retrieve(filePath string) error {
+	d.retrievals.Add(1)
+	d.activeRetrievals.Add(1)
+	defer d.retrievals.Done()
+	defer d.activeRetrievals.Add(-1)
+
+	start := time.Now()
+	if err := d.zstorClient.Retrieve(filePath); err != nil {
+		return err
+	}
+	d.metrics.retrievalDuration.Observe(time.Since(start).Seconds())
+
+	// The file is back in the cache, so it can be evicted again later
+	if err := d.journal.ClearEvicted(filePath); err != nil {
+		log.Printf("Failed to update journal for %s: %v", filePath, err)
+	}
+
+	if info, err := os.Stat(filePath); err == nil {
+		d.metrics.retrievalSize.Observe(float64(info.Size()))
+	}
+	return nil
+}
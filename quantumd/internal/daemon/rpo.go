@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/control"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
+)
+
+// namespaceRPO tracks the local files of a namespace that have no matching
+// remote checksum, and would be lost if the frontend died
+type namespaceRPO struct {
+	// oldest is the modification time of the oldest such file, zero when
+	// everything is offloaded
+	oldest time.Time
+	bytes  int64
+	files  int
+}
+
+// age returns how long the oldest file has been waiting to be offloaded
+func (r namespaceRPO) age(now time.Time) time.Duration {
+	if r.oldest.IsZero() || now.Before(r.oldest) {
+		return 0
+	}
+	return now.Sub(r.oldest)
+}
+
+// updateRPO recomputes the recovery point of each namespace from the eligible
+// files. Files in offloaded were found to match their remote checksum by the
+// retry cycle, any other local file counts as not offloaded. The result is
+// published as a snapshot, since the control API reads it from other
+// goroutines.
+func (d *Daemon) updateRPO(eligibleFiles []string, offloaded map[string]bool) {
+	rpo := make(map[string]namespaceRPO)
+	for _, filePath := range eligibleFiles {
+		namespace := util.NamespaceOf(filePath)
+		ns := rpo[namespace]
+		if !offloaded[filePath] {
+			if info, err := os.Stat(filePath); err == nil {
+				ns.files++
+				ns.bytes += info.Size()
+				if ns.oldest.IsZero() || info.ModTime().Before(ns.oldest) {
+					ns.oldest = info.ModTime()
+				}
+			}
+		}
+		rpo[namespace] = ns
+	}
+
+	d.rpo.Store(&rpo)
+	d.updateRPOMetrics()
+}
+
+// updateRPOMetrics sets the RPO gauges from the last computed snapshot. The
+// ages keep growing between retry cycles, so this also runs on every metrics
+// update.
+func (d *Daemon) updateRPOMetrics() {
+	rpo := d.rpo.Load()
+	if rpo == nil {
+		return
+	}
+
+	now := time.Now()
+	d.metrics.rpoAge.Reset()
+	d.metrics.rpoPendingBytes.Reset()
+	for namespace, ns := range *rpo {
+		d.metrics.rpoAge.WithLabelValues(namespace).Set(ns.age(now).Seconds())
+		d.metrics.rpoPendingBytes.WithLabelValues(namespace).Set(float64(ns.bytes))
+	}
+
+	reason := d.degradedReason(now)
+	switch {
+	case reason != "" && !d.degraded:
+		log.Printf("Daemon is degraded: %s", reason)
+	case reason == "" && d.degraded:
+		log.Println("Daemon is no longer degraded, all namespaces are within the RPO threshold")
+	}
+	d.degraded = reason != ""
+	if d.degraded {
+		d.metrics.degraded.Set(1)
+	} else {
+		d.metrics.degraded.Set(0)
+	}
+}
+
+// degradedReason explains why the daemon is degraded, or returns an empty
+// string when it isn't. The daemon is degraded once the oldest file that
+// isn't offloaded in any namespace is older than the RPO threshold.
+func (d *Daemon) degradedReason(now time.Time) string {
+	rpo := d.rpo.Load()
+	if d.cfg.RPOThreshold <= 0 || rpo == nil {
+		return ""
+	}
+
+	var worst string
+	var worstAge time.Duration
+	for namespace, ns := range *rpo {
+		if age := ns.age(now); age > worstAge {
+			worst, worstAge = namespace, age
+		}
+	}
+	if worstAge <= d.cfg.RPOThreshold {
+		return ""
+	}
+	return fmt.Sprintf("namespace %s has data waiting to be offloaded for %s, over the RPO threshold of %s",
+		worst, worstAge.Round(time.Second), d.cfg.RPOThreshold)
+}
+
+// rpoStatus returns the recovery point of each namespace for the control API
+func (d *Daemon) rpoStatus(now time.Time) []control.NamespaceRPO {
+	rpo := d.rpo.Load()
+	if rpo == nil {
+		return nil
+	}
+
+	result := make([]control.NamespaceRPO, 0, len(*rpo))
+	for namespace, ns := range *rpo {
+		result = append(result, control.NamespaceRPO{
+			Namespace:    namespace,
+			OldestAt:     ns.oldest,
+			AgeSeconds:   ns.age(now).Seconds(),
+			PendingBytes: ns.bytes,
+			PendingFiles: ns.files,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Namespace < result[j].Namespace })
+	return result
+}
@@ -0,0 +1,322 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
+)
+
+// scrubCheckInterval is how often the daemon checks whether a scrub cycle is
+// due. Cycles are timed from the last recorded scrub, so restarts don't
+// postpone them.
+const scrubCheckInterval = time.Hour
+
+// scrubTarget is a stored file picked for scrubbing, with the metadata it is
+// checked against
+type scrubTarget struct {
+	filePath string
+	metadata zstor.Metadata
+}
+
+// StartScrubLoop periodically asks the main loop to start a scrub cycle
+func (d *Daemon) StartScrubLoop() {
+	if d.cfg.ScrubInterval <= 0 {
+		return
+	}
+	log.Printf("Scrubbing %.0f%% of stored files every %s, at up to %s/s",
+		d.cfg.ScrubSample*100, d.cfg.ScrubInterval, d.cfg.ScrubBandwidth)
+
+	ticker := time.NewTicker(min(scrubCheckInterval, d.cfg.ScrubInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.requestScrub(false)
+		case <-d.quitChan:
+			return
+		}
+	}
+}
+
+// requestScrub asks the main loop to start a scrub cycle. Unless forced, the
+// cycle only starts when the last one is at least a scrub interval ago.
+func (d *Daemon) requestScrub(force bool) {
+	select {
+	case d.scrubChan <- force:
+	default:
+		// A scrub request is already waiting to be handled
+	}
+}
+
+// handleScrub picks the files to scrub and starts a cycle in the background.
+// It runs in the main loop, which owns the metadata the files are checked
+// against.
+func (d *Daemon) handleScrub(force bool) {
+	if d.dataReader == nil {
+		log.Println("Scrubbing is disabled, set scrub_interval to enable it")
+		return
+	}
+	if d.scrubbing.Load() {
+		log.Println("Scrub already running, skipping")
+		return
+	}
+
+	scrubs, err := d.journal.Scrubs()
+	if err != nil {
+		log.Printf("Failed to read scrub results: %v", err)
+		return
+	}
+	if !force {
+		var last time.Time
+		for _, scrub := range scrubs {
+			if scrub.ScrubbedAt.After(last) {
+				last = scrub.ScrubbedAt
+			}
+		}
+		if time.Since(last) < d.cfg.ScrubInterval {
+			return
+		}
+	}
+
+	targets := d.scrubTargets(scrubs)
+	if len(targets) == 0 {
+		log.Println("No stored files to scrub")
+		return
+	}
+
+	d.scrubbing.Store(true)
+	d.retrievals.Add(1)
+	go func() {
+		defer d.retrievals.Done()
+		defer d.scrubbing.Store(false)
+		d.scrub(targets)
+	}()
+}
+
+// scrubTargets returns the sampled share of the stored files, least recently
+// scrubbed first so that every file gets its turn
+func (d *Daemon) scrubTargets(scrubs map[string]journal.ScrubEntry) []scrubTarget {
+	var targets []scrubTarget
+	for filePath, metadata := range d.metadataStore {
+		// Metadata that couldn't be matched to a local path is keyed by hash
+		if !filepath.IsAbs(filePath) {
+			continue
+		}
+		targets = append(targets, scrubTarget{filePath: filePath, metadata: metadata})
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		a, b := scrubs[targets[i].filePath].ScrubbedAt, scrubs[targets[j].filePath].ScrubbedAt
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return targets[i].filePath < targets[j].filePath
+	})
+
+	count := int(math.Ceil(float64(len(targets)) * d.cfg.ScrubSample))
+	return targets[:count]
+}
+
+// scrub retrieves each target into the scratch directory and checks it end to
+// end, within the bandwidth budget. It stops early on shutdown.
+func (d *Daemon) scrub(targets []scrubTarget) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.quitChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := os.MkdirAll(d.cfg.ScrubScratchPath, 0700); err != nil {
+		log.Printf("Failed to create scrub scratch directory: %v", err)
+		return
+	}
+
+	log.Printf("Starting scrub of %d files", len(targets))
+	start := time.Now()
+	limiter := &bandwidthLimiter{rate: float64(d.cfg.ScrubBandwidthBytes), start: start}
+	throttle := func(ctx context.Context, n int) error {
+		d.metrics.scrubReadBytes.Add(float64(n))
+		return limiter.wait(ctx, n)
+	}
+
+	counts := make(map[journal.ScrubResult]int)
+	for i, target := range targets {
+		entry, err := d.scrubFile(ctx, throttle, target)
+		if ctx.Err() != nil {
+			log.Printf("Scrub interrupted after %d of %d files", i, len(targets))
+			return
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		counts[entry.Result]++
+		d.metrics.scrubFiles.WithLabelValues(string(entry.Result)).Inc()
+		if err := d.journal.RecordScrub(entry); err != nil {
+			log.Printf("Failed to record scrub result: %v", err)
+		}
+		// Only queued once the queued result is in the journal, so the
+		// upload result can't come in before there is a scrub to resolve
+		if entry.Result == journal.ScrubQueued {
+			d.QueueUpload([]string{target.filePath}, isIndexFile(target.filePath))
+		}
+	}
+
+	log.Printf("Scrub of %d files finished in %s: %d ok, %d repaired, %d queued for upload, %d failed",
+		len(targets), time.Since(start).Round(time.Second),
+		counts[journal.ScrubOK], counts[journal.ScrubRepaired], counts[journal.ScrubQueued], counts[journal.ScrubFailed])
+	d.updateScrubFailedCount()
+}
+
+// scrubFile retrieves a single file and verifies it against its metadata. A
+// file with damaged shards that can still be decoded is rebuilt by zstor. A
+// file that can't be decoded or doesn't match its checksum is reported as
+// queued when its local copy is intact, for the caller to store it again
+// from that copy, and otherwise as failed. A queued file counts as repaired
+// once its upload is confirmed.
+func (d *Daemon) scrubFile(ctx context.Context, throttle func(context.Context, int) error, target scrubTarget) (journal.ScrubEntry, error) {
+	entry := journal.ScrubEntry{
+		Path:       target.filePath,
+		Result:     journal.ScrubFailed,
+		ScrubbedAt: time.Now(),
+	}
+
+	report, err := d.retrieveToScratch(ctx, throttle, target)
+	entry.HealthyShards = report.Healthy
+	entry.DamagedShards = len(report.Missing) + len(report.Corrupt)
+	if ctx.Err() != nil {
+		return entry, ctx.Err()
+	}
+
+	switch {
+	case err == nil && !report.Damaged():
+		entry.Result = journal.ScrubOK
+		return entry, nil
+
+	case err == nil:
+		log.Printf("Scrub of %s found missing shards %v and corrupt shards %v, rebuilding", target.filePath, report.Missing, report.Corrupt)
+		if err := d.zstorClient.Rebuild(target.filePath); err != nil {
+			log.Printf("ALERT: rebuild of %s after scrub failed: %v", target.filePath, err)
+			return entry, fmt.Errorf("rebuild failed: %w", err)
+		}
+		// The rebuild changed where the shards are
+		d.refreshMetadataOf([]string{target.filePath})
+		entry.Result = journal.ScrubRepaired
+		return entry, nil
+
+	default:
+		localHash := zstor.GetLocalHash(target.filePath)
+		if localHash != nil && bytes.Equal(localHash, target.metadata.Checksum) {
+			log.Printf("Scrub of %s failed (%v), storing it again from the local copy", target.filePath, err)
+			entry.Result = journal.ScrubQueued
+			return entry, err
+		}
+		log.Printf("ALERT: scrub of %s failed and there is no intact local copy to repair it from: %v", target.filePath, err)
+		return entry, err
+	}
+}
+
+// retrieveToScratch decodes a file from its shards into the scratch directory
+// and checks the result against the checksum in its metadata
+func (d *Daemon) retrieveToScratch(ctx context.Context, throttle func(context.Context, int) error, target scrubTarget) (*zstor.ShardReport, error) {
+	scratchPath := filepath.Join(d.cfg.ScrubScratchPath, zstor.GetPathHash(target.filePath))
+	f, err := os.Create(scratchPath)
+	if err != nil {
+		return &zstor.ShardReport{}, fmt.Errorf("failed to create scratch file: %w", err)
+	}
+	defer os.Remove(scratchPath)
+
+	report, err := d.dataReader.Read(ctx, &target.metadata, f, throttle)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write scratch file: %w", closeErr)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	hash := zstor.GetLocalHash(scratchPath)
+	if hash == nil {
+		return report, errors.New("failed to hash retrieved file")
+	}
+	if !bytes.Equal(hash, target.metadata.Checksum) {
+		return report, fmt.Errorf("retrieved checksum %x doesn't match stored checksum %x", hash, []byte(target.metadata.Checksum))
+	}
+	return report, nil
+}
+
+// resolveQueuedScrub records the outcome of an upload for a file a scrub
+// queued to be stored again: repaired once the upload is confirmed, failed
+// once the file runs out of upload attempts. It runs in the main loop.
+func (d *Daemon) resolveQueuedScrub(filePath string, uploadErr error) {
+	result := journal.ScrubRepaired
+	if uploadErr != nil {
+		result = journal.ScrubFailed
+	}
+	if err := d.journal.ResolveQueuedScrub(filePath, result); err != nil {
+		log.Printf("Failed to record scrub result: %v", err)
+		return
+	}
+	if uploadErr != nil {
+		d.updateScrubFailedCount()
+	}
+}
+
+// updateScrubFailedCount refreshes the gauge of files whose last scrub failed
+func (d *Daemon) updateScrubFailedCount() {
+	scrubs, err := d.journal.Scrubs()
+	if err != nil {
+		log.Printf("Failed to read scrub results: %v", err)
+		return
+	}
+	failed := 0
+	for _, scrub := range scrubs {
+		if scrub.Result == journal.ScrubFailed {
+			failed++
+		}
+	}
+	d.metrics.scrubFailedFiles.Set(float64(failed))
+}
+
+// bandwidthLimiter spreads reads over time so that the average rate since
+// start stays within the budget. A zero rate means no limit.
+type bandwidthLimiter struct {
+	rate     float64
+	start    time.Time
+	consumed int64
+}
+
+// wait accounts for n bytes read and sleeps until they fit in the budget
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.consumed += int64(n)
+	if l.rate <= 0 {
+		return nil
+	}
+
+	due := l.start.Add(time.Duration(float64(l.consumed) / l.rate * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,41 @@
+package daemon
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/journal"
+)
+
+func TestQueuedScrubResolvedByUpload(t *testing.T) {
+	d := newTestDaemon(t, newFakeZstor())
+	writeZdbFiles(t, d.cfg.ZdbRootPath, "zdbfs-data", 3)
+	stored := filepath.Join(d.cfg.ZdbRootPath, "data", "zdbfs-data", "d0")
+	lost := filepath.Join(d.cfg.ZdbRootPath, "data", "zdbfs-data", "d1")
+
+	for _, filePath := range []string{stored, lost} {
+		err := d.journal.RecordScrub(journal.ScrubEntry{Path: filePath, Result: journal.ScrubQueued, ScrubbedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.handleUploadResult(storedResult(t, stored, nil))
+
+	// The last attempt of an upload that keeps failing gives up on the file
+	d.cfg.UploadMaxAttempts = 1
+	d.handleUploadResult(uploadResult{filePath: lost, err: errors.New("backend unreachable")})
+
+	scrubs, err := d.journal.Scrubs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := scrubs[stored].Result; result != journal.ScrubRepaired {
+		t.Errorf("scrub of a confirmed upload is %s, want %s", result, journal.ScrubRepaired)
+	}
+	if result := scrubs[lost].Result; result != journal.ScrubFailed {
+		t.Errorf("scrub of a dead-letter upload is %s, want %s", result, journal.ScrubFailed)
+	}
+}
@@ -20,8 +20,11 @@ func DeployBackends(gridClient deployer.TFPluginClient, cfg *config.Config) ([]w
 	if cfg.MetaSizeGb <= 0 {
 		return nil, nil, fmt.Errorf("meta_size must be greater than 0")
 	}
-	if cfg.DataSizeGb <= 0 {
-		return nil, nil, fmt.Errorf("data_size or total_storage_size must be set to a value greater than 0")
+	groups := cfg.DataGroups()
+	for _, group := range groups {
+		if group.DataSizeGb <= 0 {
+			return nil, nil, fmt.Errorf("data_size or total_storage_size must be set to a value greater than 0")
+		}
 	}
 
 	deploymentDeployer := deployer.NewDeploymentDeployer(&gridClient)
@@ -67,14 +70,35 @@ func DeployBackends(gridClient deployer.TFPluginClient, cfg *config.Config) ([]w
 		}
 	}
 
-	requiredDataCount := cfg.ExpectedShards - len(existingDataNodes)
-	// Deploy data ZDBs, preferring metadata nodes after any manually specified data nodes.
-	dataDeployments, err := deployInBatches(
-		&deploymentDeployer, &gridClient, cfg, "data", cfg.DataSizeGb, workloads.ZDBModeSeq, requiredDataCount,
-		cfg.DataNodes, metaNodes, nodePool,
-	)
+	existingDataGroups, err := GroupDataDeployments(&gridClient, cfg, existingDataDeployments)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to deploy data ZDBs")
+		return nil, nil, errors.Wrap(err, "failed to group existing data deployments")
+	}
+
+	// Deploy data ZDBs per group, preferring metadata nodes after any manually
+	// specified data nodes. With several groups, only metadata nodes of the
+	// same group are preferred, to keep the groups apart. Each backend holds at
+	// most one shard of a file, so the group's data size fits its share.
+	var dataDeployments []workloads.Deployment
+	perGroup := cfg.DataBackendsPerGroup()
+	for i, group := range groups {
+		preferredNodes := metaNodes
+		groupPool := nodePool
+		if len(cfg.Groups) > 0 {
+			fmt.Printf("Deploying data ZDBs of group %s\n", group.Name)
+			preferredNodes = nodesInGroup(&gridClient, cfg.Groups, i, metaNodes)
+			groupPool = nodePool.ForGroup(group)
+		}
+
+		requiredDataCount := perGroup - len(existingDataGroups[i])
+		deployments, err := deployInBatches(
+			&deploymentDeployer, &gridClient, cfg, "data", group.DataSizeGb, workloads.ZDBModeSeq, requiredDataCount,
+			group.Nodes, preferredNodes, groupPool,
+		)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to deploy data ZDBs of group %s", group.Name)
+		}
+		dataDeployments = append(dataDeployments, deployments...)
 	}
 
 	allMetaDeployments := append(existingMetaDeployments, metaDeployments...)
@@ -104,24 +128,28 @@ func deployInBatches(
 
 	// Build the list of nodes to deploy, respecting priority.
 	processedForDeployList := make(map[uint32]bool)
-	addNode := func(nodeID uint32) {
+	addNode := func(nodeID uint32) bool {
 		if _, ok := processedForDeployList[nodeID]; ok {
-			return // already added
+			return false // already added
 		}
-		// Nodes may have both a data and a meta zdb.
-		if (pool.IsDataNode(nodeID) && nodeType == "meta") || (pool.IsMetaNode(nodeID) && nodeType == "data") {
-			nodesToDeploy = append(nodesToDeploy, nodeID)
-			processedForDeployList[nodeID] = true
+		// Nodes may have both a data and a meta zdb, but not two of a kind.
+		if (nodeType == "meta" && pool.IsMetaNode(nodeID)) || (nodeType == "data" && pool.IsDataNode(nodeID)) {
+			return false
 		}
+		nodesToDeploy = append(nodesToDeploy, nodeID)
+		processedForDeployList[nodeID] = true
+		return true
 	}
 
 	// Prioritize manual nodes
 	for _, nodeID := range manualNodes {
-		addNode(nodeID)
+		if addNode(nodeID) {
+			fmt.Printf("Using node %d for a %s ZDB, as configured\n", nodeID, nodeType)
+		}
 	}
 
-	// Then add preferred nodes
-	for _, nodeID := range preferredNodes {
+	// Then add preferred nodes, within the anti-affinity caps
+	for _, nodeID := range pool.Preferred(requiredCount-len(nodesToDeploy), nodeType, preferredNodes, nodesToDeploy) {
 		addNode(nodeID)
 	}
 
@@ -146,7 +174,7 @@ func deployInBatches(
 		} else {
 			// If no manual nodes left, get new ones from the pool
 			fmt.Printf("Needing %d more %s nodes, searching farms...\n", needed, nodeType)
-			newCandidates, err := pool.Get(needed)
+			newCandidates, err := pool.Get(needed, nodeType)
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to get candidate nodes for %s deployment", nodeType)
 			}
@@ -192,6 +220,7 @@ func deployInBatches(
 			// After BatchDeploy, contract ID should be updated in the deployment object.
 			if dl.ContractID == 0 {
 				fmt.Printf("warn: deployment on node %d failed to get a contract ID.\n", dl.NodeID)
+				pool.MarkFailed(dl.NodeID)
 				continue
 			}
 
@@ -0,0 +1,32 @@
+package grid
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/deployer"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/workloads"
+)
+
+// ResizeZDB grows the zdb of a deployment in place, keeping its contract and
+// namespace. zos refuses to shrink a zdb, and fails the update if the node
+// doesn't have the free space.
+func ResizeZDB(gridClient *deployer.TFPluginClient, deployment workloads.Deployment, sizeGB int) error {
+	if len(deployment.Zdbs) == 0 {
+		return fmt.Errorf("deployment %s has no ZDBs", deployment.Name)
+	}
+
+	updated := deployment
+	updated.Zdbs = append([]workloads.ZDB{}, deployment.Zdbs...)
+	updated.Zdbs[0].SizeGB = uint64(sizeGB)
+
+	deploymentDeployer := deployer.NewDeploymentDeployer(gridClient)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if err := deploymentDeployer.Deploy(ctx, &updated); err != nil {
+		return errors.Wrapf(err, "failed to resize ZDB on node %d", deployment.NodeID)
+	}
+	return nil
+}
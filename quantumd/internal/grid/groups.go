@@ -0,0 +1,71 @@
+package grid
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/deployer"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/workloads"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+)
+
+// GroupDataDeployments splits data deployments over the data groups of the
+// config, in config order. A deployment belongs to the group that lists its
+// node, or else to the group that lists the farm of its node. Without groups
+// in the config, all deployments form a single group.
+func GroupDataDeployments(gridClient *deployer.TFPluginClient, cfg *config.Config, data []workloads.Deployment) ([][]workloads.Deployment, error) {
+	if len(cfg.Groups) == 0 {
+		return [][]workloads.Deployment{data}, nil
+	}
+
+	grouped := make([][]workloads.Deployment, len(cfg.Groups))
+	for _, deployment := range data {
+		index, err := nodeGroup(gridClient, cfg.Groups, deployment.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("data ZDB on node %d is in none of the groups, add the node or its farm to a group", deployment.NodeID)
+		}
+		grouped[index] = append(grouped[index], deployment)
+	}
+	return grouped, nil
+}
+
+// nodeGroup returns the index of the group a node belongs to, or -1 if it
+// belongs to none
+func nodeGroup(gridClient *deployer.TFPluginClient, groups []config.Group, nodeID uint32) (int, error) {
+	for i, group := range groups {
+		for _, node := range group.Nodes {
+			if node == nodeID {
+				return i, nil
+			}
+		}
+	}
+
+	node, err := gridClient.GridProxyClient.Node(context.Background(), nodeID)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to look up the farm of node %d", nodeID)
+	}
+	for i, group := range groups {
+		for _, farm := range group.Farms {
+			if farm == uint64(node.FarmID) {
+				return i, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// nodesInGroup returns the nodes that belong to a group. Nodes that can't be
+// looked up are left out.
+func nodesInGroup(gridClient *deployer.TFPluginClient, groups []config.Group, index int, nodes []uint32) []uint32 {
+	var result []uint32
+	for _, nodeID := range nodes {
+		if i, err := nodeGroup(gridClient, groups, nodeID); err == nil && i == index {
+			result = append(result, nodeID)
+		}
+	}
+	return result
+}
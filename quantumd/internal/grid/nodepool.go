@@ -17,7 +17,13 @@ type NodePool struct {
 	gridClient *deployer.TFPluginClient
 	metaNodes  map[uint32]struct{}
 	dataNodes  map[uint32]struct{}
-	mu         sync.Mutex
+	// Farms to pick nodes from, and the free space they need
+	farms  []uint64
+	sizeGB int
+	// Known details of nodes, for scoring, and nodes that failed to deploy
+	info   map[uint32]nodeInfo
+	failed map[uint32]struct{}
+	mu     *sync.Mutex
 }
 
 // newNodePool creates a helper for managing available nodes for deployment.
@@ -30,51 +36,175 @@ func NewNodePool(cfg *config.Config, gridClient *deployer.TFPluginClient, metaNo
 	for _, node := range dataNodes {
 		dataMap[node] = struct{}{}
 	}
+	// Without global farms, nodes come from the farms of all groups
+	farms := cfg.Farms
+	if len(farms) == 0 {
+		for _, group := range cfg.Groups {
+			farms = append(farms, group.Farms...)
+		}
+	}
 	return &NodePool{
 		cfg:        cfg,
 		gridClient: gridClient,
 		metaNodes:  metaMap,
 		dataNodes:  dataMap,
-		mu:         sync.Mutex{},
+		farms:      farms,
+		sizeGB:     cfg.DataSizeGb,
+		info:       make(map[uint32]nodeInfo),
+		failed:     make(map[uint32]struct{}),
+		mu:         &sync.Mutex{},
+	}
+}
+
+// ForGroup returns a pool that picks nodes from the farms of a data group.
+// It shares the used nodes with this pool, so no node is picked twice.
+func (p *NodePool) ForGroup(group config.Group) *NodePool {
+	return &NodePool{
+		cfg:        p.cfg,
+		gridClient: p.gridClient,
+		metaNodes:  p.metaNodes,
+		dataNodes:  p.dataNodes,
+		farms:      group.Farms,
+		sizeGB:     group.DataSizeGb,
+		info:       p.info,
+		failed:     p.failed,
+		mu:         p.mu,
 	}
 }
 
-func (p *NodePool) Get(count int) ([]uint32, error) {
+// Get picks nodes for new zdbs of a type from the farms. Candidates are
+// ranked by the configured node scoring, one pick at a time so that each pick
+// accounts for the nodes chosen before it, and nodes that would exceed the
+// anti-affinity caps are passed over. Every pick is explained in the output.
+func (p *NodePool) Get(count int, nodeType string) ([]uint32, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if len(p.cfg.Farms) == 0 {
+	if len(p.farms) == 0 {
 		return nil, errors.New("no farms configured for automatic node selection")
 	}
 
 	// Fetch available nodes from farms
-	hru := uint64(p.cfg.DataSizeGb) * 1024 * 1024 * 1024 // Use data size for filtering
-	availableNodes, err := p.getNodesFromFarms(p.cfg.Farms, hru, 0)
+	hru := uint64(p.sizeGB) * 1024 * 1024 * 1024 // Use data size for filtering
+	availableNodes, err := p.getNodesFromFarms(p.farms, hru, 0)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get nodes from farms")
 	}
 
-	// Filter out excluded nodes
-	candidates := []uint32{}
-	for _, nodeID := range availableNodes {
-		if _, ok := p.metaNodes[nodeID]; ok {
-			continue
-		}
-		if _, ok := p.dataNodes[nodeID]; ok {
+	excluded := make(map[uint32]bool)
+	for _, nodeID := range p.cfg.ExcludeNodes {
+		excluded[nodeID] = true
+	}
+
+	// Filter out used and excluded nodes
+	candidates := []nodeInfo{}
+	for _, node := range availableNodes {
+		nodeID := uint32(node.NodeID)
+		if p.IsUsed(nodeID) || excluded[nodeID] {
 			continue
 		}
-		candidates = append(candidates, nodeID)
+		candidates = append(candidates, nodeInfoFromNode(node))
 	}
 
 	if len(candidates) < count {
 		return nil, fmt.Errorf("not enough available nodes in farms, needed %d, found %d", count, len(candidates))
 	}
 
+	// Ties are broken at random
 	rand.Shuffle(len(candidates), func(i, j int) {
 		candidates[i], candidates[j] = candidates[j], candidates[i]
 	})
 
-	return candidates[:count], nil
+	selection := newSelection(p.cfg, nodeType, p.sizeGB, candidates, p.placed(nodeType))
+	var selected []uint32
+	for len(selected) < count {
+		node, ok := selection.next()
+		if !ok {
+			return nil, fmt.Errorf("not enough available nodes in farms within max_shards_per_farm and max_shards_per_country, needed %d, found %d",
+				count, len(selected))
+		}
+		p.info[node.id] = node
+		selected = append(selected, node.id)
+	}
+	return selected, nil
+}
+
+// Preferred picks up to count of the preferred nodes for new zdbs of a type,
+// in order, such as nodes that hold a zdb of the other type. Nodes that would
+// exceed the anti-affinity caps, counting the manual nodes deployed before
+// them, are passed over. Every pick and skip is explained in the output.
+func (p *NodePool) Preferred(count int, nodeType string, preferred, manual []uint32) []uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	placed := p.placed(nodeType)
+	isManual := make(map[uint32]bool)
+	for _, nodeID := range manual {
+		isManual[nodeID] = true
+		info, err := p.nodeInfo(nodeID)
+		if err != nil {
+			fmt.Printf("warn: %v, leaving it out of the node scoring\n", err)
+			continue
+		}
+		placed = append(placed, info)
+	}
+
+	selection := newSelection(p.cfg, nodeType, p.sizeGB, nil, placed)
+	var selected []uint32
+	for _, nodeID := range preferred {
+		if len(selected) >= count {
+			break
+		}
+		if isManual[nodeID] || (nodeType == "meta" && p.IsMetaNode(nodeID)) || (nodeType == "data" && p.IsDataNode(nodeID)) {
+			continue
+		}
+		info, err := p.nodeInfo(nodeID)
+		if err != nil {
+			fmt.Printf("warn: %v, passing over preferred node %d\n", err, nodeID)
+			continue
+		}
+		if selection.prefer(info) {
+			selected = append(selected, nodeID)
+		}
+	}
+	return selected
+}
+
+// placed returns the nodes holding a zdb of a type, for the node scoring and
+// the anti-affinity caps
+func (p *NodePool) placed(nodeType string) []nodeInfo {
+	placedNodes := p.dataNodes
+	if nodeType == "meta" {
+		placedNodes = p.metaNodes
+	}
+	var placed []nodeInfo
+	for nodeID := range placedNodes {
+		if _, ok := p.failed[nodeID]; ok {
+			continue
+		}
+		info, err := p.nodeInfo(nodeID)
+		if err != nil {
+			fmt.Printf("warn: %v, leaving it out of the node scoring\n", err)
+			continue
+		}
+		placed = append(placed, info)
+	}
+	return placed
+}
+
+// nodeInfo returns what is known about a node, looking it up on the grid
+// proxy the first time
+func (p *NodePool) nodeInfo(nodeID uint32) (nodeInfo, error) {
+	if info, ok := p.info[nodeID]; ok {
+		return info, nil
+	}
+	node, err := p.gridClient.GridProxyClient.Node(context.Background(), nodeID)
+	if err != nil {
+		return nodeInfo{}, errors.Wrapf(err, "failed to look up node %d", nodeID)
+	}
+	info := nodeInfoFromNested(node)
+	p.info[nodeID] = info
+	return info, nil
 }
 
 func (p *NodePool) MarkUsed(nodeID uint32, nodeType string) {
@@ -87,7 +217,15 @@ func (p *NodePool) MarkUsed(nodeID uint32, nodeType string) {
 	}
 }
 
-func (p *NodePool) getNodesFromFarms(farmIDs []uint64, hru, sru uint64) ([]uint32, error) {
+// MarkFailed records that a deployment on a node failed. The node stays used,
+// so it isn't tried again, but no longer counts as holding a zdb.
+func (p *NodePool) MarkFailed(nodeID uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed[nodeID] = struct{}{}
+}
+
+func (p *NodePool) getNodesFromFarms(farmIDs []uint64, hru, sru uint64) ([]types.Node, error) {
 	rentedFalse := false
 	filter := types.NodeFilter{
 		FarmIDs: farmIDs,
@@ -102,12 +240,7 @@ func (p *NodePool) getNodesFromFarms(farmIDs []uint64, hru, sru uint64) ([]uint3
 		return nil, errors.Wrap(err, "failed to query nodes from grid proxy")
 	}
 
-	var nodeIDs []uint32
-	for _, node := range nodes {
-		nodeIDs = append(nodeIDs, uint32(node.NodeID))
-	}
-
-	return nodeIDs, nil
+	return nodes, nil
 }
 
 // IsMetaNode returns true if the given node ID is marked as a meta node
@@ -0,0 +1,99 @@
+package grid
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/deployer"
+	"github.com/scottyeager/tfgrid-sdk-go/grid-client/workloads"
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+)
+
+// DeployReplacement deploys a zdb to take over from an old one, with the same
+// size and mode. The replacement goes on the target node when one is given,
+// and otherwise on a node that holds none of the deployment's zdbs yet, or on
+// a node that only holds a zdb of the other type, as with DeployBackends.
+// Data zdbs are only replaced within their group. Nodes in avoid, such as
+// nodes with dead zdbs, are never picked automatically.
+func DeployReplacement(gridClient *deployer.TFPluginClient, cfg *config.Config, nodeType string, old workloads.Deployment, meta, data []workloads.Deployment, target uint32, avoid []uint32) (workloads.Deployment, error) {
+	if len(old.Zdbs) == 0 {
+		return workloads.Deployment{}, fmt.Errorf("deployment %s has no ZDBs", old.Name)
+	}
+	zdb := old.Zdbs[0]
+
+	var metaNodes, dataNodes []uint32
+	for _, d := range meta {
+		metaNodes = append(metaNodes, d.NodeID)
+	}
+	for _, d := range data {
+		dataNodes = append(dataNodes, d.NodeID)
+	}
+	pool := NewNodePool(cfg, gridClient, metaNodes, dataNodes)
+
+	sameType, otherType := dataNodes, metaNodes
+	if nodeType == "meta" {
+		sameType, otherType = metaNodes, dataNodes
+	}
+
+	// A data zdb is replaced within its group, so the groups stay apart
+	if nodeType == "data" && len(cfg.Groups) > 0 {
+		index, err := nodeGroup(gridClient, cfg.Groups, old.NodeID)
+		if err != nil {
+			return workloads.Deployment{}, err
+		}
+		if index < 0 {
+			return workloads.Deployment{}, fmt.Errorf("data ZDB on node %d is in none of the groups", old.NodeID)
+		}
+		group := cfg.Groups[index]
+		if target != 0 {
+			if targetIndex, err := nodeGroup(gridClient, cfg.Groups, target); err != nil {
+				return workloads.Deployment{}, err
+			} else if targetIndex != index {
+				return workloads.Deployment{}, fmt.Errorf("node %d is not in group %s of the data ZDB it would replace", target, group.Name)
+			}
+		}
+		pool = pool.ForGroup(group)
+		otherType = nodesInGroup(gridClient, cfg.Groups, index, otherType)
+	}
+	skip := make(map[uint32]bool)
+	for _, nodeID := range append(append([]uint32{}, sameType...), avoid...) {
+		skip[nodeID] = true
+	}
+	var preferredNodes []uint32
+	for _, nodeID := range otherType {
+		if !skip[nodeID] {
+			preferredNodes = append(preferredNodes, nodeID)
+		}
+	}
+
+	var manualNodes []uint32
+	if target != 0 {
+		for _, nodeID := range sameType {
+			if nodeID == target {
+				return workloads.Deployment{}, fmt.Errorf("node %d already holds a %s ZDB of this deployment", target, nodeType)
+			}
+		}
+		manualNodes = []uint32{target}
+	}
+
+	deploymentDeployer := deployer.NewDeploymentDeployer(gridClient)
+	deployments, err := deployInBatches(
+		&deploymentDeployer, gridClient, cfg, nodeType, int(zdb.SizeGB), zdb.Mode, 1,
+		manualNodes, preferredNodes, pool,
+	)
+	if err != nil {
+		return workloads.Deployment{}, errors.Wrapf(err, "failed to deploy replacement %s ZDB", nodeType)
+	}
+	return deployments[0], nil
+}
+
+// CancelDeployment cancels the contract of a single deployment
+func CancelDeployment(gridClient *deployer.TFPluginClient, deployment workloads.Deployment) error {
+	if deployment.ContractID == 0 {
+		return fmt.Errorf("deployment %s has no contract", deployment.Name)
+	}
+	if err := gridClient.SubstrateConn.CancelContract(gridClient.Identity, deployment.ContractID); err != nil {
+		return errors.Wrapf(err, "failed to cancel contract %d", deployment.ContractID)
+	}
+	return nil
+}
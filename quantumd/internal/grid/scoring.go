@@ -0,0 +1,251 @@
+package grid
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+	"github.com/threefoldtech/tfgrid-sdk-go/grid-proxy/pkg/types"
+)
+
+// bootHorizon is the time since boot at which a node gets the full score. The
+// grid proxy only reports the time since the last boot rather than an uptime
+// history, so this favors nodes that haven't rebooted lately, whatever their
+// downtime before that.
+const bootHorizon = 30 * 24 * time.Hour
+
+// nodeInfo is what node selection knows about a node
+type nodeInfo struct {
+	id      uint32
+	farmID  uint64
+	country string
+	// place is the city and country for display, location is used to
+	// compare nodes
+	place     string
+	location  string
+	sinceBoot time.Duration
+	totalHRU  uint64
+	freeHRU   uint64
+	price     float64
+}
+
+func nodeInfoFromNode(node types.Node) nodeInfo {
+	return newNodeInfo(node.NodeID, node.FarmID, node.Country, node.City, node.Location, node.Uptime,
+		uint64(node.TotalResources.HRU), uint64(node.UsedResources.HRU), node.PriceUsd)
+}
+
+func nodeInfoFromNested(node types.NodeWithNestedCapacity) nodeInfo {
+	return newNodeInfo(node.NodeID, node.FarmID, node.Country, node.City, node.Location, node.Uptime,
+		uint64(node.Capacity.Total.HRU), uint64(node.Capacity.Used.HRU), node.PriceUsd)
+}
+
+// newNodeInfo builds the node info from what the grid proxy reports. Its
+// uptime field holds the seconds since the node's last boot.
+func newNodeInfo(nodeID, farmID int, country, city string, location types.Location, uptime int64, totalHRU, usedHRU uint64, price float64) nodeInfo {
+	info := nodeInfo{
+		id:        uint32(nodeID),
+		farmID:    uint64(farmID),
+		country:   country,
+		place:     fmt.Sprintf("%s, %s", city, country),
+		sinceBoot: time.Duration(uptime) * time.Second,
+		totalHRU:  totalHRU,
+		price:     price,
+	}
+	// Nodes within about 10 km of each other count as one location
+	info.location = info.place
+	if location.Latitude != nil && location.Longitude != nil {
+		info.location = fmt.Sprintf("%.1f,%.1f", *location.Latitude, *location.Longitude)
+	}
+	if usedHRU < totalHRU {
+		info.freeHRU = totalHRU - usedHRU
+	}
+	return info
+}
+
+// scorer rates a candidate node between 0 and 1
+type scorer struct {
+	name   string
+	weight float64
+	score  func(node nodeInfo, s *selection) float64
+}
+
+// newScorers returns the scorers with a weight in the config
+func newScorers(weights config.NodeScoring) []scorer {
+	all := []scorer{
+		{"time since boot", weights.TimeSinceBoot, scoreTimeSinceBoot},
+		{"capacity", weights.Capacity, scoreCapacity},
+		{"price", weights.Price, scorePrice},
+		{"diversity", weights.Diversity, scoreDiversity},
+	}
+	var scorers []scorer
+	for _, s := range all {
+		if s.weight > 0 {
+			scorers = append(scorers, s)
+		}
+	}
+	return scorers
+}
+
+// scoreTimeSinceBoot favors nodes that were booted longer ago
+func scoreTimeSinceBoot(node nodeInfo, s *selection) float64 {
+	return min(float64(node.sinceBoot)/float64(bootHorizon), 1)
+}
+
+// scoreCapacity favors nodes with more free HDD capacity left once the zdb is
+// deployed
+func scoreCapacity(node nodeInfo, s *selection) float64 {
+	size := uint64(s.sizeGB) * 1024 * 1024 * 1024
+	if node.totalHRU == 0 || node.freeHRU <= size {
+		return 0
+	}
+	return float64(node.freeHRU-size) / float64(node.totalHRU)
+}
+
+// scorePrice favors cheaper nodes, relative to the other candidates
+func scorePrice(node nodeInfo, s *selection) float64 {
+	if s.maxPrice <= s.minPrice {
+		return 1
+	}
+	return (s.maxPrice - node.price) / (s.maxPrice - s.minPrice)
+}
+
+// scoreDiversity favors nodes that share no farm, country or location with
+// the zdbs of the same type placed so far
+func scoreDiversity(node nodeInfo, s *selection) float64 {
+	var farm, country, location int
+	for _, placed := range s.placed {
+		if placed.farmID == node.farmID {
+			farm++
+		}
+		if node.country != "" && placed.country == node.country {
+			country++
+		}
+		if placed.location == node.location {
+			location++
+		}
+	}
+	return (1/float64(1+farm) + 1/float64(1+country) + 1/float64(1+location)) / 3
+}
+
+// selection picks nodes one at a time, each time taking the best scoring
+// candidate that stays within the anti-affinity caps. Of candidates with the
+// same score, the first one wins, so callers shuffle the candidates to break
+// ties at random. Each pick is explained on out.
+type selection struct {
+	out        io.Writer
+	cfg        *config.Config
+	nodeType   string
+	scorers    []scorer
+	sizeGB     int
+	candidates []nodeInfo
+	placed     []nodeInfo
+	minPrice   float64
+	maxPrice   float64
+}
+
+func newSelection(cfg *config.Config, nodeType string, sizeGB int, candidates, placed []nodeInfo) *selection {
+	s := &selection{
+		out:        os.Stdout,
+		cfg:        cfg,
+		nodeType:   nodeType,
+		scorers:    newScorers(cfg.NodeScoring),
+		sizeGB:     sizeGB,
+		candidates: candidates,
+		placed:     placed,
+	}
+	for i, node := range candidates {
+		if i == 0 || node.price < s.minPrice {
+			s.minPrice = node.price
+		}
+		if i == 0 || node.price > s.maxPrice {
+			s.maxPrice = node.price
+		}
+	}
+	return s
+}
+
+// capped returns why a node would exceed an anti-affinity cap, or an empty
+// string if it wouldn't
+func (s *selection) capped(node nodeInfo) string {
+	var farm, country int
+	for _, placed := range s.placed {
+		if placed.farmID == node.farmID {
+			farm++
+		}
+		if placed.country == node.country {
+			country++
+		}
+	}
+	if s.cfg.MaxShardsPerFarm > 0 && farm >= s.cfg.MaxShardsPerFarm {
+		return fmt.Sprintf("farm %d already holds %d %s ZDBs (max_shards_per_farm)", node.farmID, farm, s.nodeType)
+	}
+	if s.cfg.MaxShardsPerCountry > 0 && node.country != "" && country >= s.cfg.MaxShardsPerCountry {
+		return fmt.Sprintf("country %s already holds %d %s ZDBs (max_shards_per_country)", node.country, country, s.nodeType)
+	}
+	return ""
+}
+
+// score returns the weighted score of a node and how it was arrived at
+func (s *selection) score(node nodeInfo) (float64, string) {
+	var total float64
+	var parts []string
+	for _, sc := range s.scorers {
+		value := sc.score(node, s)
+		total += sc.weight * value
+		parts = append(parts, fmt.Sprintf("%s %.2f", sc.name, value))
+	}
+	return total, strings.Join(parts, ", ")
+}
+
+// prefer counts a preferred node as placed unless it would exceed an
+// anti-affinity cap, and explains either way
+func (s *selection) prefer(node nodeInfo) bool {
+	if reason := s.capped(node); reason != "" {
+		fmt.Fprintf(s.out, "Skipping preferred node %d for a %s ZDB, %s\n", node.id, s.nodeType, reason)
+		return false
+	}
+	other := "meta"
+	if s.nodeType == "meta" {
+		other = "data"
+	}
+	s.placed = append(s.placed, node)
+	fmt.Fprintf(s.out, "Selected node %d for a %s ZDB (farm %d, %s): preferred, it holds a %s ZDB\n",
+		node.id, s.nodeType, node.farmID, node.place, other)
+	return true
+}
+
+// next picks the best scoring candidate within the caps, removes it from the
+// candidates and counts it as placed. It reports false when no candidate is
+// left within the caps.
+func (s *selection) next() (nodeInfo, bool) {
+	best := -1
+	var bestScore float64
+	var bestExplanation string
+	skipped := make(map[string]int)
+	for i, node := range s.candidates {
+		if reason := s.capped(node); reason != "" {
+			skipped[reason]++
+			continue
+		}
+		score, explanation := s.score(node)
+		if best < 0 || score > bestScore {
+			best, bestScore, bestExplanation = i, score, explanation
+		}
+	}
+	for reason, count := range skipped {
+		fmt.Fprintf(s.out, "Skipping %d candidate nodes for the next %s ZDB, %s\n", count, s.nodeType, reason)
+	}
+	if best < 0 {
+		return nodeInfo{}, false
+	}
+
+	node := s.candidates[best]
+	s.candidates = append(s.candidates[:best], s.candidates[best+1:]...)
+	s.placed = append(s.placed, node)
+	fmt.Fprintf(s.out, "Selected node %d for a %s ZDB (farm %d, %s): score %.2f from %s\n",
+		node.id, s.nodeType, node.farmID, node.place, bestScore, bestExplanation)
+	return node, true
+}
@@ -0,0 +1,153 @@
+package grid
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/config"
+)
+
+func TestScoreTimeSinceBoot(t *testing.T) {
+	tests := []struct {
+		sinceBoot time.Duration
+		want      float64
+	}{
+		{0, 0},
+		{15 * 24 * time.Hour, 0.5},
+		{bootHorizon, 1},
+		{90 * 24 * time.Hour, 1},
+	}
+	for _, tt := range tests {
+		if got := scoreTimeSinceBoot(nodeInfo{sinceBoot: tt.sinceBoot}, nil); got != tt.want {
+			t.Errorf("%s since boot scores %.2f, want %.2f", tt.sinceBoot, got, tt.want)
+		}
+	}
+}
+
+func TestSelectionCapped(t *testing.T) {
+	cfg := &config.Config{MaxShardsPerFarm: 2, MaxShardsPerCountry: 3}
+	placed := []nodeInfo{
+		{id: 1, farmID: 10, country: "Belgium"},
+		{id: 2, farmID: 10, country: "Belgium"},
+		{id: 3, farmID: 11, country: "Belgium"},
+		{id: 4, farmID: 12},
+		{id: 5, farmID: 12},
+	}
+
+	tests := []struct {
+		name string
+		node nodeInfo
+		want string
+	}{
+		{"within the caps", nodeInfo{farmID: 13, country: "Egypt"}, ""},
+		{"farm full", nodeInfo{farmID: 10, country: "Egypt"}, "farm 10 already holds 2 data ZDBs (max_shards_per_farm)"},
+		{"country full", nodeInfo{farmID: 13, country: "Belgium"}, "country Belgium already holds 3 data ZDBs (max_shards_per_country)"},
+		{"farm checked first", nodeInfo{farmID: 10, country: "Belgium"}, "farm 10 already holds 2 data ZDBs (max_shards_per_farm)"},
+		{"unknown country isn't capped", nodeInfo{farmID: 13}, ""},
+	}
+	s := newSelection(cfg, "data", 10, nil, placed)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.capped(tt.node); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectionNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        *config.Config
+		candidates []nodeInfo
+		placed     []nodeInfo
+		want       []uint32
+		output     string
+	}{
+		{
+			name:       "equal scores keep candidate order",
+			cfg:        &config.Config{NodeScoring: config.NodeScoring{Price: 1}},
+			candidates: []nodeInfo{{id: 7, farmID: 1, place: "Ghent, Belgium"}, {id: 3, farmID: 1, place: "Ghent, Belgium"}},
+			want:       []uint32{7, 3},
+			output: "Selected node 7 for a data ZDB (farm 1, Ghent, Belgium): score 1.00 from price 1.00\n" +
+				"Selected node 3 for a data ZDB (farm 1, Ghent, Belgium): score 1.00 from price 1.00\n",
+		},
+		{
+			name: "weighted scores",
+			cfg:  &config.Config{NodeScoring: config.NodeScoring{TimeSinceBoot: 1, Price: 2}},
+			candidates: []nodeInfo{
+				{id: 1, farmID: 1, place: "Ghent, Belgium", sinceBoot: bootHorizon, price: 2},
+				{id: 2, farmID: 2, place: "Cairo, Egypt", sinceBoot: 15 * 24 * time.Hour, price: 1},
+			},
+			want: []uint32{2},
+			output: "Selected node 2 for a data ZDB (farm 2, Cairo, Egypt): score 2.50 from time since boot 0.50, price 1.00\n" +
+				"Selected node 1 for a data ZDB (farm 1, Ghent, Belgium): score 1.00 from time since boot 1.00, price 0.00\n",
+		},
+		{
+			name:       "capped candidates are skipped",
+			cfg:        &config.Config{NodeScoring: config.NodeScoring{Price: 1}, MaxShardsPerFarm: 1},
+			candidates: []nodeInfo{{id: 4, farmID: 1}, {id: 5, farmID: 1}},
+			placed:     []nodeInfo{{id: 1, farmID: 1}},
+			output:     "Skipping 2 candidate nodes for the next data ZDB, farm 1 already holds 1 data ZDBs (max_shards_per_farm)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			s := newSelection(tt.cfg, "data", 10, tt.candidates, tt.placed)
+			s.out = &out
+
+			var got []uint32
+			for {
+				node, ok := s.next()
+				if !ok {
+					break
+				}
+				got = append(got, node.id)
+			}
+			if len(got) < len(tt.want) {
+				t.Fatalf("picked %v, want %v first", got, tt.want)
+			}
+			for i, id := range tt.want {
+				if got[i] != id {
+					t.Errorf("picked %v, want %v first", got, tt.want)
+					break
+				}
+			}
+			if out.String() != tt.output {
+				t.Errorf("got output:\n%s\nwant:\n%s", out.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestSelectionPrefer(t *testing.T) {
+	cfg := &config.Config{MaxShardsPerFarm: 1}
+	placed := []nodeInfo{{id: 1, farmID: 10}}
+	s := newSelection(cfg, "data", 10, nil, placed)
+	var out bytes.Buffer
+	s.out = &out
+
+	preferred := []nodeInfo{
+		{id: 2, farmID: 10, place: "Ghent, Belgium"},
+		{id: 3, farmID: 11, place: "Cairo, Egypt"},
+		{id: 4, farmID: 11, place: "Cairo, Egypt"},
+	}
+	var got []uint32
+	for _, node := range preferred {
+		if s.prefer(node) {
+			got = append(got, node.id)
+		}
+	}
+
+	if len(got) != 1 || got[0] != 3 {
+		t.Errorf("picked %v, want [3]", got)
+	}
+	want := "Skipping preferred node 2 for a data ZDB, farm 10 already holds 1 data ZDBs (max_shards_per_farm)\n" +
+		"Selected node 3 for a data ZDB (farm 11, Cairo, Egypt): preferred, it holds a meta ZDB\n" +
+		"Skipping preferred node 4 for a data ZDB, farm 11 already holds 1 data ZDBs (max_shards_per_farm)\n"
+	if out.String() != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -2,15 +2,21 @@ package hook
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/threefoldtech/quantum-storage/quantumd/internal/util"
 	"github.com/threefoldtech/quantum-storage/quantumd/internal/zstor"
 )
 
@@ -19,19 +25,47 @@ const (
 	SocketPath = "/tmp/zdb-hook.sock"
 )
 
+// Uploader receives the files that zdb reports as ready to be stored in zstor.
+// All files passed in a single call are uploaded together as one batch.
+type Uploader interface {
+	QueueUpload(files []string, isIndex bool)
+}
+
+// Retriever fetches data files that zdb needs back from zstor. Concurrent
+// calls for the same file are expected to share a single download.
+type Retriever interface {
+	Retrieve(filePath string) error
+}
+
 // Handler manages hook dispatching
 type Handler struct {
 	ZstorIndex string
 	ZstorData  string
-	Zstor      *zstor.Client
+	Zstor      zstor.Client
+	Uploader   Uploader
+	Retriever  Retriever
+	// Namespaces decides which namespaces are uploaded to zstor
+	Namespaces util.NamespacePolicy
+	// Timeout bounds how long a blocking missing-data hook waits for its
+	// retrieval. The retrieval itself keeps going for other waiters.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	conns    sync.WaitGroup
 }
 
 // NewHandler creates a new hook handler
-func NewHandler(zdbRootPath string, zstorClient *zstor.Client) (*Handler, error) {
+func NewHandler(zdbRootPath string, namespaces util.NamespacePolicy, zstorClient zstor.Client, uploader Uploader, retriever Retriever, timeout time.Duration) (*Handler, error) {
 	h := &Handler{
 		ZstorIndex: filepath.Join(zdbRootPath, "index"),
 		ZstorData:  filepath.Join(zdbRootPath, "data"),
 		Zstor:      zstorClient,
+		Uploader:   uploader,
+		Retriever:  retriever,
+		Namespaces: namespaces,
+		Timeout:    timeout,
 	}
 	return h, nil
 }
@@ -49,119 +83,207 @@ func (h *Handler) ListenAndServe() {
 	}
 	defer listener.Close()
 
+	if !h.setListener(listener) {
+		return
+	}
+
 	log.Printf("Daemon listening for hooks on %s", SocketPath)
 
+	// Events raised while the daemon was down go first. Hooks connecting in
+	// the meantime wait in the listen backlog.
+	if err := h.ReplaySpool(); err != nil {
+		log.Printf("Failed to replay spooled hook events: %v", err)
+	}
+
+	h.serve(listener)
+}
+
+// Serve serves hook requests on a listener until the handler is closed,
+// without replaying the spool
+func (h *Handler) Serve(listener net.Listener) {
+	defer listener.Close()
+	if !h.setListener(listener) {
+		return
+	}
+	h.serve(listener)
+}
+
+// setListener records the listener for Close, and reports false if the
+// handler was closed already
+func (h *Handler) setListener(listener net.Listener) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.listener = listener
+	return true
+}
+
+func (h *Handler) serve(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("Hook listener closed")
+				return
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
 		// Handle each connection in a new goroutine to allow concurrent hooks
-		go h.handleConnection(conn)
+		h.conns.Add(1)
+		go func() {
+			defer h.conns.Done()
+			h.handleConnection(conn)
+		}()
 	}
 }
 
+// Close stops accepting hook connections. Hooks that are already being
+// handled are not interrupted, use Wait to wait for them.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if h.listener == nil {
+		return nil
+	}
+	// Closing a unix listener also removes the socket file
+	return h.listener.Close()
+}
+
+// Wait blocks until all accepted hook connections have been handled
+func (h *Handler) Wait() {
+	h.conns.Wait()
+}
+
 func (h *Handler) handleConnection(conn net.Conn) {
 	defer conn.Close()
+	start := time.Now()
 
 	scanner := bufio.NewScanner(conn)
 	if scanner.Scan() {
 		line := scanner.Text()
 		log.Printf("Received hook message: %s", line)
 
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
+		event, err := ParseEvent(line)
+		if err != nil {
+			log.Printf("Received malformed hook message: %v", err)
+			writeReply(conn, Event{Version: ProtocolVersion}, StatusError, CodeBadRequest, err, start)
+			return
+		}
+		if event.Action == "" {
 			log.Println("Received empty hook message, ignoring.")
-			fmt.Fprintf(conn, "ERROR: empty hook message\n")
+			writeReply(conn, event, StatusError, CodeBadRequest, errors.New("empty hook message"), start)
+			return
+		}
+		if event.Version > ProtocolVersion {
+			writeReply(conn, event, StatusError, CodeUnsupportedVersion,
+				fmt.Errorf("protocol version %d is not supported, expected at most %d", event.Version, ProtocolVersion), start)
 			return
 		}
 
-		action := parts[0]
-		args := parts[1:]
-
-		// Check if this is a blocking hook
-		isBlocking := action == "missing-data" || action == "ready"
+		// Reject bad arguments right away, even for hooks handled in the
+		// background
+		if err := event.validate(); err != nil {
+			writeReply(conn, event, StatusError, errorCode(err), err, start)
+			return
+		}
 
-		if isBlocking {
+		if IsBlocking(event.Action) {
 			// Handle blocking hooks synchronously
-			err := h.dispatchHook(action, args)
-			if err != nil {
-				log.Printf("Error handling blocking hook action '%s': %v", action, err)
-				fmt.Fprintf(conn, "ERROR: %v\n", err)
+			if err := h.dispatchHook(event); err != nil {
+				log.Printf("Error handling blocking hook %s: %v", event, err)
+				writeReply(conn, event, StatusError, errorCode(err), err, start)
 			} else {
-				fmt.Fprintf(conn, "SUCCESS: %s completed\n", action)
+				writeReply(conn, event, StatusOK, "", nil, start)
 			}
 		} else {
 			// Handle non-blocking hooks asynchronously
 			go func() {
-				if err := h.dispatchHook(action, args); err != nil {
-					log.Printf("Error handling hook action '%s': %v", action, err)
+				if err := h.dispatchHook(event); err != nil {
+					log.Printf("Error handling hook %s: %v", event, err)
 				}
 			}()
 			// For non-blocking hooks, we can respond immediately.
-			fmt.Fprintf(conn, "SUCCESS: %s queued\n", action)
+			writeReply(conn, event, StatusQueued, "", nil, start)
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Printf("Error reading from hook connection: %v", err)
-		fmt.Fprintf(conn, "ERROR: %v\n", err)
+		writeReply(conn, Event{}, StatusError, CodeBadRequest, err, start)
 	}
 }
 
-func (h *Handler) dispatchHook(action string, args []string) error {
-	log.Printf("Dispatching action: %s with args: %v", action, args)
+// writeReply answers a hook in the protocol the client used
+func writeReply(conn net.Conn, event Event, status, code string, err error, start time.Time) {
+	if event.Version == 0 {
+		switch status {
+		case StatusError:
+			fmt.Fprintf(conn, "ERROR: %v\n", err)
+		case StatusQueued:
+			fmt.Fprintf(conn, "SUCCESS: %s queued\n", event.Action)
+		default:
+			fmt.Fprintf(conn, "SUCCESS: %s completed\n", event.Action)
+		}
+		return
+	}
+
+	reply := Reply{
+		Version:    ProtocolVersion,
+		ID:         event.ID,
+		Status:     status,
+		Code:       code,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		log.Printf("Failed to send hook reply: %v", err)
+	}
+}
 
-	switch action {
+func (h *Handler) dispatchHook(event Event) error {
+	log.Printf("Dispatching hook %s", event)
+	if err := event.validate(); err != nil {
+		return err
+	}
+
+	args := event.Args
+	switch event.Action {
 	case "close":
 		return h.handleClose()
 	case "ready":
 		return h.handleReady()
 	case "namespace-created", "namespace-updated":
-		if len(args) < 2 {
-			return fmt.Errorf("not enough arguments for %s", action)
-		}
-		return h.handleNamespaceUpdate(args[1]) // arg[0] is instance, arg[1] is namespace
+		return h.handleNamespaceUpdate(args.Namespace)
 	case "jump-index":
-		if len(args) < 2 {
-			return fmt.Errorf("not enough arguments for %s", action)
-		}
-		var dirtyList []string
-		if len(args) >= 4 {
-			dirtyList = args[3:]
-		}
-		return h.handleJumpIndex(args[1], dirtyList)
+		return h.handleJumpIndex(args.Path, args.Dirty)
 	case "jump-data":
-		if len(args) < 2 {
-			return fmt.Errorf("not enough arguments for %s", action)
-		}
-		return h.handleJumpData(args[1]) // arg[0] is instance, arg[1] is data-file-path
+		return h.handleJumpData(args.Path)
 	case "missing-data":
-		if len(args) < 2 {
-			return fmt.Errorf("not enough arguments for %s", action)
-		}
-		return h.handleMissingData(args[1])
+		return h.handleMissingData(args.Path)
 	default:
-		log.Printf("Ignoring unknown hook action: %s", action)
+		log.Printf("Ignoring unknown hook action: %s", event.Action)
 		return nil
 	}
 }
 
-// uploadAndTrack handles uploading a file.
+// uploadAndTrack hands a single file to the daemon's upload queue.
 func (h *Handler) uploadAndTrack(filePath string, isIndex bool) {
-	// NOTE: In the new implementation, the actual upload is handled by the daemon.
-	// This function just logs the intent to upload.
-
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
 		return
 	}
 
 	log.Printf("Queuing upload for: %s (isIndex: %t)", filePath, isIndex)
-	
-	// In the new implementation, the daemon will handle the actual upload
-	// We're just logging the intent here
+	h.Uploader.QueueUpload([]string{filePath}, isIndex)
 }
 
 func (h *Handler) handleClose() error {
@@ -172,7 +294,7 @@ func (h *Handler) handleClose() error {
 
 	for _, ns := range namespaces {
 		nsName := ns.Name()
-		if !ns.IsDir() || nsName == "zdbfs-temp" {
+		if !ns.IsDir() || !h.Namespaces.Allows(nsName) {
 			continue
 		}
 
@@ -189,8 +311,8 @@ func (h *Handler) handleClose() error {
 		dataFile := filepath.Join(dataDir, fmt.Sprintf("d%d", lastActive))
 		indexFile := filepath.Join(indexDir, fmt.Sprintf("i%d", lastActive))
 
-		go h.uploadAndTrack(dataFile, false)
-		go h.uploadAndTrack(indexFile, true)
+		h.uploadAndTrack(dataFile, false)
+		h.uploadAndTrack(indexFile, true)
 	}
 	return nil
 }
@@ -200,19 +322,19 @@ func (h *Handler) handleReady() error {
 }
 
 func (h *Handler) handleNamespaceUpdate(namespace string) error {
-	if namespace == "zdbfs-temp" {
-		log.Println("Skipping temporary namespace zdbfs-temp")
+	if !h.Namespaces.Allows(namespace) {
+		log.Printf("Skipping namespace %s, which isn't offloaded", namespace)
 		return nil
 	}
 	file := filepath.Join(h.ZstorIndex, namespace, "zdb-namespace")
-	go h.uploadAndTrack(file, true)
+	h.uploadAndTrack(file, true)
 	return nil
 }
 
 func (h *Handler) handleJumpIndex(indexPath string, dirtyIndices []string) error {
-	namespace := filepath.Base(filepath.Dir(indexPath))
-	if namespace == "zdbfs-temp" {
-		log.Println("Skipping temporary namespace zdbfs-temp")
+	namespace := util.NamespaceOf(indexPath)
+	if !h.Namespaces.Allows(namespace) {
+		log.Printf("Skipping namespace %s, which isn't offloaded", namespace)
 		return nil
 	}
 
@@ -229,30 +351,48 @@ func (h *Handler) handleJumpIndex(indexPath string, dirtyIndices []string) error
 	// Add the current index file if it's not already in the dirty list
 	filesToUpload[indexPath] = struct{}{}
 
-	// Convert map keys to a slice
+	// Convert map keys to a slice, skipping files that are already gone
 	uploadList := make([]string, 0, len(filesToUpload))
 	for file := range filesToUpload {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
 		uploadList = append(uploadList, file)
 	}
+	if len(uploadList) == 0 {
+		return nil
+	}
+	sort.Strings(uploadList)
 
-	// In the new implementation, the daemon will handle the actual upload
+	// The whole list is stored with a single StoreBatch call
 	log.Printf("Queuing batch upload for namespace %s with %d files", namespace, len(uploadList))
+	h.Uploader.QueueUpload(uploadList, true)
 
 	return nil
 }
 
 func (h *Handler) handleJumpData(dataPath string) error {
-	namespace := filepath.Base(filepath.Dir(dataPath))
-	if namespace == "zdbfs-temp" {
-		log.Println("Skipping temporary namespace zdbfs-temp")
+	namespace := util.NamespaceOf(dataPath)
+	if !h.Namespaces.Allows(namespace) {
+		log.Printf("Skipping namespace %s, which isn't offloaded", namespace)
 		return nil
 	}
-	go h.uploadAndTrack(dataPath, false)
+	h.uploadAndTrack(dataPath, false)
 	return nil
 }
 
 func (h *Handler) handleMissingData(dataPath string) error {
-	return h.Zstor.Retrieve(dataPath)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Retriever.Retrieve(dataPath)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(h.Timeout):
+		return fmt.Errorf("%w after %s waiting for retrieval of %s", errTimeout, h.Timeout, dataPath)
+	}
 }
 
 func findLastActiveFile(dir string) (int, error) {
@@ -302,4 +442,4 @@ func SetupSymlink() error {
 
 	log.Printf("Creating symlink from %s to %s", src, dest)
 	return os.Symlink(src, dest)
-}
\ No newline at end of file
+}
@@ -0,0 +1,191 @@
+package hook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the version of the JSON lines hook protocol. Clients
+// send one Event per line and get one Reply per line back. Lines that don't
+// start with '{' are handled as the original protocol, where the hook
+// arguments are sent space separated and the reply is a SUCCESS: or ERROR:
+// line.
+const ProtocolVersion = 1
+
+// Reply statuses
+const (
+	// StatusOK means a blocking hook completed
+	StatusOK = "ok"
+	// StatusQueued means a non-blocking hook was accepted and is being handled
+	StatusQueued = "queued"
+	// StatusError means the hook failed, see Code and Error
+	StatusError = "error"
+)
+
+// Error codes carried in replies
+const (
+	CodeBadRequest         = "bad_request"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeInvalidArgs        = "invalid_args"
+	CodeTimeout            = "timeout"
+	CodeFailed             = "failed"
+)
+
+var (
+	errInvalidArgs = errors.New("invalid arguments")
+	errTimeout     = errors.New("timed out")
+)
+
+// Event is a hook event raised by zdb
+type Event struct {
+	Version int       `json:"version"`
+	ID      string    `json:"id"`
+	Action  string    `json:"action"`
+	Args    EventArgs `json:"args"`
+	Time    time.Time `json:"time"`
+}
+
+// EventArgs are the typed arguments of a hook event. Which of them are set
+// depends on the action.
+type EventArgs struct {
+	// Instance is the id of the zdb instance that raised the event
+	Instance string `json:"instance,omitempty"`
+	// Namespace is set for namespace-created and namespace-updated
+	Namespace string `json:"namespace,omitempty"`
+	// Path is the data or index file the event is about
+	Path string `json:"path,omitempty"`
+	// NewPath is the index file zdb moved on to, for jump-index
+	NewPath string `json:"new_path,omitempty"`
+	// Dirty lists the numbers of index files changed since they were last
+	// stored, for jump-index
+	Dirty []string `json:"dirty,omitempty"`
+}
+
+// Reply is the daemon's answer to an event
+type Reply struct {
+	Version    int    `json:"version"`
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	Code       string `json:"code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// NewEvent builds an event from the arguments zdb passes to the hook: the
+// action, the instance id and then the action specific arguments
+func NewEvent(args []string) Event {
+	event := Event{
+		Version: ProtocolVersion,
+		ID:      newEventID(),
+		Time:    time.Now().UTC(),
+	}
+	if len(args) == 0 {
+		return event
+	}
+	event.Action = args[0]
+	if len(args) > 1 {
+		event.Args.Instance = args[1]
+	}
+
+	switch event.Action {
+	case "namespace-created", "namespace-updated":
+		if len(args) > 2 {
+			event.Args.Namespace = args[2]
+		}
+	case "jump-index":
+		if len(args) > 2 {
+			event.Args.Path = args[2]
+		}
+		if len(args) > 3 {
+			event.Args.NewPath = args[3]
+		}
+		// zdb passes the dirty list as one space separated argument
+		for _, arg := range args[min(len(args), 4):] {
+			event.Args.Dirty = append(event.Args.Dirty, strings.Fields(arg)...)
+		}
+	case "jump-data", "missing-data":
+		if len(args) > 2 {
+			event.Args.Path = args[2]
+		}
+	}
+	return event
+}
+
+// ParseEvent reads an event from a line in either protocol
+func ParseEvent(line string) (Event, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		event := NewEvent(strings.Fields(line))
+		// Plain text clients don't know about versions or ids
+		event.Version = 0
+		event.ID = ""
+		return event, nil
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+// validate checks that an event carries the arguments its action needs
+func (e Event) validate() error {
+	switch e.Action {
+	case "namespace-created", "namespace-updated":
+		if e.Args.Namespace == "" {
+			return fmt.Errorf("%w: %s needs a namespace", errInvalidArgs, e.Action)
+		}
+	case "jump-index":
+		if e.Args.Path == "" {
+			return fmt.Errorf("%w: %s needs an index path", errInvalidArgs, e.Action)
+		}
+	case "jump-data", "missing-data":
+		if e.Args.Path == "" {
+			return fmt.Errorf("%w: %s needs a data path", errInvalidArgs, e.Action)
+		}
+	}
+	return nil
+}
+
+// String formats an event for logging
+func (e Event) String() string {
+	var b strings.Builder
+	b.WriteString(e.Action)
+	if e.ID != "" {
+		fmt.Fprintf(&b, " [%s]", e.ID)
+	}
+	if e.Args.Namespace != "" {
+		fmt.Fprintf(&b, " namespace=%s", e.Args.Namespace)
+	}
+	if e.Args.Path != "" {
+		fmt.Fprintf(&b, " path=%s", e.Args.Path)
+	}
+	if len(e.Args.Dirty) > 0 {
+		fmt.Fprintf(&b, " dirty=%s", strings.Join(e.Args.Dirty, ","))
+	}
+	return b.String()
+}
+
+// errorCode maps a hook error to the code sent in the reply
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errInvalidArgs):
+		return CodeInvalidArgs
+	case errors.Is(err, errTimeout):
+		return CodeTimeout
+	default:
+		return CodeFailed
+	}
+}
+
+func newEventID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,216 @@
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// SpoolPath is where hook events are kept while the daemon can't be
+	// reached. It's outside of /tmp so spooled events survive a reboot.
+	SpoolPath = "/var/lib/quantumd/hook.spool"
+
+	// replayPath holds events taken from the spool for replay. It's only
+	// removed once they have all been handed to the daemon, so a crash during
+	// replay doesn't lose them.
+	replayPath = SpoolPath + ".replay"
+	lockPath   = SpoolPath + ".lock"
+)
+
+// IsBlocking reports whether zdb waits for the result of a hook action.
+// Blocking hooks can't be spooled, since zdb needs their answer right away.
+func IsBlocking(action string) bool {
+	return action == "missing-data" || action == "ready"
+}
+
+// withSpoolLock runs fn while holding an exclusive lock on the spool. The
+// lock is shared between the hook processes started by zdb and the daemon.
+func withSpoolLock(fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(SpoolPath), 0755); err != nil {
+		return fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool lock: %w", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock spool: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// DialOrSpool connects to the daemon's hook socket. When the daemon can't be
+// reached, the event is appended to the spool instead and a nil connection is
+// returned. The socket is dialed while holding the spool lock, and the daemon
+// only takes the spool once it's listening, so an event is never spooled
+// after the daemon has already replayed the spool.
+func DialOrSpool(socketPath string, event Event) (net.Conn, error) {
+	var conn net.Conn
+	err := withSpoolLock(func() error {
+		var dialErr error
+		conn, dialErr = net.Dial("unix", socketPath)
+		if dialErr == nil {
+			return nil
+		}
+
+		line, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+
+		f, err := os.OpenFile(SpoolPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open spool: %w", err)
+		}
+		defer f.Close()
+
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write to spool: %w", err)
+		}
+		return f.Sync()
+	})
+	return conn, err
+}
+
+// takeSpool moves the spooled events to the replay file and returns all
+// events waiting for replay, including any left over from an interrupted
+// replay
+func takeSpool() ([]byte, error) {
+	var data []byte
+	err := withSpoolLock(func() error {
+		spooled, err := os.ReadFile(SpoolPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read spool: %w", err)
+		}
+		if len(spooled) > 0 {
+			f, err := os.OpenFile(replayPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				return fmt.Errorf("failed to open replay file: %w", err)
+			}
+			_, err = f.Write(spooled)
+			if err == nil {
+				err = f.Sync()
+			}
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to write replay file: %w", err)
+			}
+		}
+		if err := os.Remove(SpoolPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear spool: %w", err)
+		}
+
+		data, err = os.ReadFile(replayPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read replay file: %w", err)
+		}
+		return nil
+	})
+	return data, err
+}
+
+// parseSpool reads spooled events in order. Spooled events are JSON lines,
+// but plain text lines from older hook clients are read as well. Events for
+// the same file are collapsed into the first one, since the upload they
+// trigger picks up the file as it is by then anyway. The dirty index lists of
+// collapsed jump-index events are merged.
+func parseSpool(r io.Reader) ([]*Event, int, error) {
+	var events []*Event
+	byKey := make(map[string]*Event)
+	collapsed := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		event, err := ParseEvent(line)
+		if err != nil {
+			log.Printf("Skipping malformed spooled hook event: %v", err)
+			continue
+		}
+
+		key := line
+		switch {
+		case event.Action == "close":
+			key = event.Action
+		case event.Args.Path != "":
+			key = event.Action + " " + event.Args.Path
+		case event.Args.Namespace != "":
+			key = event.Action + " " + event.Args.Namespace
+		}
+
+		first, exists := byKey[key]
+		if !exists {
+			byKey[key] = &event
+			events = append(events, &event)
+			continue
+		}
+		collapsed++
+		first.Args.Dirty = mergeDirtyIndices(first.Args.Dirty, event.Args.Dirty)
+	}
+	return events, collapsed, scanner.Err()
+}
+
+// mergeDirtyIndices adds the dirty indices of a collapsed jump-index event to
+// those of the earlier one
+func mergeDirtyIndices(first, other []string) []string {
+	seen := make(map[string]bool)
+	for _, dirty := range first {
+		seen[dirty] = true
+	}
+	for _, dirty := range other {
+		if !seen[dirty] {
+			seen[dirty] = true
+			first = append(first, dirty)
+		}
+	}
+	return first
+}
+
+// ReplaySpool dispatches the events that were spooled while the daemon was
+// unreachable, in the order they were raised. It's called once the hook
+// socket is listening, before live hooks are accepted.
+func (h *Handler) ReplaySpool() error {
+	data, err := takeSpool()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	events, collapsed, err := parseSpool(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse spool: %w", err)
+	}
+	log.Printf("Replaying %d spooled hook events (%d duplicates collapsed)", len(events), collapsed)
+
+	for _, event := range events {
+		if IsBlocking(event.Action) {
+			continue
+		}
+		if err := h.dispatchHook(*event); err != nil {
+			log.Printf("Error replaying hook %s: %v", event, err)
+		}
+	}
+
+	if err := os.Remove(replayPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove replay file: %w", err)
+	}
+	return nil
+}
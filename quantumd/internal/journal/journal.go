@@ -0,0 +1,623 @@
+package journal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// State is the upload state of a zdb file
+type State string
+
+const (
+	// StatePending means the file is known but has not been uploaded yet
+	StatePending State = "pending"
+	// StateUploading means an upload was started and has not finished
+	StateUploading State = "uploading"
+	// StateUploaded means the file is stored in zstor
+	StateUploaded State = "uploaded"
+	// StateAwaitingData means an index file is stored in zstor, but the data
+	// file it points into isn't yet. It only counts as uploaded once the data
+	// file is.
+	StateAwaitingData State = "awaiting_data"
+	// StateFailed means the last upload attempt failed and another attempt
+	// is scheduled
+	StateFailed State = "failed"
+	// StateVerifyFailed means the upload went through but what zstor stored
+	// didn't match the local file, and another attempt is scheduled
+	StateVerifyFailed State = "verify_failed"
+	// StateDead means the file failed too many times and is quarantined
+	// until an operator re-arms it
+	StateDead State = "dead"
+)
+
+// Entry is the journal record for a single zdb file
+type Entry struct {
+	Path           string
+	State          State
+	Attempts       int
+	LastError      string
+	LocalChecksum  []byte
+	RemoteChecksum []byte
+	NextAttemptAt  time.Time
+	// Evicted means the file was removed from the local cache after it was
+	// uploaded, and is only retrieved again when zdb asks for it
+	Evicted   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// migrations are applied in order and tracked with PRAGMA user_version, so
+// new statements must only ever be appended
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS uploads (
+		path            TEXT PRIMARY KEY,
+		state           TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		last_error      TEXT NOT NULL DEFAULT '',
+		local_checksum  BLOB,
+		remote_checksum BLOB,
+		created_at      INTEGER NOT NULL,
+		updated_at      INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS uploads_state ON uploads (state)`,
+	`ALTER TABLE uploads ADD COLUMN next_attempt_at INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS scrubs (
+		path           TEXT PRIMARY KEY,
+		result         TEXT NOT NULL,
+		error          TEXT NOT NULL DEFAULT '',
+		healthy_shards INTEGER NOT NULL DEFAULT 0,
+		damaged_shards INTEGER NOT NULL DEFAULT 0,
+		scrubbed_at    INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS repairs (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		path            TEXT NOT NULL,
+		action          TEXT NOT NULL,
+		result          TEXT NOT NULL,
+		error           TEXT NOT NULL DEFAULT '',
+		healthy_shards  INTEGER NOT NULL DEFAULT 0,
+		expected_shards INTEGER NOT NULL DEFAULT 0,
+		repaired_at     INTEGER NOT NULL
+	)`,
+	`ALTER TABLE uploads ADD COLUMN evicted INTEGER NOT NULL DEFAULT 0`,
+}
+
+// ScrubResult is the outcome of scrubbing a stored file
+type ScrubResult string
+
+const (
+	// ScrubOK means the file was retrieved intact from all of its shards
+	ScrubOK ScrubResult = "ok"
+	// ScrubRepaired means the file was damaged, and was rebuilt or stored
+	// again from the local copy
+	ScrubRepaired ScrubResult = "repaired"
+	// ScrubQueued means the file was damaged, and an upload from the local
+	// copy was queued but hasn't been confirmed yet
+	ScrubQueued ScrubResult = "queued"
+	// ScrubFailed means the file was damaged and couldn't be repaired
+	ScrubFailed ScrubResult = "failed"
+)
+
+// ScrubEntry is the result of the last scrub of a stored file
+type ScrubEntry struct {
+	Path          string
+	Result        ScrubResult
+	Error         string
+	HealthyShards int
+	DamagedShards int
+	ScrubbedAt    time.Time
+}
+
+// RepairAction is how a file with shards on dead backends is repaired
+type RepairAction string
+
+const (
+	// RepairRebuild has zstor rebuild the file from its remaining shards
+	RepairRebuild RepairAction = "rebuild"
+	// RepairStore stores the file again from the local copy, for files
+	// with too few shards left to rebuild
+	RepairStore RepairAction = "store"
+)
+
+// RepairResult is the outcome of a repair
+type RepairResult string
+
+const (
+	// RepairDone means the repair went through
+	RepairDone RepairResult = "repaired"
+	// RepairFailed means the repair was attempted and failed
+	RepairFailed RepairResult = "failed"
+	// RepairPlanned means the repair would have run, but the daemon is in
+	// dry-run mode
+	RepairPlanned RepairResult = "planned"
+	// RepairQueued means the file was queued to be stored again, and the
+	// upload hasn't been confirmed yet
+	RepairQueued RepairResult = "queued"
+)
+
+// RepairEntry records a single repair of a file
+type RepairEntry struct {
+	Path           string
+	Action         RepairAction
+	Result         RepairResult
+	Error          string
+	HealthyShards  int
+	ExpectedShards int
+	RepairedAt     time.Time
+}
+
+const entryColumns = `path, state, attempts, last_error, local_checksum, remote_checksum, next_attempt_at, evicted, created_at, updated_at`
+
+// Journal is a durable record of the upload state of every eligible zdb
+// file, backed by a SQLite database
+type Journal struct {
+	db *sql.DB
+}
+
+// Open opens the journal at the given path, creating the database and its
+// parent directory if needed
+func Open(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal database %s: %w", path, err)
+	}
+	// SQLite only allows a single writer, so serialize access here rather
+	// than handling busy errors everywhere
+	db.SetMaxOpenConns(1)
+
+	j := &Journal{db: db}
+	if err := j.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Close closes the underlying database
+func (j *Journal) Close() error {
+	return j.db.Close()
+}
+
+func (j *Journal) migrate() error {
+	var version int
+	if err := j.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read journal schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := j.applyMigration(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration and bumps the schema version in one
+// transaction. SQLite rolls back DDL too, so a crash in between can't leave a
+// column added without the version that records it.
+func (j *Journal) applyMigration(i int) error {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start journal migration %d: %w", i+1, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(migrations[i]); err != nil {
+		return fmt.Errorf("failed to apply journal migration %d: %w", i+1, err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+		return fmt.Errorf("failed to update journal schema version: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit journal migration %d: %w", i+1, err)
+	}
+	return nil
+}
+
+// Count returns the number of files in the journal
+func (j *Journal) Count() (int, error) {
+	var count int
+	if err := j.db.QueryRow(`SELECT COUNT(*) FROM uploads`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count journal entries: %w", err)
+	}
+	return count, nil
+}
+
+// CountByState returns the number of files in the given state
+func (j *Journal) CountByState(state State) (int, error) {
+	var count int
+	if err := j.db.QueryRow(`SELECT COUNT(*) FROM uploads WHERE state = ?`, string(state)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count journal entries: %w", err)
+	}
+	return count, nil
+}
+
+// CountsByState returns the number of files in each state
+func (j *Journal) CountsByState() (map[State]int, error) {
+	rows, err := j.db.Query(`SELECT state, COUNT(*) FROM uploads GROUP BY state`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count journal entries: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[State]int)
+	for rows.Next() {
+		var (
+			state string
+			count int
+		)
+		if err := rows.Scan(&state, &count); err != nil {
+			return nil, fmt.Errorf("failed to count journal entries: %w", err)
+		}
+		counts[State(state)] = count
+	}
+	return counts, rows.Err()
+}
+
+// Get returns the entry for a path, or nil if the path is not in the journal
+func (j *Journal) Get(path string) (*Entry, error) {
+	row := j.db.QueryRow(`SELECT `+entryColumns+` FROM uploads WHERE path = ?`, path)
+	entry, err := scanEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal entry for %s: %w", path, err)
+	}
+	return entry, nil
+}
+
+// All returns every entry in the journal keyed by path
+func (j *Journal) All() (map[string]Entry, error) {
+	return j.query(`SELECT ` + entryColumns + ` FROM uploads`)
+}
+
+// ListByState returns all entries in one of the given states
+func (j *Journal) ListByState(states ...State) (map[string]Entry, error) {
+	if len(states) == 0 {
+		return map[string]Entry{}, nil
+	}
+	query := `SELECT ` + entryColumns + ` FROM uploads WHERE state IN (?`
+	args := []any{string(states[0])}
+	for _, state := range states[1:] {
+		query += `, ?`
+		args = append(args, string(state))
+	}
+	query += `)`
+	return j.query(query, args...)
+}
+
+func (j *Journal) query(query string, args ...any) (map[string]Entry, error) {
+	rows, err := j.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query journal: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make(map[string]Entry)
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal entry: %w", err)
+		}
+		entries[entry.Path] = *entry
+	}
+	return entries, rows.Err()
+}
+
+// MarkPending records that a file is waiting to be uploaded, keeping its
+// attempt count and checksums
+func (j *Journal) MarkPending(path string) error {
+	now := time.Now().Unix()
+	_, err := j.db.Exec(`INSERT INTO uploads (path, state, created_at, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at`,
+		path, string(StatePending), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to mark %s as pending: %w", path, err)
+	}
+	return nil
+}
+
+// MarkUploading records the start of an upload attempt
+func (j *Journal) MarkUploading(path string) error {
+	now := time.Now().Unix()
+	_, err := j.db.Exec(`INSERT INTO uploads (path, state, attempts, created_at, updated_at) VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET state = excluded.state, attempts = attempts + 1, updated_at = excluded.updated_at`,
+		path, string(StateUploading), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to mark %s as uploading: %w", path, err)
+	}
+	return nil
+}
+
+// MarkUploaded records a successful upload along with the checksum of the
+// local file and the checksum zstor stored for it
+func (j *Journal) MarkUploaded(path string, localChecksum, remoteChecksum []byte) error {
+	return j.markStored(path, StateUploaded, localChecksum, remoteChecksum)
+}
+
+// MarkAwaitingData records a successful upload of an index file whose data
+// file isn't stored yet
+func (j *Journal) MarkAwaitingData(path string, localChecksum, remoteChecksum []byte) error {
+	return j.markStored(path, StateAwaitingData, localChecksum, remoteChecksum)
+}
+
+func (j *Journal) markStored(path string, state State, localChecksum, remoteChecksum []byte) error {
+	now := time.Now().Unix()
+	_, err := j.db.Exec(`INSERT INTO uploads (path, state, local_checksum, remote_checksum, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET state = excluded.state, attempts = 0, last_error = '', next_attempt_at = 0, evicted = 0,
+			local_checksum = excluded.local_checksum, remote_checksum = excluded.remote_checksum, updated_at = excluded.updated_at`,
+		path, string(state), localChecksum, remoteChecksum, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to mark %s as %s: %w", path, state, err)
+	}
+	return nil
+}
+
+// MarkEvicted records that an uploaded file was removed from the local cache
+func (j *Journal) MarkEvicted(path string) error {
+	return j.setEvicted(path, true)
+}
+
+// ClearEvicted records that an evicted file is back in the local cache
+func (j *Journal) ClearEvicted(path string) error {
+	return j.setEvicted(path, false)
+}
+
+func (j *Journal) setEvicted(path string, evicted bool) error {
+	_, err := j.db.Exec(`UPDATE uploads SET evicted = ?, updated_at = ? WHERE path = ?`, evicted, time.Now().Unix(), path)
+	if err != nil {
+		return fmt.Errorf("failed to update eviction of %s: %w", path, err)
+	}
+	return nil
+}
+
+// CompleteAwaitingData marks an index file that was waiting for its data file
+// as uploaded. It reports whether the file was waiting.
+func (j *Journal) CompleteAwaitingData(path string) (bool, error) {
+	res, err := j.db.Exec(`UPDATE uploads SET state = ?, updated_at = ? WHERE path = ? AND state = ?`,
+		string(StateUploaded), time.Now().Unix(), path, string(StateAwaitingData))
+	if err != nil {
+		return false, fmt.Errorf("failed to mark %s as uploaded: %w", path, err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark %s as uploaded: %w", path, err)
+	}
+	return count > 0, nil
+}
+
+// MarkFailed records a failed upload attempt and when the next attempt is due
+func (j *Journal) MarkFailed(path string, uploadErr error, nextAttempt time.Time) error {
+	return j.markError(path, StateFailed, uploadErr, nextAttempt.Unix())
+}
+
+// MarkVerifyFailed records an upload whose stored checksum or shards didn't
+// pass verification, and when the next attempt is due
+func (j *Journal) MarkVerifyFailed(path string, verifyErr error, nextAttempt time.Time) error {
+	return j.markError(path, StateVerifyFailed, verifyErr, nextAttempt.Unix())
+}
+
+// MarkDead moves a file to the dead-letter state after its last failed attempt
+func (j *Journal) MarkDead(path string, uploadErr error) error {
+	return j.markError(path, StateDead, uploadErr, 0)
+}
+
+func (j *Journal) markError(path string, state State, uploadErr error, nextAttempt int64) error {
+	now := time.Now().Unix()
+	_, err := j.db.Exec(`INSERT INTO uploads (path, state, last_error, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET state = excluded.state, last_error = excluded.last_error,
+			next_attempt_at = excluded.next_attempt_at, updated_at = excluded.updated_at`,
+		path, string(state), uploadErr.Error(), nextAttempt, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to mark %s as %s: %w", path, state, err)
+	}
+	return nil
+}
+
+// Rearm resets dead-letter files to pending with a fresh attempt count. With
+// no paths, every dead-letter file is re-armed. It returns the number of
+// files that were re-armed.
+func (j *Journal) Rearm(paths ...string) (int, error) {
+	now := time.Now().Unix()
+	query := `UPDATE uploads SET state = ?, attempts = 0, next_attempt_at = 0, updated_at = ? WHERE state = ?`
+	args := []any{string(StatePending), now, string(StateDead)}
+	if len(paths) > 0 {
+		query += ` AND path IN (?` + strings.Repeat(`, ?`, len(paths)-1) + `)`
+		for _, path := range paths {
+			args = append(args, path)
+		}
+	}
+
+	res, err := j.db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-arm dead-letter files: %w", err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-arm dead-letter files: %w", err)
+	}
+	return int(count), nil
+}
+
+// SetRemoteChecksum updates the remote checksum of a file, as found in the
+// zstor metadata. A file with a remote checksum that is not yet marked as
+// uploaded is considered uploaded from then on, unless an upload is running,
+// its last upload failed verification or it's an index file still waiting
+// for its data file. Failed and dead files keep their state too, so a copy
+// already in zstor doesn't clear their backoff or quarantine.
+func (j *Journal) SetRemoteChecksum(path string, remoteChecksum []byte) error {
+	return j.setRemoteChecksum(path, StateUploaded, remoteChecksum)
+}
+
+// SetRemoteChecksumAwaitingData updates the remote checksum of an index file
+// whose data file isn't stored in zstor, so it doesn't count as uploaded
+func (j *Journal) SetRemoteChecksumAwaitingData(path string, remoteChecksum []byte) error {
+	return j.setRemoteChecksum(path, StateAwaitingData, remoteChecksum)
+}
+
+func (j *Journal) setRemoteChecksum(path string, state State, remoteChecksum []byte) error {
+	now := time.Now().Unix()
+	_, err := j.db.Exec(`INSERT INTO uploads (path, state, remote_checksum, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET remote_checksum = excluded.remote_checksum, updated_at = excluded.updated_at,
+			state = CASE WHEN state IN (?, ?, ?, ?) OR (state = ? AND excluded.state = ?) THEN state ELSE excluded.state END`,
+		path, string(state), remoteChecksum, now, now, string(StateUploading), string(StateVerifyFailed),
+		string(StateFailed), string(StateDead), string(StateAwaitingData), string(StateUploaded))
+	if err != nil {
+		return fmt.Errorf("failed to set remote checksum for %s: %w", path, err)
+	}
+	return nil
+}
+
+// RecordScrub records the result of scrubbing a file, replacing the result of
+// the previous scrub
+func (j *Journal) RecordScrub(entry ScrubEntry) error {
+	_, err := j.db.Exec(`INSERT INTO scrubs (path, result, error, healthy_shards, damaged_shards, scrubbed_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET result = excluded.result, error = excluded.error, healthy_shards = excluded.healthy_shards,
+			damaged_shards = excluded.damaged_shards, scrubbed_at = excluded.scrubbed_at`,
+		entry.Path, string(entry.Result), entry.Error, entry.HealthyShards, entry.DamagedShards, entry.ScrubbedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record scrub of %s: %w", entry.Path, err)
+	}
+	return nil
+}
+
+// ResolveQueuedScrub replaces the queued result of the last scrub of a file
+// with the outcome of its upload. Files whose last scrub isn't queued are
+// left alone.
+func (j *Journal) ResolveQueuedScrub(path string, result ScrubResult) error {
+	_, err := j.db.Exec(`UPDATE scrubs SET result = ? WHERE path = ? AND result = ?`,
+		string(result), path, string(ScrubQueued))
+	if err != nil {
+		return fmt.Errorf("failed to update scrub of %s: %w", path, err)
+	}
+	return nil
+}
+
+// Scrubs returns the result of the last scrub of every scrubbed file, keyed
+// by path
+func (j *Journal) Scrubs() (map[string]ScrubEntry, error) {
+	rows, err := j.db.Query(`SELECT path, result, error, healthy_shards, damaged_shards, scrubbed_at FROM scrubs`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scrubs: %w", err)
+	}
+	defer rows.Close()
+
+	scrubs := make(map[string]ScrubEntry)
+	for rows.Next() {
+		var (
+			entry      ScrubEntry
+			result     string
+			scrubbedAt int64
+		)
+		if err := rows.Scan(&entry.Path, &result, &entry.Error, &entry.HealthyShards, &entry.DamagedShards, &scrubbedAt); err != nil {
+			return nil, fmt.Errorf("failed to read scrub: %w", err)
+		}
+		entry.Result = ScrubResult(result)
+		entry.ScrubbedAt = time.Unix(scrubbedAt, 0)
+		scrubs[entry.Path] = entry
+	}
+	return scrubs, rows.Err()
+}
+
+// RecordRepair adds a repair to the repair log
+func (j *Journal) RecordRepair(entry RepairEntry) error {
+	_, err := j.db.Exec(`INSERT INTO repairs (path, action, result, error, healthy_shards, expected_shards, repaired_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.Path, string(entry.Action), string(entry.Result), entry.Error, entry.HealthyShards, entry.ExpectedShards, entry.RepairedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record repair of %s: %w", entry.Path, err)
+	}
+	return nil
+}
+
+// ResolveQueuedRepairs replaces the queued result of the repairs of a file
+// with the outcome of its upload
+func (j *Journal) ResolveQueuedRepairs(path string, result RepairResult, repairErr string) (int, error) {
+	res, err := j.db.Exec(`UPDATE repairs SET result = ?, error = ? WHERE path = ? AND result = ?`,
+		string(result), repairErr, path, string(RepairQueued))
+	if err != nil {
+		return 0, fmt.Errorf("failed to update repairs of %s: %w", path, err)
+	}
+	resolved, err := res.RowsAffected()
+	return int(resolved), err
+}
+
+// CountRepairsSince counts the repairs attempted since a point in time,
+// leaving out the ones only planned in dry-run mode
+func (j *Journal) CountRepairsSince(since time.Time) (int, error) {
+	var count int
+	err := j.db.QueryRow(`SELECT COUNT(*) FROM repairs WHERE repaired_at >= ? AND result != ?`,
+		since.Unix(), string(RepairPlanned)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count repairs: %w", err)
+	}
+	return count, nil
+}
+
+// Repairs returns the most recent repairs, newest first. A limit of zero or
+// less returns them all.
+func (j *Journal) Repairs(limit int) ([]RepairEntry, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := j.db.Query(`SELECT path, action, result, error, healthy_shards, expected_shards, repaired_at FROM repairs
+		ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query repairs: %w", err)
+	}
+	defer rows.Close()
+
+	var repairs []RepairEntry
+	for rows.Next() {
+		var (
+			entry          RepairEntry
+			action, result string
+			repairedAt     int64
+		)
+		if err := rows.Scan(&entry.Path, &action, &result, &entry.Error, &entry.HealthyShards, &entry.ExpectedShards, &repairedAt); err != nil {
+			return nil, fmt.Errorf("failed to read repair: %w", err)
+		}
+		entry.Action = RepairAction(action)
+		entry.Result = RepairResult(result)
+		entry.RepairedAt = time.Unix(repairedAt, 0)
+		repairs = append(repairs, entry)
+	}
+	return repairs, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanEntry(row scanner) (*Entry, error) {
+	var (
+		entry         Entry
+		state         string
+		nextAttemptAt int64
+		createdAt     int64
+		updatedAt     int64
+	)
+	err := row.Scan(&entry.Path, &state, &entry.Attempts, &entry.LastError,
+		&entry.LocalChecksum, &entry.RemoteChecksum, &nextAttemptAt, &entry.Evicted, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	entry.State = State(state)
+	if nextAttemptAt > 0 {
+		entry.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+	}
+	entry.CreatedAt = time.Unix(createdAt, 0)
+	entry.UpdatedAt = time.Unix(updatedAt, 0)
+	return &entry, nil
+}
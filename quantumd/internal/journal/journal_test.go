@@ -0,0 +1,82 @@
+package journal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMigrationRollsBack fails a migration after its ALTER TABLE and checks
+// the column is gone with it, so the next start can apply it again
+func TestMigrationRollsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.db")
+	original := migrations
+	t.Cleanup(func() { migrations = original })
+
+	migrations = append(original[:len(original):len(original)],
+		`ALTER TABLE uploads ADD COLUMN probe INTEGER; SELECT * FROM no_such_table`)
+	if j, err := Open(path); err == nil {
+		j.Close()
+		t.Fatal("failing migration was applied")
+	}
+
+	migrations = append(original[:len(original):len(original)],
+		`ALTER TABLE uploads ADD COLUMN probe INTEGER`)
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("migration after a failed attempt: %v", err)
+	}
+	defer j.Close()
+
+	var version int
+	if err := j.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("schema version is %d, want %d", version, len(migrations))
+	}
+}
+
+func TestSetRemoteChecksumKeepsFailedAndDead(t *testing.T) {
+	j, err := Open(filepath.Join(t.TempDir(), "journal.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	local, stale := []byte{1, 2, 3}, []byte{4, 5, 6}
+	uploadErr := errors.New("backend unreachable")
+	for _, path := range []string{"/failed", "/dead"} {
+		if err := j.MarkUploaded(path, local, local); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nextAttempt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := j.MarkFailed("/failed", uploadErr, nextAttempt); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.MarkDead("/dead", uploadErr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry cycle or an operator moves them on, not a metadata sync
+	for _, tt := range []struct {
+		path string
+		want State
+	}{{"/failed", StateFailed}, {"/dead", StateDead}} {
+		if err := j.SetRemoteChecksum(tt.path, stale); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := j.Get(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.State != tt.want {
+			t.Errorf("%s is %s after a metadata sync, want %s", tt.path, entry.State, tt.want)
+		}
+		if tt.want == StateFailed && !entry.NextAttemptAt.Equal(nextAttempt) {
+			t.Errorf("%s next attempt moved to %s, want %s", tt.path, entry.NextAttemptAt, nextAttempt)
+		}
+	}
+}
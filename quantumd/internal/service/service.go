@@ -25,6 +25,7 @@ type ServiceManager interface {
 	DaemonReload() error
 	ServiceExists(name string) (bool, error)
 	ServiceIsRunning(name string) (bool, error)
+	SignalService(name, signal string) error
 }
 
 // ManagedServices is the list of services quantumd manages
@@ -143,6 +144,11 @@ func (s *SystemdManager) ServiceIsRunning(name string) (bool, error) {
 	return false, err
 }
 
+// SignalService sends a signal such as SIGUSR1 to the processes of a service
+func (s *SystemdManager) SignalService(name, signal string) error {
+	return exec.Command("systemctl", "kill", "--signal="+signal, name).Run()
+}
+
 // ZinitManager implements ServiceManager for zinit.
 type ZinitManager struct{}
 
@@ -221,6 +227,11 @@ func (z *ZinitManager) ServiceIsRunning(name string) (bool, error) {
 	return strings.Contains(string(output), "state: Running"), nil
 }
 
+// SignalService sends a signal such as SIGUSR1 to the process of a service
+func (z *ZinitManager) SignalService(name, signal string) error {
+	return exec.Command("zinit", "kill", name, signal).Run()
+}
+
 const (
 	zdbfsVersion = "0.1.11"
 	zdbVersion   = "2.0.8"
@@ -267,11 +278,11 @@ func Setup(cfg *config.Config, metaBackends, dataBackends []workloads.Deployment
 func StartServiceByName(name string) error {
 	sm, err := NewServiceManager()
 	if err != nil {
-		return fmt.Errorf("failed to get service manager: %%w", err)
+		return fmt.Errorf("failed to get service manager: %w", err)
 	}
 	fmt.Printf("Starting %s...\n", name)
 	if err := sm.StartService(name); err != nil {
-		return fmt.Errorf("failed to start service %s: %%w", name, err)
+		return fmt.Errorf("failed to start service %s: %w", name, err)
 	}
 	fmt.Printf("Service %s started.\n", name)
 	return nil
@@ -281,7 +292,7 @@ func StartAllServices() {
 	fmt.Println("Starting all services...")
 	for _, s := range ManagedServices {
 		if err := StartServiceByName(s); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start service %s: %%v\n", s, err)
+			fmt.Fprintf(os.Stderr, "Failed to start service %s: %v\n", s, err)
 		}
 	}
 }
@@ -289,18 +300,18 @@ func StartAllServices() {
 func StopServiceByName(name string) error {
 	sm, err := NewServiceManager()
 	if err != nil {
-		return fmt.Errorf("failed to get service manager: %%w", err)
+		return fmt.Errorf("failed to get service manager: %w", err)
 	}
 
 	running, err := sm.ServiceIsRunning(name)
 	if err != nil {
-		return fmt.Errorf("failed to check status of service %s: %%w", name, err)
+		return fmt.Errorf("failed to check status of service %s: %w", name, err)
 	}
 
 	if running {
 		fmt.Printf("Stopping %s...\n", name)
 		if err := sm.StopService(name); err != nil {
-			return fmt.Errorf("failed to stop service %s: %%w", name, err)
+			return fmt.Errorf("failed to stop service %s: %w", name, err)
 		}
 		fmt.Printf("Service %s stopped.\n", name)
 	} else {
@@ -313,7 +324,7 @@ func StopAllServices() {
 	fmt.Println("Stopping all services...")
 	for _, s := range ManagedServices {
 		if err := StopServiceByName(s); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to stop service %s: %%v\n", s, err)
+			fmt.Fprintf(os.Stderr, "Failed to stop service %s: %v\n", s, err)
 		}
 	}
 }
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// DefaultIncludedNamespaces are the namespaces zdbfs stores its data in
+	DefaultIncludedNamespaces = []string{"zdbfs-data", "zdbfs-meta"}
+	// DefaultExcludedNamespaces holds zdbfs' scratch namespace, which is
+	// never worth storing
+	DefaultExcludedNamespaces = []string{"zdbfs-temp"}
+)
+
+// NamespacePolicy decides which zdb namespaces are offloaded to zstor and how
+// their files are treated. Include and Exclude hold namespace names or glob
+// patterns as understood by filepath.Match. A namespace is offloaded when it
+// matches an include pattern and no exclude pattern.
+type NamespacePolicy struct {
+	Include []string        `yaml:"include"`
+	Exclude []string        `yaml:"exclude"`
+	Rules   []NamespaceRule `yaml:"rules"`
+}
+
+// NamespaceRule sets the upload priority and eviction of the namespaces
+// matching its pattern. The first matching rule applies.
+type NamespaceRule struct {
+	Pattern string `yaml:"pattern"`
+	// Priority orders uploads between namespaces, higher goes first. The
+	// default is 0.
+	Priority int `yaml:"priority"`
+	// Evict allows uploaded data files to be removed from the local cache.
+	// The default is true.
+	Evict *bool `yaml:"evict"`
+}
+
+// Validate checks that all patterns of the policy are well formed
+func (p NamespacePolicy) Validate() error {
+	patterns := append(append([]string{}, p.Include...), p.Exclude...)
+	for _, rule := range p.Rules {
+		patterns = append(patterns, rule.Pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Allows reports whether a namespace is offloaded to zstor
+func (p NamespacePolicy) Allows(namespace string) bool {
+	return matchAny(p.Include, namespace) && !matchAny(p.Exclude, namespace)
+}
+
+// Priority returns the upload priority of a namespace
+func (p NamespacePolicy) Priority(namespace string) int {
+	if rule := p.rule(namespace); rule != nil {
+		return rule.Priority
+	}
+	return 0
+}
+
+// Evictable reports whether uploaded data files of a namespace may be removed
+// from the local cache
+func (p NamespacePolicy) Evictable(namespace string) bool {
+	if rule := p.rule(namespace); rule != nil && rule.Evict != nil {
+		return *rule.Evict
+	}
+	return true
+}
+
+// Names returns the namespaces that are included by name rather than by a
+// glob pattern, and aren't excluded
+func (p NamespacePolicy) Names() []string {
+	var names []string
+	for _, include := range p.Include {
+		if !IsNamespacePattern(include) && p.Allows(include) {
+			names = append(names, include)
+		}
+	}
+	return names
+}
+
+func (p NamespacePolicy) rule(namespace string) *NamespaceRule {
+	for i, rule := range p.Rules {
+		if match(rule.Pattern, namespace) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// NamespaceOf returns the namespace of a zdb data or index file
+func NamespaceOf(filePath string) string {
+	return filepath.Base(filepath.Dir(filePath))
+}
+
+// ZdbFileNamespace returns the namespace of a file in the data or index
+// directory under a zdb root path. It reports false for any other path.
+func ZdbFileNamespace(rootPath, filePath string) (string, bool) {
+	rel, err := filepath.Rel(filepath.Clean(rootPath), filepath.Clean(filePath))
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 3 || (parts[0] != "data" && parts[0] != "index") || parts[1] == ".." {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func matchAny(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, namespace string) bool {
+	// Patterns are checked when the config is loaded
+	matched, _ := filepath.Match(pattern, namespace)
+	return matched
+}
+
+// IsNamespacePattern reports whether an include or exclude entry is a glob
+// pattern rather than a plain namespace name
+func IsNamespacePattern(pattern string) bool {
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
@@ -114,3 +114,16 @@ func ParseSizeToGB(sizeStr string) (int, error) {
 	gb := (bytes + (1024*1024*1024 - 1)) / (1024 * 1024 * 1024)
 	return int(gb), nil
 }
+
+// FormatSize formats a byte count with the largest binary unit that keeps the
+// value at or above one, in the units understood by ParseSize
+func FormatSize(bytes uint64) string {
+	units := []string{"T", "G", "M", "K"}
+	for i, unit := range units {
+		multiplier := uint64(1) << (10 * (len(units) - i))
+		if bytes >= multiplier {
+			return fmt.Sprintf("%.1f%s", float64(bytes)/float64(multiplier), unit)
+		}
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
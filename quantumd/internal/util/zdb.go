@@ -35,32 +35,32 @@ func MapIPs(ips []string) map[string]string {
 
 // GetEligibleZdbFiles returns all files that are eligible for upload into zstor
 // It takes a base path for zdb data and returns full paths of eligible files
+// in the namespaces allowed by the policy
 // These files might not exist on disk, since zstor can remove uploaded files,
 // so it's a theoretical set
-func GetEligibleZdbFiles(basePath string) ([]string, error) {
+func GetEligibleZdbFiles(basePath string, policy NamespacePolicy) ([]string, error) {
 	var result []string
 
 	// Define the directories to check
 	dirs := []string{"data", "index"}
 
-	// Define the namespaces to process (excluding zdbfs-temp)
-	namespaces := []string{"zdbfs-data", "zdbfs-meta"}
-
 	for _, dir := range dirs {
 		dirPath := filepath.Join(basePath, dir)
 
-		// Check if directory exists
-		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		// Skip the directory if it doesn't exist
+		entries, err := os.ReadDir(dirPath)
+		if os.IsNotExist(err) {
 			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading directory %s: %w", dirPath, err)
 		}
 
-		for _, namespace := range namespaces {
-			nsPath := filepath.Join(dirPath, namespace)
-
-			// Check if namespace directory exists
-			if _, err := os.Stat(nsPath); os.IsNotExist(err) {
+		for _, entry := range entries {
+			namespace := entry.Name()
+			if !entry.IsDir() || !policy.Allows(namespace) {
 				continue
 			}
+			nsPath := filepath.Join(dirPath, namespace)
 
 			// Get all files in the namespace directory
 			files, err := os.ReadDir(nsPath)
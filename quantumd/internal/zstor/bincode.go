@@ -0,0 +1,172 @@
+package zstor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// bincodeReader decodes values in bincode's default encoding, as used by
+// zstor for its metadata: little endian fixed size integers, u32 enum
+// variants, u8 option tags and u64 length prefixes for strings and vectors
+type bincodeReader struct {
+	buf []byte
+	err error
+}
+
+func (r *bincodeReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = fmt.Errorf("unexpected end of data, need %d bytes, have %d", n, len(r.buf))
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *bincodeReader) u8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *bincodeReader) u16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *bincodeReader) u32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *bincodeReader) u64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// length reads a u64 length prefix, bounded by the remaining data so corrupt
+// values can't cause huge allocations
+func (r *bincodeReader) length() int {
+	n := r.u64()
+	if r.err == nil && n > uint64(len(r.buf)) {
+		r.err = fmt.Errorf("length %d exceeds remaining %d bytes", n, len(r.buf))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *bincodeReader) string() string {
+	return string(r.take(r.length()))
+}
+
+func (r *bincodeReader) optionString() string {
+	switch tag := r.u8(); tag {
+	case 0:
+		return ""
+	case 1:
+		return r.string()
+	default:
+		r.fail("invalid option tag %d", tag)
+		return ""
+	}
+}
+
+func (r *bincodeReader) checksum() Checksum {
+	b := r.take(16)
+	if b == nil {
+		return nil
+	}
+	return Checksum(append([]byte(nil), b...))
+}
+
+func (r *bincodeReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+}
+
+// socketAddr decodes a Rust SocketAddr, which serde encodes as a V4 or V6
+// variant of raw address bytes followed by the port
+func (r *bincodeReader) socketAddr() string {
+	var ip net.IP
+	switch variant := r.u32(); variant {
+	case 0:
+		ip = net.IP(append([]byte(nil), r.take(4)...))
+	case 1:
+		ip = net.IP(append([]byte(nil), r.take(16)...))
+	default:
+		r.fail("invalid socket address variant %d", variant)
+		return ""
+	}
+	port := r.u16()
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// decodeMetadata decodes zstor's MetaData struct
+func decodeMetadata(data []byte) (*Metadata, error) {
+	r := &bincodeReader{buf: data}
+
+	var metadata Metadata
+	metadata.DataShards = int(r.u64())
+	metadata.DisposableShards = int(r.u64())
+	metadata.Checksum = r.checksum()
+
+	switch variant := r.u32(); variant {
+	case 0:
+		metadata.Encryption.Aes = r.string()
+	default:
+		r.fail("unknown encryption variant %d", variant)
+	}
+
+	switch variant := r.u32(); variant {
+	case 0:
+		metadata.Compression = "Snappy"
+	default:
+		r.fail("unknown compression variant %d", variant)
+	}
+
+	shardCount := r.length()
+	for i := 0; i < shardCount && r.err == nil; i++ {
+		var shard Shard
+		shard.ShardIdx = int(r.u64())
+		shard.Checksum = r.checksum()
+
+		keyCount := r.length()
+		for k := 0; k < keyCount && r.err == nil; k++ {
+			switch variant := r.u32(); variant {
+			case 0:
+				shard.Keys = append(shard.Keys, Key{V1: int(r.u32()), Version: 1})
+			case 1:
+				shard.Keys = append(shard.Keys, Key{V2: int(r.u64()), Version: 2})
+			default:
+				r.fail("unknown key variant %d", variant)
+			}
+		}
+
+		shard.CI.Address = r.socketAddr()
+		shard.CI.Namespace = r.optionString()
+		shard.CI.Password = r.optionString()
+		metadata.Shards = append(metadata.Shards, shard)
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", r.err)
+	}
+	return &metadata, nil
+}
@@ -0,0 +1,60 @@
+package zstor
+
+import (
+	"fmt"
+	"log"
+)
+
+// Client is the set of zstor operations used by quantumd
+type Client interface {
+	// Store uploads a single file. Index files should use StoreBatch.
+	Store(filePath string) error
+	// StoreBatch uploads a set of files from one directory together
+	StoreBatch(files []string, originalDir string) error
+	// Check returns the remote hash of a file, or an empty string if zstor
+	// doesn't know the file
+	Check(filePath string) (string, error)
+	// Retrieve downloads a file from zstor
+	Retrieve(filePath string) error
+	// Rebuild re-encodes a stored file onto the currently healthy backends
+	Rebuild(filePath string) error
+	// Test checks the connection to the zstor backends
+	Test() error
+	// GetMetadata fetches the metadata of a single file
+	GetMetadata(filePath string) (*Metadata, error)
+	// GetAllMetadata fetches the metadata of all files, keyed by meta key
+	GetAllMetadata() (map[string]Metadata, error)
+}
+
+// Client kinds that can be selected in the config
+const (
+	ClientSocket = "socket"
+	ClientExec   = "exec"
+)
+
+// NewClient creates a zstor client of the given kind. The socket client talks
+// to the monitor on the socket set in the zstor config, and falls back to the
+// exec client when the config has no socket.
+func NewClient(configPath, kind string) (Client, error) {
+	execClient, err := NewExecClient(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case ClientExec:
+		return execClient, nil
+	case ClientSocket, "":
+		cfg, err := LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Socket == "" {
+			log.Printf("No socket set in zstor config %s, using the zstor binary", configPath)
+			return execClient, nil
+		}
+		return NewSocketClient(cfg.Socket, execClient), nil
+	default:
+		return nil, fmt.Errorf("unknown zstor client %q, expected %q or %q", kind, ClientSocket, ClientExec)
+	}
+}
@@ -84,7 +84,20 @@ func (cfg *ZstorConfig) SaveConfig(path string) error {
 	return nil
 }
 
-func GenerateRemoteConfig(cfg *config.Config, meta, data []workloads.Deployment) (string, error) {
+// LoadExistingConfig loads the zstor config at path, or returns nil if there
+// is none yet
+func LoadExistingConfig(path string) (*ZstorConfig, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return LoadConfig(path)
+}
+
+// GenerateRemoteConfig renders the zstor config for the meta backends and the
+// data backends, with one zstor group per data group. Meta backends keep
+// their place in the existing config, if any, since metadata shards are
+// matched to backends by position.
+func GenerateRemoteConfig(cfg *config.Config, meta []workloads.Deployment, dataGroups [][]workloads.Deployment, existing *ZstorConfig) (string, error) {
 	key, err := keyFromMnemonic(cfg.Mnemonic, cfg.Password)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to generate key from mnemonic")
@@ -99,47 +112,36 @@ func GenerateRemoteConfig(cfg *config.Config, meta, data []workloads.Deployment)
 	// Prepare meta backends
 	var metaBackends []BackendConfig
 	for _, deployment := range meta {
-		zdb := deployment.Zdbs[0]
-		if len(zdb.IPs) == 0 {
-			return "", fmt.Errorf("Error parsing deployment info for zdb %s: no IPs found", zdb.Name)
-		}
-		mappedIPs := util.MapIPs(zdb.IPs)
-		ip, ok := mappedIPs[cfg.ZdbConnectionType]
-		if !ok {
-			return "", fmt.Errorf("ZDB connection type '%s' not supported on node for zdb %s", cfg.ZdbConnectionType, zdb.Name)
+		backend, err := BackendFromDeployment(cfg, deployment)
+		if err != nil {
+			return "", err
 		}
-		metaBackends = append(metaBackends, BackendConfig{
-			Address:   fmt.Sprintf("[%s]:9900", ip),
-			Namespace: zdb.Namespace,
-			Password:  cfg.Password,
-		})
+		metaBackends = append(metaBackends, backend)
+	}
+	if existing != nil {
+		metaBackends = keepMetaOrder(metaBackends, existing.Meta.Config.Backends)
 	}
 
 	// Prepare data backends
-	var dataBackends []BackendConfig
-	for _, deployment := range data {
-		zdb := deployment.Zdbs[0]
-		if len(zdb.IPs) == 0 {
-			return "", fmt.Errorf("Error parsing deployment info for zdb %s: no IPs found", zdb.Name)
-		}
-		mappedIPs := util.MapIPs(zdb.IPs)
-		ip, ok := mappedIPs[cfg.ZdbConnectionType]
-		if !ok {
-			return "", fmt.Errorf("ZDB connection type '%s' not supported on node for zdb %s", cfg.ZdbConnectionType, zdb.Name)
+	var groups []GroupConfig
+	for _, data := range dataGroups {
+		var dataBackends []BackendConfig
+		for _, deployment := range data {
+			backend, err := BackendFromDeployment(cfg, deployment)
+			if err != nil {
+				return "", err
+			}
+			dataBackends = append(dataBackends, backend)
 		}
-		dataBackends = append(dataBackends, BackendConfig{
-			Address:   fmt.Sprintf("[%s]:9900", ip),
-			Namespace: zdb.Namespace,
-			Password:  cfg.Password,
-		})
+		groups = append(groups, GroupConfig{Backends: dataBackends})
 	}
 
 	// Create config struct
 	zstorConfig := ZstorConfig{
 		MinimalShards:     cfg.MinShards,
 		ExpectedShards:    cfg.ExpectedShards,
-		RedundantGroups:   0,
-		RedundantNodes:    0,
+		RedundantGroups:   cfg.RedundantGroups,
+		RedundantNodes:    cfg.RedundantNodes,
 		Root:              "",
 		ZdbfsMountpoint:   cfg.QsfsMountpoint,
 		Socket:            "/tmp/zstor.sock",
@@ -164,9 +166,7 @@ func GenerateRemoteConfig(cfg *config.Config, meta, data []workloads.Deployment)
 			Algorithm: "AES",
 			Key:       key,
 		},
-		Groups: []GroupConfig{
-			{Backends: dataBackends},
-		},
+		Groups: groups,
 	}
 
 	// Serialize to TOML
@@ -178,6 +178,97 @@ func GenerateRemoteConfig(cfg *config.Config, meta, data []workloads.Deployment)
 	return buf.String(), nil
 }
 
+// keepMetaOrder puts the meta backends in the order of an existing config.
+// Backends in the existing config keep their place, and new ones take the
+// places of backends that are gone, such as a replacement deployed for a
+// dead backend. The deployment order puts replacements last, which would
+// match shards to the wrong backends.
+func keepMetaOrder(backends, existing []BackendConfig) []BackendConfig {
+	slots := make([]*BackendConfig, len(existing))
+	var added []BackendConfig
+	for _, backend := range backends {
+		placed := false
+		for i, old := range existing {
+			if slots[i] == nil && old.Address == backend.Address && old.Namespace == backend.Namespace {
+				slots[i] = &backend
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			added = append(added, backend)
+		}
+	}
+
+	var ordered []BackendConfig
+	for _, slot := range slots {
+		if slot == nil {
+			if len(added) == 0 {
+				continue
+			}
+			slot, added = &added[0], added[1:]
+		}
+		ordered = append(ordered, *slot)
+	}
+	return append(ordered, added...)
+}
+
+// BackendFromDeployment returns the zstor backend for the zdb of a deployment,
+// reached over the configured connection type
+func BackendFromDeployment(cfg *config.Config, deployment workloads.Deployment) (BackendConfig, error) {
+	if len(deployment.Zdbs) == 0 {
+		return BackendConfig{}, fmt.Errorf("Error parsing deployment info for %s: no ZDBs found", deployment.Name)
+	}
+	zdb := deployment.Zdbs[0]
+	if len(zdb.IPs) == 0 {
+		return BackendConfig{}, fmt.Errorf("Error parsing deployment info for zdb %s: no IPs found", zdb.Name)
+	}
+	mappedIPs := util.MapIPs(zdb.IPs)
+	ip, ok := mappedIPs[cfg.ZdbConnectionType]
+	if !ok {
+		return BackendConfig{}, fmt.Errorf("ZDB connection type '%s' not supported on node for zdb %s", cfg.ZdbConnectionType, zdb.Name)
+	}
+	return BackendConfig{
+		Address:   fmt.Sprintf("[%s]:9900", ip),
+		Namespace: zdb.Namespace,
+		Password:  cfg.Password,
+	}, nil
+}
+
+// HasBackend reports whether a backend is among the meta or data backends
+func (cfg *ZstorConfig) HasBackend(backend BackendConfig) bool {
+	lists := [][]BackendConfig{cfg.Meta.Config.Backends}
+	for _, group := range cfg.Groups {
+		lists = append(lists, group.Backends)
+	}
+	for _, backends := range lists {
+		for _, b := range backends {
+			if b.Address == backend.Address && b.Namespace == backend.Namespace {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReplaceBackend swaps a meta or data backend for another one, keeping its
+// place in the config. It reports whether the old backend was found.
+func (cfg *ZstorConfig) ReplaceBackend(old, replacement BackendConfig) bool {
+	lists := [][]BackendConfig{cfg.Meta.Config.Backends}
+	for _, group := range cfg.Groups {
+		lists = append(lists, group.Backends)
+	}
+	for _, backends := range lists {
+		for i, backend := range backends {
+			if backend.Address == old.Address && backend.Namespace == old.Namespace {
+				backends[i] = replacement
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func keyFromMnemonic(mnemonic, password string) (string, error) {
 	seed := bip39.NewSeed(mnemonic, password)
 	hash := sha256.Sum256(seed)
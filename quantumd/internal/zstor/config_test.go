@@ -0,0 +1,36 @@
+package zstor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeepMetaOrder(t *testing.T) {
+	backend := func(address string) BackendConfig {
+		return BackendConfig{Address: address, Namespace: "meta", Password: "secret"}
+	}
+	a, b, c, d, e := backend("[2a02::a]:9900"), backend("[2a02::b]:9900"), backend("[2a02::c]:9900"),
+		backend("[2a02::d]:9900"), backend("[2a02::e]:9900")
+
+	tests := []struct {
+		name     string
+		backends []BackendConfig
+		existing []BackendConfig
+		want     []BackendConfig
+	}{
+		{"no existing config", []BackendConfig{b, a, c, d}, nil, []BackendConfig{b, a, c, d}},
+		{"same backends", []BackendConfig{d, c, b, a}, []BackendConfig{a, b, c, d}, []BackendConfig{a, b, c, d}},
+		// e replaced b in the existing config, and comes last from the grid
+		{"replaced backend", []BackendConfig{a, c, d, e}, []BackendConfig{a, e, c, d}, []BackendConfig{a, e, c, d}},
+		// e was deployed for b, which is gone, before the config was updated
+		{"dead backend", []BackendConfig{a, c, d, e}, []BackendConfig{a, b, c, d}, []BackendConfig{a, e, c, d}},
+		{"missing backend", []BackendConfig{a, c, d}, []BackendConfig{a, b, c, d}, []BackendConfig{a, c, d}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keepMetaOrder(tt.backends, tt.existing); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package zstor
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/reedsolomon"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ShardReport describes the state of the shards of a file as found while
+// reading them back
+type ShardReport struct {
+	// Healthy counts the shards that were read and matched their checksum
+	Healthy int
+	// Missing lists the indices of shards that couldn't be read
+	Missing []int
+	// Corrupt lists the indices of shards that didn't match their checksum
+	Corrupt []int
+}
+
+// Damaged reports whether any shard was missing or corrupt
+func (r *ShardReport) Damaged() bool {
+	return len(r.Missing) > 0 || len(r.Corrupt) > 0
+}
+
+// ErrTooFewShards is returned when not enough shards of a file can be read to
+// decode it
+var ErrTooFewShards = errors.New("too few shards")
+
+// DataReader reads files straight from zstor's data backends, the way zstor
+// itself retrieves them. Each shard is read from the backend recorded in the
+// metadata and checked against its checksum, after which the file is
+// erasure decoded, decrypted with the data encryption key and decompressed.
+type DataReader struct {
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	clients map[string]*redis.Client
+}
+
+// NewDataReader sets up a reader with the data encryption key of a zstor
+// config
+func NewDataReader(cfg *ZstorConfig) (*DataReader, error) {
+	key, err := hex.DecodeString(cfg.Encryption.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up decryption: %w", err)
+	}
+	return &DataReader{
+		aead:    aead,
+		clients: make(map[string]*redis.Client),
+	}, nil
+}
+
+// Close closes all backend connections
+func (r *DataReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for key, client := range r.clients {
+		errs = append(errs, client.Close())
+		delete(r.clients, key)
+	}
+	return errors.Join(errs...)
+}
+
+// client returns a connection to the backend a shard is stored on. Backends
+// are shared between files, so connections are kept for reuse.
+func (r *DataReader) client(ci CI) *redis.Client {
+	key := ci.Address + "/" + ci.Namespace
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[key]
+	if !ok {
+		client = newZdbClient(BackendConfig{Address: ci.Address, Namespace: ci.Namespace, Password: ci.Password})
+		r.clients[key] = client
+	}
+	return client
+}
+
+// Read decodes a file from its shards and writes it to w. Every shard is read
+// and checked, even when enough are available to decode, so the report shows
+// the full state of the file. throttle is called with the size of each shard
+// read, to let the caller bound the bandwidth used. The report is returned
+// along with any error.
+func (r *DataReader) Read(ctx context.Context, metadata *Metadata, w io.Writer, throttle func(ctx context.Context, n int) error) (*ShardReport, error) {
+	report := &ShardReport{}
+	total := len(metadata.Shards)
+	if metadata.DataShards <= 0 || metadata.DataShards > total {
+		return report, fmt.Errorf("invalid metadata with %d data shards out of %d", metadata.DataShards, total)
+	}
+
+	shards := make([][]byte, total)
+	for _, shard := range metadata.Shards {
+		if shard.ShardIdx < 0 || shard.ShardIdx >= total {
+			return report, fmt.Errorf("invalid shard index %d out of %d shards", shard.ShardIdx, total)
+		}
+
+		data, err := r.readShard(ctx, shard)
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Missing = append(report.Missing, shard.ShardIdx)
+			continue
+		}
+		if err := throttle(ctx, len(data)); err != nil {
+			return report, err
+		}
+
+		hash, err := blake2b.New(16, nil)
+		if err != nil {
+			return report, fmt.Errorf("failed to create blake2b hash: %w", err)
+		}
+		hash.Write(data)
+		if !bytes.Equal(hash.Sum(nil), shard.Checksum) {
+			report.Corrupt = append(report.Corrupt, shard.ShardIdx)
+			continue
+		}
+		shards[shard.ShardIdx] = data
+		report.Healthy++
+	}
+	sort.Ints(report.Missing)
+	sort.Ints(report.Corrupt)
+
+	if report.Healthy < metadata.DataShards {
+		return report, fmt.Errorf("%w: only %d of %d shards readable, need %d", ErrTooFewShards, report.Healthy, total, metadata.DataShards)
+	}
+
+	return report, r.decode(shards, metadata.DataShards, w)
+}
+
+// readShard reads the value of every key of a shard from its backend. Shards
+// larger than zdb's value size limit are split over several sequential keys.
+func (r *DataReader) readShard(ctx context.Context, shard Shard) ([]byte, error) {
+	client := r.client(shard.CI)
+
+	var data []byte
+	for _, key := range shard.Keys {
+		zkey, err := zdbKey(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := client.Get(ctx, zkey).Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard %d from %s: %w", shard.ShardIdx, shard.CI.Address, err)
+		}
+		data = append(data, value...)
+	}
+	return data, nil
+}
+
+// zdbKey encodes a key the way zdb hands them out in sequential mode, as a
+// little endian integer of the width of its variant
+func zdbKey(key Key) (string, error) {
+	switch key.Version {
+	case 1:
+		return string(binary.LittleEndian.AppendUint32(nil, uint32(key.V1))), nil
+	case 2:
+		return string(binary.LittleEndian.AppendUint64(nil, uint64(key.V2))), nil
+	default:
+		return "", fmt.Errorf("unknown key variant %d", key.Version)
+	}
+}
+
+// decode reverses zstor's pipeline on a full set of shards, where missing
+// shards are nil: erasure decoding, decryption and decompression. The file is
+// written to w. AES-GCM only authenticates a value as a whole and snappy
+// blocks aren't framed, so the value can't be decoded piece by piece. It's
+// decrypted in place instead, so a file takes about twice the size of its
+// value in memory, which zdb_data_size keeps small.
+func (r *DataReader) decode(shards [][]byte, dataShards int, w io.Writer) error {
+	encoder, err := reedsolomon.New(dataShards, len(shards)-dataShards)
+	if err != nil {
+		return fmt.Errorf("failed to set up erasure decoding: %w", err)
+	}
+	for _, shard := range shards[:dataShards] {
+		if shard == nil {
+			if err := encoder.ReconstructData(shards); err != nil {
+				return fmt.Errorf("failed to reconstruct shards: %w", err)
+			}
+			break
+		}
+	}
+
+	// As with metadata, the value is padded to a multiple of the data shard
+	// count and the last byte holds the length of the padding
+	padded := bytes.Join(shards[:dataShards], nil)
+	if len(padded) == 0 {
+		return fmt.Errorf("empty value")
+	}
+	padding := int(padded[len(padded)-1])
+	if padding == 0 || padding > len(padded) {
+		return fmt.Errorf("invalid padding length %d", padding)
+	}
+	encrypted := padded[:len(padded)-padding]
+
+	nonceSize := r.aead.NonceSize()
+	if len(encrypted) < nonceSize {
+		return fmt.Errorf("value too short to decrypt")
+	}
+	ciphertext := encrypted[nonceSize:]
+	compressed, err := r.aead.Open(ciphertext[:0], encrypted[:nonceSize], ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	plain, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return fmt.Errorf("failed to decompress: %w", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		return fmt.Errorf("failed to write decoded file: %w", err)
+	}
+	return nil
+}
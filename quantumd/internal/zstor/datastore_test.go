@@ -0,0 +1,177 @@
+package zstor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"crypto/cipher"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/reedsolomon"
+)
+
+var dataFixturePlain = []byte("zstor data fixture: compressed, encrypted and erasure coded\n")
+
+// dataFixtureShards is dataFixturePlain as stored on three data backends:
+// compressed with snappy, prefixed with its nonce and sealed with AES-256-GCM
+// under the key 000102..1f and the nonce b0b1..bb, padded to an even length
+// with bytes holding the padding length, and split into 2 data shards and 1
+// parity shard with Reed-Solomon. The sealed value has an even length, so it
+// carries a full block of padding.
+var dataFixtureShards = []string{
+	"b0b1b2b3b4b5b6b7b8b9babba5b920d898a2c97f2399e3c3ed3be1baf0493bb72f0eec5a33bef0942ff19772296b",
+	"465400acdfc8d13ec46a5dd7e695481f76b46e4927d02ee508556091b073029e62f0573b5721b67f60be814b0202",
+	"4166cb8d624f78b84002696323e1f04b598e9a132b0b648f3ae7feec703d49e5b5ef8798fb9d7c5fb16fbb007fb9",
+}
+
+func newTestDataReader(t *testing.T) *DataReader {
+	t.Helper()
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DataReader{aead: aead}
+}
+
+// sealValue runs zstor's store pipeline on a file, the reverse of decode
+func sealValue(t *testing.T, aead cipher.AEAD, plain []byte, dataShards, parityShards int) [][]byte {
+	t.Helper()
+	nonce := make([]byte, aead.NonceSize())
+	for i := range nonce {
+		nonce[i] = byte(rand.N(256))
+	}
+	value := aead.Seal(append([]byte{}, nonce...), nonce, snappy.Encode(nil, plain), nil)
+	padding := dataShards - len(value)%dataShards
+	value = append(value, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := encoder.Split(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+func fixtureShards() [][]byte {
+	shards := make([][]byte, len(dataFixtureShards))
+	for i, shard := range dataFixtureShards {
+		shards[i] = mustHex(shard)
+	}
+	return shards
+}
+
+func TestDecodeDataFixture(t *testing.T) {
+	r := newTestDataReader(t)
+
+	// Any two of the three shards are enough
+	for missing := -1; missing < len(dataFixtureShards); missing++ {
+		shards := fixtureShards()
+		if missing >= 0 {
+			shards[missing] = nil
+		}
+		var out bytes.Buffer
+		if err := r.decode(shards, 2, &out); err != nil {
+			t.Errorf("without shard %d: %v", missing, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), dataFixturePlain) {
+			t.Errorf("without shard %d: decoded %q", missing, out.Bytes())
+		}
+	}
+}
+
+func TestDecodeDataErrors(t *testing.T) {
+	r := newTestDataReader(t)
+
+	tests := []struct {
+		name   string
+		damage func(shards [][]byte)
+	}{
+		{"tampered ciphertext", func(shards [][]byte) { shards[0][20] ^= 0xff }},
+		{"tampered nonce", func(shards [][]byte) { shards[0][0] ^= 0xff }},
+		{"zero padding", func(shards [][]byte) { shards[1][len(shards[1])-1] = 0 }},
+		{"padding longer than the value", func(shards [][]byte) { shards[1][len(shards[1])-1] = 0xff }},
+		{"too few shards", func(shards [][]byte) { shards[0], shards[2] = nil, nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shards := fixtureShards()
+			tt.damage(shards)
+			var out bytes.Buffer
+			if err := r.decode(shards, 2, &out); err == nil {
+				t.Error("decoding succeeded")
+			}
+			if out.Len() > 0 {
+				t.Errorf("wrote %d bytes of a value that didn't decode", out.Len())
+			}
+		})
+	}
+}
+
+func TestDecodeDataRoundTrip(t *testing.T) {
+	r := newTestDataReader(t)
+
+	for _, size := range []int{1, 4095, 1 << 20} {
+		plain := make([]byte, size)
+		for i := range plain {
+			// Half random, half runs, so snappy has something to compress
+			if i%2 == 0 {
+				plain[i] = byte(rand.N(256))
+			}
+		}
+		shards := sealValue(t, r.aead, plain, 4, 2)
+		shards[1], shards[4] = nil, nil
+
+		var out bytes.Buffer
+		if err := r.decode(shards, 4, &out); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("%d bytes: decoded file doesn't match", size)
+		}
+	}
+}
+
+func TestZdbKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  Key
+		want string
+	}{
+		{"V1(0)", Key{V1: 0, Version: 1}, "00000000"},
+		{"V2(0)", Key{V2: 0, Version: 2}, "0000000000000000"},
+		{"V1(258)", Key{V1: 258, Version: 1}, "02010000"},
+		{"V2(258)", Key{V2: 258, Version: 2}, "0201000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := zdbKey(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString([]byte(got)) != tt.want {
+				t.Errorf("got key %x, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := zdbKey(Key{}); err == nil {
+		t.Error("key without a variant was encoded")
+	}
+}
@@ -1,11 +1,12 @@
 package zstor
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"os/exec"
+	"net"
 	"strings"
+	"time"
 )
 
 // Checksum represents a checksum array.
@@ -47,9 +48,38 @@ type CI struct {
 	Password  string `json:"password"`
 }
 
-// Key represents a key with its version.
+// IsOn reports whether the shard connection points to a backend. Metadata
+// holds plain socket addresses, while the config puts every host in brackets.
+func (ci CI) IsOn(backend BackendConfig) bool {
+	if ci.Namespace != backend.Namespace {
+		return false
+	}
+	host, port, err := net.SplitHostPort(ci.Address)
+	if err != nil {
+		return ci.Address == backend.Address
+	}
+	backendHost, backendPort, err := net.SplitHostPort(backend.Address)
+	if err != nil {
+		return false
+	}
+	if port != backendPort {
+		return false
+	}
+	ip, backendIP := net.ParseIP(host), net.ParseIP(backendHost)
+	if ip == nil || backendIP == nil {
+		return host == backendHost
+	}
+	return ip.Equal(backendIP)
+}
+
+// Key represents a key with its version. Version is the variant zstor
+// encoded the key with, 1 for a u32 key in V1 and 2 for a u64 key in V2,
+// since zdb's sequential keys start at 0 and the width can't be told from
+// the value.
 type Key struct {
-	V2 int `json:"V2"`
+	V1      int `json:"V1,omitempty"`
+	V2      int `json:"V2"`
+	Version int `json:"-"`
 }
 
 // Shard represents a shard's metadata.
@@ -70,36 +100,25 @@ type Metadata struct {
 	Shards           []Shard    `json:"shards"`
 }
 
-// GetMetadata fetches and parses metadata for a given file using zstor-metadata-decoder.
-func (c *Client) GetMetadata(filePath string) (*Metadata, error) {
-	cmd := exec.Command(c.MetadataDecoderPath, "--config", c.ConfigPath, "--file", filePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute zstor-metadata-decoder: %w", err)
-	}
-
-	var metadata Metadata
-	if err := json.Unmarshal(output, &metadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
-	}
+// metadataTimeout bounds a single metadata read. Fetching all metadata scans
+// every meta backend and gets a longer budget.
+const (
+	metadataTimeout    = 30 * time.Second
+	allMetadataTimeout = 5 * time.Minute
+)
 
-	return &metadata, nil
+// GetMetadata fetches and decodes metadata for a given file from the meta backends.
+func (c *ExecClient) GetMetadata(filePath string) (*Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	return c.MetaStore.Get(ctx, filePath)
 }
 
-// GetAllMetadata fetches and parses metadata for all files using zstor-metadata-decoder.
-func (c *Client) GetAllMetadata() (map[string]Metadata, error) {
-	cmd := exec.Command(c.MetadataDecoderPath, "--config", c.ConfigPath, "--all")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute zstor-metadata-decoder: %w", err)
-	}
-
-	var allMetadata map[string]Metadata
-	if err := json.Unmarshal(output, &allMetadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal all metadata: %w", err)
-	}
-
-	return allMetadata, nil
+// GetAllMetadata fetches and decodes metadata for all files from the meta backends.
+func (c *ExecClient) GetAllMetadata() (map[string]Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), allMetadataTimeout)
+	defer cancel()
+	return c.MetaStore.GetAll(ctx)
 }
 
 // AssignFilenamesToMetadata takes a map of zstor paths to metadata and assigns
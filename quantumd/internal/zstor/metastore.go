@@ -0,0 +1,427 @@
+package zstor
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/redis/go-redis/v9"
+)
+
+// scanBatchSize bounds how many GETs are pipelined in one round trip
+const scanBatchSize = 256
+
+// ErrMetadataNotFound is returned when none of the meta backends has metadata
+// for a file, which means zstor doesn't know about it
+var ErrMetadataNotFound = errors.New("metadata not found")
+
+// MetaStore reads file metadata straight from zstor's meta backends. Values
+// are stored as Reed-Solomon shards of AES-GCM encrypted, bincode encoded
+// metadata, one shard per backend in config order.
+type MetaStore struct {
+	prefix     string
+	backends   []*redis.Client
+	aead       cipher.AEAD
+	encoder    reedsolomon.Encoder
+	dataShards int
+}
+
+// NewMetaStore connects to the meta backends of a zstor config. Connections
+// are opened lazily, so unreachable backends only fail the reads that need
+// them.
+func NewMetaStore(cfg *ZstorConfig) (*MetaStore, error) {
+	metaCfg := cfg.Meta.Config
+	dataShards, parityShards, err := metaShardCounts(len(metaCfg.Backends))
+	if err != nil {
+		return nil, err
+	}
+
+	// The key in the zstor config is the one keyFromMnemonic derived at
+	// deploy time
+	key, err := hex.DecodeString(metaCfg.Encryption.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid meta encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid meta encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up meta decryption: %w", err)
+	}
+
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up erasure decoding: %w", err)
+	}
+
+	store := &MetaStore{
+		prefix:     metaCfg.Prefix,
+		aead:       aead,
+		encoder:    encoder,
+		dataShards: dataShards,
+	}
+	for _, backend := range metaCfg.Backends {
+		store.backends = append(store.backends, newZdbClient(backend))
+	}
+	return store, nil
+}
+
+// metaShardCounts returns how zstor splits each metadata value over the meta
+// backends in its config: half of them hold data shards, and the rest parity
+// shards
+func metaShardCounts(backends int) (dataShards, parityShards int, err error) {
+	if backends < 2 {
+		return 0, 0, fmt.Errorf("expected at least 2 meta backends, found %d", backends)
+	}
+	dataShards = backends / 2
+	return dataShards, backends - dataShards, nil
+}
+
+// newZdbClient creates a redis client for a zdb namespace. zdb only speaks
+// RESP2 and selects namespaces with SELECT <namespace> <password>.
+func newZdbClient(backend BackendConfig) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:            backend.Address,
+		Protocol:        2,
+		DisableIdentity: true,
+		PoolSize:        2,
+		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+			args := []any{"SELECT", backend.Namespace}
+			if backend.Password != "" {
+				args = append(args, backend.Password)
+			}
+			return cn.Do(ctx, args...).Err()
+		},
+	})
+}
+
+// Close closes all backend connections
+func (s *MetaStore) Close() error {
+	var errs []error
+	for _, backend := range s.backends {
+		errs = append(errs, backend.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// metaKey returns the key zstor stores the metadata of a file under
+func (s *MetaStore) metaKey(filePath string) string {
+	return fmt.Sprintf("/%s/meta/%s", s.prefix, GetPathHash(filePath))
+}
+
+// Get returns the metadata of a single file
+func (s *MetaStore) Get(ctx context.Context, filePath string) (*Metadata, error) {
+	key := s.metaKey(filePath)
+	shards := make([][]byte, len(s.backends))
+	missing := 0
+	for i, backend := range s.backends {
+		value, err := backend.Get(ctx, key).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				missing++
+			} else {
+				log.Printf("Failed to read metadata shard %d of %s: %v", i, filePath, err)
+			}
+			continue
+		}
+		shards[i] = value
+	}
+	if missing == len(s.backends) {
+		return nil, ErrMetadataNotFound
+	}
+
+	metadata, err := s.decodeValue(shards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", filePath, err)
+	}
+	return metadata, nil
+}
+
+// GetAll returns the metadata of every file, keyed by meta key in the form
+// /{prefix}/meta/{path hash}
+func (s *MetaStore) GetAll(ctx context.Context) (map[string]Metadata, error) {
+	// Every backend holds a shard of every key, but any of them can be
+	// missing some, so take the union
+	keySet := make(map[string]struct{})
+	reachable := 0
+	for i, backend := range s.backends {
+		keys, err := s.scanMetaKeys(ctx, backend)
+		if err != nil {
+			log.Printf("Failed to scan meta backend %d: %v", i, err)
+			continue
+		}
+		reachable++
+		for _, key := range keys {
+			keySet[key] = struct{}{}
+		}
+	}
+	if reachable < s.dataShards {
+		return nil, fmt.Errorf("only %d of %d meta backends reachable, need %d", reachable, len(s.backends), s.dataShards)
+	}
+
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+
+	result := make(map[string]Metadata, len(keys))
+	for start := 0; start < len(keys); start += scanBatchSize {
+		end := min(start+scanBatchSize, len(keys))
+		batch := keys[start:end]
+
+		shards := s.fetchShards(ctx, batch)
+		for i, key := range batch {
+			metadata, err := s.decodeValue(shards[i])
+			if err != nil {
+				log.Printf("Skipping metadata %s: %v", key, err)
+				continue
+			}
+			result[key] = *metadata
+		}
+	}
+	return result, nil
+}
+
+// scanMetaKeys lists the file metadata keys on one backend. zdb's SCAN
+// returns a cursor and a list of [key, size, timestamp] entries, and
+// reports the end of the namespace as an error.
+func (s *MetaStore) scanMetaKeys(ctx context.Context, backend *redis.Client) ([]string, error) {
+	prefix := fmt.Sprintf("/%s/meta/", s.prefix)
+
+	var keys []string
+	args := []any{"SCAN"}
+	for {
+		reply, err := backend.Do(ctx, args...).Slice()
+		if err != nil {
+			if strings.Contains(err.Error(), "No more data") {
+				return keys, nil
+			}
+			return nil, err
+		}
+		if len(reply) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply with %d elements", len(reply))
+		}
+
+		cursor, ok := reply[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected SCAN cursor of type %T", reply[0])
+		}
+		entries, ok := reply[1].([]any)
+		if !ok {
+			return nil, fmt.Errorf("unexpected SCAN entries of type %T", reply[1])
+		}
+		for _, entry := range entries {
+			fields, ok := entry.([]any)
+			if !ok || len(fields) == 0 {
+				continue
+			}
+			key, ok := fields[0].(string)
+			if ok && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		args = []any{"SCAN", cursor}
+	}
+}
+
+// fetchShards reads the shards of a batch of keys from all backends, with
+// one pipelined round trip per backend
+func (s *MetaStore) fetchShards(ctx context.Context, keys []string) [][][]byte {
+	shards := make([][][]byte, len(keys))
+	for i := range shards {
+		shards[i] = make([][]byte, len(s.backends))
+	}
+
+	for b, backend := range s.backends {
+		pipe := backend.Pipeline()
+		cmds := make([]*redis.StringCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		// Errors are checked per command below
+		pipe.Exec(ctx)
+
+		for i, cmd := range cmds {
+			value, err := cmd.Bytes()
+			if err != nil {
+				continue
+			}
+			shards[i][b] = value
+		}
+	}
+	return shards
+}
+
+// decodeValue reassembles, decrypts and decodes a metadata value from its
+// shards. Missing shards are nil.
+func (s *MetaStore) decodeValue(shards [][]byte) (*Metadata, error) {
+	present := 0
+	for _, shard := range shards {
+		if shard != nil {
+			present++
+		}
+	}
+	if present < s.dataShards {
+		return nil, fmt.Errorf("only %d of %d shards available", present, len(shards))
+	}
+
+	for _, shard := range shards[:s.dataShards] {
+		if shard == nil {
+			if err := s.encoder.ReconstructData(shards); err != nil {
+				return nil, fmt.Errorf("failed to reconstruct shards: %w", err)
+			}
+			break
+		}
+	}
+
+	// The encoder pads the value to a multiple of the data shard count, and
+	// the last byte holds the length of the padding
+	padded := bytes.Join(shards[:s.dataShards], nil)
+	if len(padded) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	padding := int(padded[len(padded)-1])
+	if padding == 0 || padding > len(padded) {
+		return nil, fmt.Errorf("invalid padding length %d", padding)
+	}
+	encrypted := padded[:len(padded)-padding]
+
+	nonceSize := s.aead.NonceSize()
+	if len(encrypted) < nonceSize {
+		return nil, fmt.Errorf("value too short to decrypt")
+	}
+	plain, err := s.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return decodeMetadata(plain)
+}
+
+// ShardOrder finds the order zstor wrote the metadata shards in, for a config
+// rebuilt from the grid that may list the meta backends in another order.
+// Every order is tried on values that all backends hold until one decodes.
+// order[i] is the index of the backend holding shard i.
+func (s *MetaStore) ShardOrder(ctx context.Context) ([]int, error) {
+	if len(s.backends) == 0 {
+		return nil, fmt.Errorf("no meta backends configured")
+	}
+	keys, err := s.scanMetaKeys(ctx, s.backends[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan meta backend 0: %w", err)
+	}
+
+	for start := 0; start < len(keys); start += scanBatchSize {
+		end := min(start+scanBatchSize, len(keys))
+		for _, shards := range s.fetchShards(ctx, keys[start:end]) {
+			if order, ok := s.shardOrder(shards); ok {
+				return order, nil
+			}
+		}
+	}
+	return nil, ErrMetadataNotFound
+}
+
+// shardOrder tries every order of a value's shards, and returns the one under
+// which the parity matches and the value decodes. Values missing a shard
+// can't be placed and are skipped.
+func (s *MetaStore) shardOrder(shards [][]byte) ([]int, bool) {
+	for _, shard := range shards {
+		if shard == nil {
+			return nil, false
+		}
+	}
+	ordered := make([][]byte, len(shards))
+	for _, order := range permutations(len(shards)) {
+		for i, backend := range order {
+			ordered[i] = shards[backend]
+		}
+		if ok, err := s.encoder.Verify(ordered); err != nil || !ok {
+			continue
+		}
+		if _, err := s.decodeValue(ordered); err == nil {
+			return order, true
+		}
+	}
+	return nil, false
+}
+
+// permutations returns every order of the integers 0 to n-1
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var result [][]int
+	for _, rest := range permutations(n - 1) {
+		for i := 0; i <= len(rest); i++ {
+			order := append(append(append([]int{}, rest[:i]...), n-1), rest[i:]...)
+			result = append(result, order)
+		}
+	}
+	return result
+}
+
+// MissingKeys lists the file metadata keys found on any other meta backend
+// but not on the backend at index, such as a new backend swapped into the
+// config. Only key presence is checked, the values aren't decoded.
+func (s *MetaStore) MissingKeys(ctx context.Context, index int) ([]string, error) {
+	if index < 0 || index >= len(s.backends) {
+		return nil, fmt.Errorf("invalid meta backend index %d", index)
+	}
+
+	keySet := make(map[string]struct{})
+	for i, backend := range s.backends {
+		if i == index {
+			continue
+		}
+		keys, err := s.scanMetaKeys(ctx, backend)
+		if err != nil {
+			log.Printf("Failed to scan meta backend %d: %v", i, err)
+			continue
+		}
+		for _, key := range keys {
+			keySet[key] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var missing []string
+	target := s.backends[index]
+	for start := 0; start < len(keys); start += scanBatchSize {
+		end := min(start+scanBatchSize, len(keys))
+		batch := keys[start:end]
+
+		pipe := target.Pipeline()
+		cmds := make([]*redis.IntCmd, len(batch))
+		for i, key := range batch {
+			cmds[i] = pipe.Exists(ctx, key)
+		}
+		// Errors are checked per command below
+		pipe.Exec(ctx)
+
+		for i, cmd := range cmds {
+			found, err := cmd.Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to check metadata %s on meta backend %d: %w", batch[i], index, err)
+			}
+			if found == 0 {
+				missing = append(missing, batch[i])
+			}
+		}
+	}
+	return missing, nil
+}
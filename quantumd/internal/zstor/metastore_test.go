@@ -0,0 +1,237 @@
+package zstor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// metadataFixture is zstor's MetaData struct in bincode, spelled out field by
+// field: little endian fixed size integers, u32 enum variants, u8 option tags
+// and u64 length prefixes.
+var metadataFixture = "" +
+	"0200000000000000" + // data_shards: 2
+	"0100000000000000" + // disposable_shards: 1
+	"101112131415161718191a1b1c1d1e1f" + // checksum
+	"00000000" + "1000000000000000" + hex.EncodeToString([]byte("0123456789abcdef")) + // encryption: Aes(key)
+	"00000000" + // compression: Snappy
+	"0300000000000000" + // shards: 3 entries
+	// shard 0, one V2 key on an IPv6 backend with namespace and password
+	"0000000000000000" + // shard_idx: 0
+	"202122232425262728292a2b2c2d2e2f" + // checksum
+	"0100000000000000" + // keys: 1 entry
+	"01000000" + "0700000000000000" + // V2(7)
+	"01000000" + "2a021802005e00000000000000000001" + "ac26" + // [2a02:1802:5e::1]:9900
+	"01" + "0400000000000000" + hex.EncodeToString([]byte("ns-a")) + // namespace: Some("ns-a")
+	"01" + "0600000000000000" + hex.EncodeToString([]byte("secret")) + // password: Some("secret")
+	// shard 1, two V1 keys on an IPv4 backend without password
+	"0100000000000000" + // shard_idx: 1
+	"303132333435363738393a3b3c3d3e3f" + // checksum
+	"0200000000000000" + // keys: 2 entries
+	"00000000" + "03000000" + // V1(3)
+	"00000000" + "04000000" + // V1(4)
+	"00000000" + "0a000002" + "ac26" + // 10.0.0.2:9900
+	"01" + "0400000000000000" + hex.EncodeToString([]byte("ns-b")) + // namespace: Some("ns-b")
+	"00" + // password: None
+	// shard 2, without namespace or password
+	"0200000000000000" + // shard_idx: 2
+	"404142434445464748494a4b4c4d4e4f" + // checksum
+	"0100000000000000" + // keys: 1 entry
+	"01000000" + "0100000000000000" + // V2(1)
+	"00000000" + "0a000003" + "ac26" + // 10.0.0.3:9900
+	"00" + // namespace: None
+	"00" // password: None
+
+var metadataFixtureDecoded = Metadata{
+	DataShards:       2,
+	DisposableShards: 1,
+	Checksum:         mustHex("101112131415161718191a1b1c1d1e1f"),
+	Encryption:       Encryption{Aes: "0123456789abcdef"},
+	Compression:      "Snappy",
+	Shards: []Shard{
+		{
+			ShardIdx: 0,
+			Checksum: mustHex("202122232425262728292a2b2c2d2e2f"),
+			Keys:     []Key{{V2: 7, Version: 2}},
+			CI:       CI{Address: "[2a02:1802:5e::1]:9900", Namespace: "ns-a", Password: "secret"},
+		},
+		{
+			ShardIdx: 1,
+			Checksum: mustHex("303132333435363738393a3b3c3d3e3f"),
+			Keys:     []Key{{V1: 3, Version: 1}, {V1: 4, Version: 1}},
+			CI:       CI{Address: "10.0.0.2:9900", Namespace: "ns-b"},
+		},
+		{
+			ShardIdx: 2,
+			Checksum: mustHex("404142434445464748494a4b4c4d4e4f"),
+			Keys:     []Key{{V2: 1, Version: 2}},
+			CI:       CI{Address: "10.0.0.3:9900"},
+		},
+	},
+}
+
+// metadataValueShards is metadataFixture as stored on four meta backends:
+// prefixed with its nonce and sealed with AES-256-GCM under the key
+// 000102..1f and the nonce a0a1..ab, padded to an even length with bytes
+// holding the padding length, and split into 2 data and 2 parity shards with
+// Reed-Solomon.
+var metadataValueShards = []string{
+	"a0a1a2a3a4a5a6a7a8a9aaabe4187c2d45cb02bf636587d3077ac0de60bd4b0386a2547b84173c9d63b66b1ed27647ffbf22533d5f9c04c8394bb1ca732e707f5ae97b1c223a6e38a47085b0b7bc856f30a5e4e0f4e2ff188fceccbaed2a8987e1e4bf5dc65c14b19db763bb8e842bab03ae8f9b9fdb06508288ed28245061aedf359b3c05cdc6a6b40bf24dc511b07fd34280169b7fff8f124a91d688d9ad05cdfd",
+	"9b8dfbcdbdf5afc7342bb57d7cc3d31e4116820a2b226fd286d04515c9ad34519607b8b94a0462bd1d5734364cc960d1bbedf35d43cf492432b552e9e0e83f63d8b8edc152e55dc4764169553221b96dd93fc0d23172200b427f0bbdc23f895230c629eee92f237460db5d7485caa183a3e066a35785673b6dd338110b50bbbac32af86716dae2b08e2d9b4bea842002ee9636ec42af9d5900a417ed4487685b0202",
+	"d6f9107f9605b4678db0941ac9b33f4b4d6c1fc8f3eb4ad11833d7552f9db5a7a6f591e2053180dd9f69d54ef31509a3b7a10efd673a9e0d2faa6a8c48bfee47434b4abbc29908dd1d124067a09bfd6bff8cac8463df5c3e08b15fb4b30089305ea08e2698ba7a267a6f1f38981822fb5e3240eb1267c486413e5a5a7a50c886e70b5d8a23e38e8ac04720419b268d85a9f7f1ff34c23b3e368b80a00d653ab94e1e",
+	"edd549118f55bd0711328bcc5168907849b19f7dbbaca2d09999529e868dcaf5b6507d20cb22defde1888a666daa2e8db36eae9d7b69d3e1245489afdb79a15bc11adc66b2463b21cf23ac822506c169161688b6a64f832dc50098b39c1589e58f821895b7c94de3870321f79356a8d3fe7ca9d3da39a5edae658f6355501292fb143ed130f4aa9cfa614947b4b31df894234705ed1259e82465069bc13bffe781e1",
+}
+
+func newTestMetaStore(t *testing.T) *MetaStore {
+	t.Helper()
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := reedsolomon.New(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MetaStore{aead: aead, encoder: encoder, dataShards: 2}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	got, err := decodeMetadata(mustHex(metadataFixture))
+	if err != nil {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+	if !reflect.DeepEqual(*got, metadataFixtureDecoded) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", *got, metadataFixtureDecoded)
+	}
+}
+
+func TestDecodeMetadataTruncated(t *testing.T) {
+	data := mustHex(metadataFixture)
+	for n := 0; n < len(data); n++ {
+		if _, err := decodeMetadata(data[:n]); err == nil {
+			t.Errorf("decoding the first %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+func TestDecodeMetadataInvalidVariant(t *testing.T) {
+	data := mustHex(metadataFixture)
+	// The compression variant follows the two counts, the checksum and the
+	// encryption key
+	offset := 8 + 8 + 16 + 4 + 8 + 16
+	data[offset] = 7
+	if _, err := decodeMetadata(data); err == nil {
+		t.Error("decoding an unknown compression variant succeeded")
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	store := newTestMetaStore(t)
+
+	// Any two of the four shards are enough
+	for first := 0; first < 4; first++ {
+		for second := first; second < 4; second++ {
+			shards := make([][]byte, 4)
+			for i, shard := range metadataValueShards {
+				if i != first && i != second {
+					shards[i] = mustHex(shard)
+				}
+			}
+			got, err := store.decodeValue(shards)
+			if err != nil {
+				t.Errorf("without shards %d and %d: %v", first, second, err)
+				continue
+			}
+			if !reflect.DeepEqual(*got, metadataFixtureDecoded) {
+				t.Errorf("without shards %d and %d: decoded %+v", first, second, *got)
+			}
+		}
+	}
+}
+
+func TestDecodeValueErrors(t *testing.T) {
+	store := newTestMetaStore(t)
+
+	onlyOne := make([][]byte, 4)
+	onlyOne[2] = mustHex(metadataValueShards[2])
+	if _, err := store.decodeValue(onlyOne); err == nil {
+		t.Error("decoding from a single shard succeeded")
+	}
+
+	tampered := make([][]byte, 4)
+	for i, shard := range metadataValueShards {
+		tampered[i] = mustHex(shard)
+	}
+	tampered[0][20] ^= 0xff
+	if _, err := store.decodeValue(tampered); err == nil {
+		t.Error("decoding a tampered value succeeded")
+	}
+}
+
+func TestShardOrder(t *testing.T) {
+	store := newTestMetaStore(t)
+
+	// The backends as a config rebuilt from contract order lists them, after
+	// the backend holding shard 1 was replaced
+	shards := make([][]byte, 4)
+	for i, backend := range []int{0, 3, 1, 2} {
+		shards[backend] = mustHex(metadataValueShards[i])
+	}
+	order, ok := store.shardOrder(shards)
+	if !ok {
+		t.Fatal("no order decodes the shards")
+	}
+	if want := []int{0, 3, 1, 2}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+
+	shards[2] = nil
+	if _, ok := store.shardOrder(shards); ok {
+		t.Error("placed a value with a missing shard")
+	}
+}
+
+func TestMetaShardCounts(t *testing.T) {
+	tests := []struct {
+		backends     int
+		dataShards   int
+		parityShards int
+		wantErr      bool
+	}{
+		{backends: 4, dataShards: 2, parityShards: 2},
+		{backends: 5, dataShards: 2, parityShards: 3},
+		{backends: 6, dataShards: 3, parityShards: 3},
+		{backends: 1, wantErr: true},
+		{backends: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		dataShards, parityShards, err := metaShardCounts(tt.backends)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d backends: got error %v, want error %v", tt.backends, err, tt.wantErr)
+			continue
+		}
+		if dataShards != tt.dataShards || parityShards != tt.parityShards {
+			t.Errorf("%d backends: got %d+%d shards, want %d+%d", tt.backends, dataShards, parityShards, tt.dataShards, tt.parityShards)
+		}
+	}
+}
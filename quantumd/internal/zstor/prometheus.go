@@ -3,7 +3,9 @@ package zstor
 import (
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,18 +20,38 @@ type BackendStatus struct {
 	Namespace   string
 	IsAlive     bool
 	LastSeen    time.Time
+	// DeadSince is when the backend was first found dead in a row of
+	// scrapes, zero while it's alive. It's reset when the daemon restarts.
+	DeadSince time.Time
 }
 
-// MetricsScraper handles scraping and storing zstor backend status metrics
+// DeadFor returns how long the backend has been dead, or zero if it's alive
+func (s BackendStatus) DeadFor(now time.Time) time.Duration {
+	if s.IsAlive || s.DeadSince.IsZero() {
+		return 0
+	}
+	return now.Sub(s.DeadSince)
+}
+
+// MetricsScraper handles scraping and storing zstor backend status metrics.
+// Each scrape publishes a new snapshot of the backend statuses, so readers
+// never see a scrape half applied. It's safe for concurrent use.
 type MetricsScraper struct {
 	configPath     string
-	backendStatus  map[string]*BackendStatus
 	statusGauge    *prometheus.GaugeVec
 	lastScrapeTime prometheus.Gauge
+
+	// scrapeMu serializes scrapes, so no update is lost between two of them
+	scrapeMu sync.Mutex
+
+	// mu guards the snapshot pointer. A published snapshot is never modified.
+	mu            sync.RWMutex
+	backendStatus map[string]BackendStatus
 }
 
-// NewMetricsScraper creates a new metrics scraper
-func NewMetricsScraper(configPath string) (*MetricsScraper, error) {
+// NewMetricsScraper creates a new metrics scraper, with its metrics registered
+// on reg. The daemon passes the default registry it serves.
+func NewMetricsScraper(configPath string, reg prometheus.Registerer) (*MetricsScraper, error) {
 	// Create prometheus metrics
 	statusGauge := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -47,12 +69,12 @@ func NewMetricsScraper(configPath string) (*MetricsScraper, error) {
 	)
 
 	// Register metrics
-	prometheus.MustRegister(statusGauge)
-	prometheus.MustRegister(lastScrapeTime)
+	reg.MustRegister(statusGauge)
+	reg.MustRegister(lastScrapeTime)
 
 	scraper := &MetricsScraper{
 		configPath:     configPath,
-		backendStatus:  make(map[string]*BackendStatus),
+		backendStatus:  make(map[string]BackendStatus),
 		statusGauge:    statusGauge,
 		lastScrapeTime: lastScrapeTime,
 	}
@@ -100,19 +122,31 @@ func (ms *MetricsScraper) ScrapeMetrics() error {
 		return fmt.Errorf("failed to parse metrics: %w", err)
 	}
 
+	// Build the next snapshot from the current one, so backends missing from
+	// this scrape keep their last known status
+	ms.scrapeMu.Lock()
+	defer ms.scrapeMu.Unlock()
+	statuses := maps.Clone(ms.GetBackendStatuses())
+
 	metricCount := 0
 	// Process connection_status metrics
 	if family, exists := metricFamilies["connection_status"]; exists {
+		now := time.Now()
 		for _, metric := range family.Metric {
-			ms.processConnectionStatusMetric(metric)
+			processConnectionStatusMetric(statuses, metric, now)
 			metricCount++
 		}
 	}
 
 	log.Printf("Found %d connection_status metrics", metricCount)
 
+	// Publish the new snapshot
+	ms.mu.Lock()
+	ms.backendStatus = statuses
+	ms.mu.Unlock()
+
 	// Update prometheus metrics
-	ms.updatePrometheusMetrics()
+	ms.updatePrometheusMetrics(statuses)
 
 	// Update last scrape time
 	ms.lastScrapeTime.Set(float64(time.Now().Unix()))
@@ -120,8 +154,9 @@ func (ms *MetricsScraper) ScrapeMetrics() error {
 	return nil
 }
 
-// processConnectionStatusMetric processes a connection_status metric
-func (ms *MetricsScraper) processConnectionStatusMetric(metric *dto.Metric) {
+// processConnectionStatusMetric processes a connection_status metric into a
+// snapshot that hasn't been published yet
+func processConnectionStatusMetric(statuses map[string]BackendStatus, metric *dto.Metric, now time.Time) {
 	var address, backendType, namespace string
 
 	// Extract labels
@@ -152,25 +187,32 @@ func (ms *MetricsScraper) processConnectionStatusMetric(metric *dto.Metric) {
 	// Create a unique key for this backend
 	key := fmt.Sprintf("%s-%s-%s", address, backendType, namespace)
 
-	// Update or create backend status
-	status, exists := ms.backendStatus[key]
-	if !exists {
-		status = &BackendStatus{
-			Address:     address,
-			BackendType: backendType,
-			Namespace:   namespace,
+	// Keep when the backend was first found dead, to know how long it's been
+	// down
+	alive := value == 1
+	var deadSince time.Time
+	if !alive {
+		deadSince = now
+		if previous, exists := statuses[key]; exists && !previous.IsAlive && !previous.DeadSince.IsZero() {
+			deadSince = previous.DeadSince
 		}
-		ms.backendStatus[key] = status
 	}
 
-	status.IsAlive = value == 1
-	status.LastSeen = time.Now()
+	// Update or create backend status
+	statuses[key] = BackendStatus{
+		Address:     address,
+		BackendType: backendType,
+		Namespace:   namespace,
+		IsAlive:     alive,
+		LastSeen:    now,
+		DeadSince:   deadSince,
+	}
 }
 
 // updatePrometheusMetrics updates the prometheus metrics with current backend status
-func (ms *MetricsScraper) updatePrometheusMetrics() {
-	log.Printf("Updating prometheus metrics with %d backend statuses", len(ms.backendStatus))
-	for key, status := range ms.backendStatus {
+func (ms *MetricsScraper) updatePrometheusMetrics(statuses map[string]BackendStatus) {
+	log.Printf("Updating prometheus metrics with %d backend statuses", len(statuses))
+	for key, status := range statuses {
 		value := 0.0
 		if status.IsAlive {
 			value = 1.0
@@ -190,7 +232,7 @@ func (ms *MetricsScraper) updatePrometheusMetrics() {
 // GetBackendLastSeen returns the last time a backend was seen alive
 func (ms *MetricsScraper) GetBackendLastSeen(address, backendType, namespace string) (time.Time, bool) {
 	key := fmt.Sprintf("%s-%s-%s", address, backendType, namespace)
-	status, exists := ms.backendStatus[key]
+	status, exists := ms.GetBackendStatuses()[key]
 	if !exists {
 		return time.Time{}, false
 	}
@@ -198,8 +240,10 @@ func (ms *MetricsScraper) GetBackendLastSeen(address, backendType, namespace str
 	return status.LastSeen, true
 }
 
-// GetBackendStatuses returns all current backend statuses
-func (ms *MetricsScraper) GetBackendStatuses() map[string]*BackendStatus {
-	log.Printf("Returning %d backend statuses", len(ms.backendStatus))
+// GetBackendStatuses returns a snapshot of all current backend statuses. The
+// snapshot is shared between callers and must not be modified.
+func (ms *MetricsScraper) GetBackendStatuses() map[string]BackendStatus {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
 	return ms.backendStatus
 }
@@ -0,0 +1,123 @@
+package zstor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeZstorMetrics serves zstor's connection_status metrics, with the data
+// backend's status taken from alive on each request
+func fakeZstorMetrics(t *testing.T, alive *atomic.Bool) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := 0
+		if alive.Load() {
+			status = 1
+		}
+		fmt.Fprintln(w, "# TYPE connection_status gauge")
+		fmt.Fprintln(w, `connection_status{address="[2a02::1]:9900",backend_type="meta",namespace="meta1"} 1`)
+		fmt.Fprintf(w, "connection_status{address=\"[2a02::2]:9900\",backend_type=\"data\",namespace=\"data1\"} %d\n", status)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(t.TempDir(), "zstor.toml")
+	if err := os.WriteFile(configPath, []byte("prometheus_port = "+u.Port()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestMetricsScraperDeadSince(t *testing.T) {
+	var alive atomic.Bool
+	scraper, err := NewMetricsScraper(fakeZstorMetrics(t, &alive), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "[2a02::2]:9900-data-data1"
+
+	if err := scraper.ScrapeMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := scraper.GetBackendStatuses()
+	first := snapshot[key]
+	if first.IsAlive || first.DeadSince.IsZero() {
+		t.Fatalf("got %+v after the first scrape, want a dead backend", first)
+	}
+
+	// Staying dead keeps the time it was first found dead
+	if err := scraper.ScrapeMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if second := scraper.GetBackendStatuses()[key]; !second.DeadSince.Equal(first.DeadSince) {
+		t.Errorf("dead since moved from %s to %s", first.DeadSince, second.DeadSince)
+	}
+
+	alive.Store(true)
+	if err := scraper.ScrapeMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if third := scraper.GetBackendStatuses()[key]; !third.IsAlive || third.DeadFor(time.Now()) != 0 {
+		t.Errorf("got %+v once the backend is back, want it alive", third)
+	}
+	// Published snapshots are never modified by later scrapes
+	if snapshot[key].IsAlive {
+		t.Error("the first snapshot changed with a later scrape")
+	}
+}
+
+// TestMetricsScraperConcurrent scrapes while other goroutines read the
+// snapshots, as the daemon's main loop, repairs and the control API do. Run
+// it with -race.
+func TestMetricsScraperConcurrent(t *testing.T) {
+	var alive atomic.Bool
+	scraper, err := NewMetricsScraper(fakeZstorMetrics(t, &alive), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				alive.Store(j%2 == 0)
+				if err := scraper.ScrapeMetrics(); err != nil {
+					t.Errorf("scrape failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				for _, status := range scraper.GetBackendStatuses() {
+					status.DeadFor(time.Now())
+				}
+				scraper.GetBackendLastSeen("[2a02::1]:9900", "meta", "meta1")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if statuses := scraper.GetBackendStatuses(); len(statuses) != 2 {
+		t.Errorf("got %d backend statuses, want 2", len(statuses))
+	}
+}
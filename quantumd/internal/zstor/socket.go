@@ -0,0 +1,338 @@
+package zstor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Command variants of zstor's socket protocol, in the order they are
+// declared in zstor's ZstorCommand enum
+const (
+	commandStore uint32 = iota
+	commandRetrieve
+	commandRebuild
+	commandCheck
+)
+
+// Response variants of zstor's socket protocol
+const (
+	responseSuccess uint32 = iota
+	responseErr
+	responseChecksum
+)
+
+// dialTimeout bounds connecting to the monitor socket. Commands themselves
+// are not bounded, since a blocking store takes as long as the upload.
+const dialTimeout = 5 * time.Second
+
+// CommandError is an error reported by the zstor monitor for a command
+type CommandError struct {
+	Command string
+	Path    string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("zstor %s of %s failed: %s", e.Command, e.Path, e.Message)
+}
+
+// SocketClient implements Client by sending commands to the socket of a
+// running zstor monitor. Calls fall back to the exec client when the socket
+// can't be reached or the monitor doesn't answer, and operations without a
+// socket command always use it.
+type SocketClient struct {
+	*ExecClient
+	SocketPath string
+}
+
+// NewSocketClient creates a zstor client that talks to the monitor listening
+// on the given socket
+func NewSocketClient(socketPath string, fallback *ExecClient) *SocketClient {
+	return &SocketClient{
+		ExecClient: fallback,
+		SocketPath: socketPath,
+	}
+}
+
+// Store uploads a single file to zstor and waits for the upload to finish
+func (c *SocketClient) Store(filePath string) error {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil // Don't treat non-existent files as an error
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("zstor socket unavailable (%v), falling back to the zstor binary", err)
+		return c.ExecClient.Store(filePath)
+	}
+	defer conn.Close()
+
+	if err := c.send(conn, "store", filePath, encodeStore(filePath, "", false)); err != nil {
+		if monitorFailed(err) {
+			log.Printf("zstor socket failed (%v), falling back to the zstor binary", err)
+			return c.ExecClient.Store(filePath)
+		}
+		return err
+	}
+	log.Printf("Successfully stored: %s", filePath)
+	return nil
+}
+
+// StoreBatch uploads a batch of files from a temporary directory, keyed by
+// their original directory
+func (c *SocketClient) StoreBatch(files []string, originalDir string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("zstor socket unavailable (%v), falling back to the zstor binary", err)
+		return c.ExecClient.StoreBatch(files, originalDir)
+	}
+	defer conn.Close()
+
+	tmpDir, err := stageBatch(files)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := c.send(conn, "store", tmpDir, encodeStore(tmpDir, originalDir, true)); err != nil {
+		if monitorFailed(err) {
+			log.Printf("zstor socket failed (%v), falling back to the zstor binary", err)
+			return c.ExecClient.StoreBatch(files, originalDir)
+		}
+		return err
+	}
+	log.Printf("Successfully stored batch from: %s", tmpDir)
+	return nil
+}
+
+// Check retrieves the remote hash of a file. A file that zstor doesn't know
+// about has an empty hash, while other failures the monitor reports are
+// returned as a *CommandError.
+func (c *SocketClient) Check(filePath string) (string, error) {
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("zstor socket unavailable (%v), falling back to the zstor binary", err)
+		return c.ExecClient.Check(filePath)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	writeU32(&buf, commandCheck)
+	writeString(&buf, filePath)
+
+	checksum, err := c.roundTrip(conn, buf.Bytes())
+	if err != nil {
+		if monitorFailed(err) {
+			log.Printf("zstor socket failed (%v), falling back to the zstor binary", err)
+			return c.ExecClient.Check(filePath)
+		}
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) && isNotFound(cmdErr) {
+			return "", nil
+		}
+		cmdErr.Command = "check"
+		cmdErr.Path = filePath
+		return "", err
+	}
+	return hex.EncodeToString(checksum), nil
+}
+
+// Retrieve downloads a file from zstor
+func (c *SocketClient) Retrieve(filePath string) error {
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("zstor socket unavailable (%v), falling back to the zstor binary", err)
+		return c.ExecClient.Retrieve(filePath)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	writeU32(&buf, commandRetrieve)
+	writeString(&buf, filePath)
+
+	if err := c.send(conn, "retrieve", filePath, buf.Bytes()); err != nil {
+		if monitorFailed(err) {
+			log.Printf("zstor socket failed (%v), falling back to the zstor binary", err)
+			return c.ExecClient.Retrieve(filePath)
+		}
+		return err
+	}
+	log.Printf("Successfully retrieved: %s", filePath)
+	return nil
+}
+
+// Rebuild re-encodes a stored file onto the currently healthy backends
+func (c *SocketClient) Rebuild(filePath string) error {
+	conn, err := c.dial()
+	if err != nil {
+		log.Printf("zstor socket unavailable (%v), falling back to the zstor binary", err)
+		return c.ExecClient.Rebuild(filePath)
+	}
+	defer conn.Close()
+
+	// A rebuild takes either a file or a raw metadata key, of which only the
+	// file is used
+	var buf bytes.Buffer
+	writeU32(&buf, commandRebuild)
+	buf.WriteByte(1)
+	writeString(&buf, filePath)
+	buf.WriteByte(0)
+
+	if err := c.send(conn, "rebuild", filePath, buf.Bytes()); err != nil {
+		if monitorFailed(err) {
+			log.Printf("zstor socket failed (%v), falling back to the zstor binary", err)
+			return c.ExecClient.Rebuild(filePath)
+		}
+		return err
+	}
+	log.Printf("Successfully rebuilt: %s", filePath)
+	return nil
+}
+
+func (c *SocketClient) dial() (net.Conn, error) {
+	return net.DialTimeout("unix", c.SocketPath, dialTimeout)
+}
+
+// monitorFailed reports whether a command got no answer from the monitor, as
+// when it went away mid-command, rather than the monitor reporting a failure.
+// Such commands are run through the zstor binary instead.
+func monitorFailed(err error) bool {
+	var cmdErr *CommandError
+	return !errors.As(err, &cmdErr)
+}
+
+// isNotFound reports whether the monitor failed a command because it has no
+// metadata for the file
+func isNotFound(err *CommandError) bool {
+	return strings.Contains(strings.ToLower(err.Message), "not found")
+}
+
+// send runs a command that is expected to answer with a plain success
+func (c *SocketClient) send(conn net.Conn, command, path string, payload []byte) error {
+	if _, err := c.roundTrip(conn, payload); err != nil {
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			cmdErr.Command = command
+			cmdErr.Path = path
+		}
+		return err
+	}
+	return nil
+}
+
+// roundTrip writes a length prefixed command and reads the response. It
+// returns the checksum for checksum responses and a *CommandError when zstor
+// reports a failure.
+func (c *SocketClient) roundTrip(conn net.Conn, payload []byte) ([]byte, error) {
+	if len(payload) > 0xffff {
+		return nil, fmt.Errorf("zstor command too large: %d bytes", len(payload))
+	}
+
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[2:], payload)
+	if _, err := conn.Write(frame); err != nil {
+		return nil, fmt.Errorf("failed to send command to zstor: %w", err)
+	}
+
+	var size uint16
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, fmt.Errorf("failed to read zstor response: %w", err)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("failed to read zstor response: %w", err)
+	}
+
+	r := bytes.NewReader(resp)
+	var variant uint32
+	if err := binary.Read(r, binary.LittleEndian, &variant); err != nil {
+		return nil, fmt.Errorf("malformed zstor response: %w", err)
+	}
+	switch variant {
+	case responseSuccess:
+		return nil, nil
+	case responseErr:
+		message, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("malformed zstor response: %w", err)
+		}
+		return nil, &CommandError{Message: message}
+	case responseChecksum:
+		checksum := make([]byte, 16)
+		if _, err := io.ReadFull(r, checksum); err != nil {
+			return nil, fmt.Errorf("malformed zstor response: %w", err)
+		}
+		return checksum, nil
+	default:
+		return nil, fmt.Errorf("unknown zstor response variant %d", variant)
+	}
+}
+
+// encodeStore encodes a blocking store command. The flags match what the exec
+// client passes on the command line: failures are saved for zstor to retry,
+// and batch directories are deleted once stored.
+func encodeStore(path, keyPath string, isBatch bool) []byte {
+	var buf bytes.Buffer
+	writeU32(&buf, commandStore)
+	writeString(&buf, path)
+	if keyPath != "" {
+		buf.WriteByte(1)
+		writeString(&buf, keyPath)
+	} else {
+		buf.WriteByte(0)
+	}
+	writeBool(&buf, true)    // save_failure
+	writeBool(&buf, isBatch) // delete
+	writeBool(&buf, true)    // blocking
+	return buf.Bytes()
+}
+
+// The helpers below follow bincode's default encoding, which zstor uses for
+// its socket messages: little endian fixed size integers, and strings
+// prefixed with their length as a u64.
+
+func writeU32(buf *bytes.Buffer, v uint32) {
+	binary.Write(buf, binary.LittleEndian, v)
+}
+
+func writeBool(buf *bytes.Buffer, v bool) {
+	if v {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var size uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return "", err
+	}
+	if size > uint64(r.Len()) {
+		return "", fmt.Errorf("string length %d exceeds message", size)
+	}
+	s := make([]byte, size)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
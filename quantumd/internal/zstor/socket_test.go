@@ -0,0 +1,299 @@
+package zstor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The frames below are spelled out byte by byte from zstor's socket protocol:
+// a u16 big endian length, followed by the bincode encoding of a ZstorCommand
+// or ZstorResponse. Variants are u32 little endian in declaration order,
+// strings and paths carry a u64 little endian length, options a u8 tag.
+const testPath = "/data/d1"
+
+var (
+	// ZstorCommand::Retrieve(Retrieve { file: "/data/d1" })
+	retrieveFrame = "0014" +
+		"01000000" +
+		"0800000000000000" + hex.EncodeToString([]byte(testPath))
+
+	// ZstorCommand::Rebuild(Rebuild { file: Some("/data/d1"), key: None })
+	rebuildFrame = "0016" +
+		"02000000" +
+		"01" + "0800000000000000" + hex.EncodeToString([]byte(testPath)) +
+		"00"
+
+	// ZstorCommand::Check(Check { path: "/data/d1" })
+	checkFrame = "0014" +
+		"03000000" +
+		"0800000000000000" + hex.EncodeToString([]byte(testPath))
+
+	// ZstorResponse::Success
+	successFrame = "0004" + "00000000"
+
+	// ZstorResponse::Err("not found")
+	errFrame = "0015" +
+		"01000000" +
+		"0900000000000000" + hex.EncodeToString([]byte("not found"))
+
+	// ZstorResponse::Err("backend timeout")
+	timeoutFrame = "001b" +
+		"01000000" +
+		"0f00000000000000" + hex.EncodeToString([]byte("backend timeout"))
+
+	// ZstorResponse::Checksum([0x00, 0x01, ..., 0x0f])
+	checksumFrame = "0014" +
+		"02000000" +
+		"000102030405060708090a0b0c0d0e0f"
+)
+
+// storeFrame is ZstorCommand::Store(Store { file, key_path: None,
+// save_failure: true, delete: false, blocking: true }). Store skips files that
+// don't exist, so its frame is built for a real temporary file.
+func storeFrame(file string) string {
+	length := 4 + 8 + len(file) + 1 + 3
+	return hex.EncodeToString(binary.BigEndian.AppendUint16(nil, uint16(length))) +
+		"00000000" +
+		hex.EncodeToString(binary.LittleEndian.AppendUint64(nil, uint64(len(file)))) + hex.EncodeToString([]byte(file)) +
+		"00" +
+		"01" + "00" + "01"
+}
+
+// fakeMonitor answers each connection on a unix socket with a fixed frame,
+// and records the frame it received. An empty reply closes the connection
+// without answering.
+type fakeMonitor struct {
+	listener net.Listener
+	reply    []byte
+	received chan []byte
+}
+
+func newFakeMonitor(t *testing.T, reply string) *fakeMonitor {
+	t.Helper()
+	replyBytes, err := hex.DecodeString(reply)
+	if err != nil {
+		t.Fatalf("invalid reply frame: %v", err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "zstor.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	m := &fakeMonitor{listener: listener, reply: replyBytes, received: make(chan []byte, 16)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			m.handle(conn)
+		}
+	}()
+	return m
+}
+
+func (m *fakeMonitor) handle(conn net.Conn) {
+	defer conn.Close()
+	var size uint16
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return
+	}
+	frame := binary.BigEndian.AppendUint16(nil, size)
+	m.received <- append(frame, payload...)
+	if len(m.reply) > 0 {
+		conn.Write(m.reply)
+	}
+}
+
+func (m *fakeMonitor) path() string {
+	return m.listener.Addr().String()
+}
+
+// fakeZstorBinary writes a script that records its arguments, standing in for
+// the zstor binary of the exec client
+func fakeZstorBinary(t *testing.T, output string) (*ExecClient, string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsPath + "\necho " + output + "\n"
+	binaryPath := filepath.Join(dir, "zstor")
+	if err := os.WriteFile(binaryPath, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake zstor binary: %v", err)
+	}
+	return &ExecClient{BinaryPath: binaryPath, ConfigPath: "/etc/zstor.toml"}, argsPath
+}
+
+func readArgs(t *testing.T, argsPath string) string {
+	t.Helper()
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(args))
+}
+
+func expectFrame(t *testing.T, m *fakeMonitor, want string) {
+	t.Helper()
+	select {
+	case got := <-m.received:
+		if hex.EncodeToString(got) != want {
+			t.Errorf("sent frame\n%x\nwant\n%s", got, want)
+		}
+	default:
+		t.Errorf("no frame sent to the monitor")
+	}
+}
+
+func TestSocketClientFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		call  func(c *SocketClient) error
+		frame string
+	}{
+		{"retrieve", func(c *SocketClient) error { return c.Retrieve(testPath) }, retrieveFrame},
+		{"rebuild", func(c *SocketClient) error { return c.Rebuild(testPath) }, rebuildFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFakeMonitor(t, successFrame)
+			exec, argsPath := fakeZstorBinary(t, "")
+			if err := tt.call(NewSocketClient(m.path(), exec)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expectFrame(t, m, tt.frame)
+			if args := readArgs(t, argsPath); args != "" {
+				t.Errorf("zstor binary ran with %q, expected only the socket to be used", args)
+			}
+		})
+	}
+}
+
+func TestSocketClientStoreFrame(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "d1")
+	if err := os.WriteFile(filePath, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newFakeMonitor(t, successFrame)
+	exec, _ := fakeZstorBinary(t, "")
+	if err := NewSocketClient(m.path(), exec).Store(filePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectFrame(t, m, storeFrame(filePath))
+}
+
+func TestSocketClientCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"checksum", checksumFrame, "000102030405060708090a0b0c0d0e0f"},
+		{"unknown file", errFrame, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFakeMonitor(t, tt.reply)
+			exec, _ := fakeZstorBinary(t, "")
+			got, err := NewSocketClient(m.path(), exec).Check(testPath)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got checksum %q, want %q", got, tt.want)
+			}
+			expectFrame(t, m, checkFrame)
+		})
+	}
+}
+
+func TestSocketClientCheckError(t *testing.T) {
+	m := newFakeMonitor(t, timeoutFrame)
+	exec, _ := fakeZstorBinary(t, "")
+	got, err := NewSocketClient(m.path(), exec).Check(testPath)
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("got checksum %q and error %v, want a CommandError", got, err)
+	}
+	if cmdErr.Command != "check" || cmdErr.Path != testPath || cmdErr.Message != "backend timeout" {
+		t.Errorf("got %+v", *cmdErr)
+	}
+}
+
+func TestSocketClientCommandError(t *testing.T) {
+	m := newFakeMonitor(t, errFrame)
+	exec, argsPath := fakeZstorBinary(t, "")
+	err := NewSocketClient(m.path(), exec).Retrieve(testPath)
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("got error %v, want a CommandError", err)
+	}
+	if cmdErr.Command != "retrieve" || cmdErr.Path != testPath || cmdErr.Message != "not found" {
+		t.Errorf("got %+v", *cmdErr)
+	}
+	// zstor answered, so running the binary wouldn't help
+	if args := readArgs(t, argsPath); args != "" {
+		t.Errorf("zstor binary ran with %q after a command error", args)
+	}
+}
+
+func TestSocketClientFallback(t *testing.T) {
+	unreachable := filepath.Join(t.TempDir(), "missing.sock")
+
+	tests := []struct {
+		name       string
+		socketPath func(t *testing.T) string
+	}{
+		{"socket unreachable", func(t *testing.T) string { return unreachable }},
+		{"monitor hangs up", func(t *testing.T) string { return newFakeMonitor(t, "").path() }},
+		{"malformed response", func(t *testing.T) string { return newFakeMonitor(t, "000107").path() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exec, argsPath := fakeZstorBinary(t, "abcd")
+			c := NewSocketClient(tt.socketPath(t), exec)
+
+			if err := c.Retrieve(testPath); err != nil {
+				t.Fatalf("retrieve through fallback failed: %v", err)
+			}
+			if args, want := readArgs(t, argsPath), "-c /etc/zstor.toml retrieve --file "+testPath; args != want {
+				t.Errorf("zstor binary ran with %q, want %q", args, want)
+			}
+
+			checksum, err := c.Check(testPath)
+			if err != nil {
+				t.Fatalf("check through fallback failed: %v", err)
+			}
+			if checksum != "abcd" {
+				t.Errorf("got checksum %q from fallback, want %q", checksum, "abcd")
+			}
+		})
+	}
+}
+
+func TestRoundTripRejectsOversizedCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := &SocketClient{}
+	_, err := c.roundTrip(client, bytes.Repeat([]byte{0}, 0x10000))
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("got error %v, want a too large error", err)
+	}
+}
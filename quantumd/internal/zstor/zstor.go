@@ -1,6 +1,7 @@
 package zstor
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -9,19 +10,20 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"golang.org/x/crypto/blake2b"
 )
 
-// Client provides a high-level API for interacting with the zstor binary.
-type Client struct {
-	BinaryPath          string
-	ConfigPath          string
-	MetadataDecoderPath string
+// ExecClient implements Client by running the zstor binary for each call.
+type ExecClient struct {
+	BinaryPath string
+	ConfigPath string
+	MetaStore  *MetaStore
 }
 
-// NewClient creates a new zstor client.
-func NewClient(configPath string) (*Client, error) {
+// NewExecClient creates a zstor client that runs the zstor binary.
+func NewExecClient(configPath string) (*ExecClient, error) {
 	zstorPath, err := exec.LookPath("zstor")
 	if err != nil {
 		return nil, fmt.Errorf("zstor binary not found in PATH: %w", err)
@@ -31,28 +33,40 @@ func NewClient(configPath string) (*Client, error) {
 		return nil, fmt.Errorf("zstor config not found at %s", configPath)
 	}
 
-	decoderPath, err := exec.LookPath("zstor-metadata-decoder")
+	cfg, err := LoadConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("zstor-metadata-decoder binary not found in PATH: %w", err)
+		return nil, err
+	}
+	metaStore, err := NewMetaStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up metadata reader: %w", err)
 	}
 
-	return &Client{
-		BinaryPath:          zstorPath,
-		ConfigPath:          configPath,
-		MetadataDecoderPath: decoderPath,
+	return &ExecClient{
+		BinaryPath: zstorPath,
+		ConfigPath: configPath,
+		MetaStore:  metaStore,
 	}, nil
 }
 
+// command builds a zstor command in its own process group, so a signal meant
+// for the daemon doesn't abort uploads and retrievals it is still waiting for
+func (c *ExecClient) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(c.BinaryPath, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
 // Store uploads a single file to zstor. This is primarily for data files.
 // Index files should use StoreBatch.
-func (c *Client) Store(filePath string) error {
+func (c *ExecClient) Store(filePath string) error {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil // Don't treat non-existent files as an error
 	}
 
 	args := []string{"-c", c.ConfigPath, "store", "-s", "--file", filePath}
 
-	cmd := exec.Command(c.BinaryPath, args...)
+	cmd := c.command(args...)
 	log.Printf("Executing: %s", cmd.String())
 
 	output, err := cmd.CombinedOutput()
@@ -65,31 +79,21 @@ func (c *Client) Store(filePath string) error {
 }
 
 // StoreBatch uploads a batch of files from a temporary directory.
-func (c *Client) StoreBatch(files []string, originalDir string) error {
+func (c *ExecClient) StoreBatch(files []string, originalDir string) error {
 	if len(files) == 0 {
 		return nil
 	}
 
-	tmpDir, err := os.MkdirTemp("/tmp", "zstor-batch-upload-")
+	tmpDir, err := stageBatch(files)
 	if err != nil {
-		return fmt.Errorf("failed to create temp dir for batch upload: %w", err)
+		return err
 	}
 	defer os.RemoveAll(tmpDir)
 
-	for _, file := range files {
-		if _, err := os.Stat(file); os.IsNotExist(err) {
-			continue // Skip non-existent files
-		}
-		tmpPath := filepath.Join(tmpDir, filepath.Base(file))
-		if err := copyFile(file, tmpPath); err != nil {
-			return fmt.Errorf("failed to copy file %s to temp dir: %w", file, err)
-		}
-	}
-
 	// -d for directory mode, -f for file (which is actually the directory path here)
 	args := []string{"-c", c.ConfigPath, "store", "-s", "-d", "-f", tmpDir, "-k", originalDir}
 
-	cmd := exec.Command(c.BinaryPath, args...)
+	cmd := c.command(args...)
 	log.Printf("Executing batch store: %s", cmd.String())
 
 	output, err := cmd.CombinedOutput()
@@ -101,9 +105,30 @@ func (c *Client) StoreBatch(files []string, originalDir string) error {
 	return nil
 }
 
+// stageBatch copies a batch of files into a new temporary directory, so they
+// can be stored together as one directory. The caller removes the directory.
+func stageBatch(files []string) (string, error) {
+	tmpDir, err := os.MkdirTemp("/tmp", "zstor-batch-upload-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir for batch upload: %w", err)
+	}
+
+	for _, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue // Skip non-existent files
+		}
+		tmpPath := filepath.Join(tmpDir, filepath.Base(file))
+		if err := copyFile(file, tmpPath); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", fmt.Errorf("failed to copy file %s to temp dir: %w", file, err)
+		}
+	}
+	return tmpDir, nil
+}
+
 // Check retrieves the remote hash of a file.
-func (c *Client) Check(filePath string) (string, error) {
-	cmd := exec.Command(c.BinaryPath, "-c", c.ConfigPath, "check", "--file", filePath)
+func (c *ExecClient) Check(filePath string) (string, error) {
+	cmd := c.command("-c", c.ConfigPath, "check", "--file", filePath)
 	output, err := cmd.Output()
 	if err != nil {
 		// zstor check returns non-zero exit code if file not found, which is not an error here.
@@ -113,8 +138,8 @@ func (c *Client) Check(filePath string) (string, error) {
 }
 
 // Retrieve downloads a file from zstor.
-func (c *Client) Retrieve(filePath string) error {
-	cmd := exec.Command(c.BinaryPath, "-c", c.ConfigPath, "retrieve", "--file", filePath)
+func (c *ExecClient) Retrieve(filePath string) error {
+	cmd := c.command("-c", c.ConfigPath, "retrieve", "--file", filePath)
 	log.Printf("Executing: %s", cmd.String())
 
 	output, err := cmd.CombinedOutput()
@@ -126,9 +151,61 @@ func (c *Client) Retrieve(filePath string) error {
 	return nil
 }
 
+// Rebuild re-encodes a stored file onto the currently healthy backends.
+func (c *ExecClient) Rebuild(filePath string) error {
+	cmd := c.command("-c", c.ConfigPath, "rebuild", "--file", filePath)
+	log.Printf("Executing: %s", cmd.String())
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to rebuild %s: %v. Output: %s", filePath, err, string(output))
+	}
+
+	log.Printf("Successfully rebuilt: %s", filePath)
+	return nil
+}
+
+// RebuildKey re-encodes a stored file by its metadata key, for files that
+// have no local path to refer to them by.
+func (c *ExecClient) RebuildKey(key string) error {
+	cmd := c.command("-c", c.ConfigPath, "rebuild", "--key", key)
+	log.Printf("Executing: %s", cmd.String())
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to rebuild %s: %v. Output: %s", key, err, string(output))
+	}
+
+	log.Printf("Successfully rebuilt: %s", key)
+	return nil
+}
+
+// RefillMetaBackend has zstor store again the metadata of every file that
+// the meta backend at index is missing. zstor writes the metadata to all meta
+// backends in its current config, so a new backend catches up without its
+// shards being written by hand. It returns how many keys were missing, so a
+// caller can repeat it until nothing is left, along with the number of files
+// zstor failed to rebuild.
+func (c *ExecClient) RefillMetaBackend(ctx context.Context, index int) (missing, failed int, err error) {
+	keys, err := c.MetaStore.MissingKeys(ctx, index)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return len(keys), failed, ctx.Err()
+		}
+		if err := c.RebuildKey(key); err != nil {
+			log.Printf("Failed to store metadata %s again: %v", key, err)
+			failed++
+		}
+	}
+	return len(keys), failed, nil
+}
+
 // Test checks the connection to the zstor backend.
-func (c *Client) Test() error {
-	cmd := exec.Command(c.BinaryPath, "-c", c.ConfigPath, "test")
+func (c *ExecClient) Test() error {
+	cmd := c.command("-c", c.ConfigPath, "test")
 	log.Printf("Executing: %s", cmd.String())
 
 	output, err := cmd.CombinedOutput()